@@ -105,7 +105,7 @@ func registerBot() error {
 
 	bot, _ := awsapi.NewBot(awsapi.TGBotKind, tgbotName)
 	bot.Secret = tgbotSecret
-	_, err = table.StoreItem(bot, awsapi.UniqueOp())
+	err = table.StoreItem(bot, awsapi.UniqueOp())
 	if err != nil {
 		return err
 	}
@@ -142,7 +142,7 @@ func inviteUser() error {
 	if err != nil {
 		return err
 	}
-	_, err = table.StoreItem(inv, awsapi.UniqueOp())
+	err = table.StoreItem(inv, awsapi.UniqueOp())
 	if err != nil {
 		return err
 	}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dmitriko/wtctrl/pkg/awsapi"
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
 	"github.com/docopt/docopt-go"
 )
 
@@ -15,10 +22,19 @@ func main() {
 	usage := `Web Tech Control CLI
 
 Usage:
-  wtctrl tgbot register [--table=<table>] [--region=<region>] [--endpoint=<url>] [--bot-name=<name>] [--secret=<secret>]
+  wtctrl tgbot register [--table=<table>] [--region=<region>] [--endpoint=<url>] [--bot-name=<name>] [--secret=<secret>] [--url=<url>]
   wtctrl tgbot invite  [--table=<table>] [--region=<region>] [--endpoint=<url>] [--bot-name=<name>] --title=<title>  [--email=<email>] [--tel=<telephone>]
+  wtctrl tgbot set-commands [--bot-name=<name>] [--secret=<secret>]
+  wtctrl tgbot rotate-token [--table=<table>] [--region=<region>] [--endpoint=<url>] [--bot-name=<name>] [--url=<url>]
+  wtctrl tgbot poll [--table=<table>] [--region=<region>] [--endpoint=<url>] [--bot-name=<name>] [--secret=<secret>] [--timeout=<seconds>]
   wtctrl user create-token [--table=<table>] [--region=<region>] [--endpoint=<url>] [--tel=<telephone>] [--email=<email>]
   wtctrl user send-ws [--table=<table>] [--region=<region>] [--endpoint=<url>] [--tel=<telephone>] [--email=<email>] -m=<message>
+  wtctrl db migrate status [--table=<table>] [--region=<region>] [--endpoint=<url>]
+  wtctrl db migrate up [--dry-run] [--table=<table>] [--region=<region>] [--endpoint=<url>]
+  wtctrl db migrate check [--table=<table>] [--region=<region>] [--endpoint=<url>]
+  wtctrl db export [--table=<table>] [--region=<region>] [--endpoint=<url>] [--segments=<n>] [--prefix=<prefix>...] [--file=<file>]
+  wtctrl db import [--table=<table>] [--region=<region>] [--endpoint=<url>] [--prefix=<prefix>...] [--rewrite-pk=<from:to>...] [--file=<file>]
+  wtctrl scheduler run [--table=<table>] [--region=<region>] [--endpoint=<url>] [--interval=<seconds>] [--once]
   wtctrl -h | --help
 
 Options:
@@ -29,7 +45,16 @@ Options:
   --bot-name=<name>   Name of Telegram bot, default to $TGBOT_NAME
   --secret=<secret>   Secret code of the bot, defaut to $TGBOT_SECRET
   --title=<title>     Title the only required flag to create new user via invite
+  --url=<url>         Webhook URL, <tgwebhook_url>/<bot name>, rotate-token defaults to the one the bot has now
   -m=<message>        Text send to user
+  --dry-run           Show what migrations would do without changing anything
+  --segments=<n>      Parallel scan segments for export [default: 4]
+  --prefix=<prefix>   Export or import only items which PK starts with prefix, like user#
+  --rewrite-pk=<from:to>  Replace prefix of imported keys and of attributes pointing to them
+  --file=<file>       JSON Lines file, default to stdout for export and stdin for import
+  --interval=<seconds>  How often scheduler looks for due reminders [default: 60]
+  --timeout=<seconds>   How long Telegram holds poll request open [default: 30]
+  --once              Send due reminders once and exit
 `
 
 	args, _ := docopt.ParseDoc(usage)
@@ -41,10 +66,17 @@ Options:
 	if args["user"].(bool) {
 		err = user(args)
 	}
+	if args["db"].(bool) {
+		err = db(args)
+	}
+	if args["scheduler"].(bool) {
+		err = scheduler(args)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Done.")
+	// stdout may carry exported items
+	fmt.Fprintln(os.Stderr, "Done.")
 }
 
 var REQUIRED_DEFAULTS = map[string]string{
@@ -178,6 +210,10 @@ func tgbot(args map[string]interface{}) error {
 	}
 	var errs []string
 	for k, _ := range REQUIRED_DEFAULTS {
+		// rotate-token uses the secret stored with the bot
+		if k == "--secret" && args["rotate-token"].(bool) {
+			continue
+		}
 		if args[k].(string) == "" || args[k] == nil {
 			errs = append(errs, fmt.Sprintf("%s must be set", k))
 		}
@@ -188,12 +224,26 @@ func tgbot(args map[string]interface{}) error {
 
 	botName := args["--bot-name"].(string)
 	secret := args["--secret"].(string)
+	if args["set-commands"].(bool) {
+		return tgbotSetCommands(secret)
+	}
 	table, err := tableFromArgs(args)
 	if err != nil {
 		return err
 	}
+	url, _ := args["--url"].(string)
 	if args["register"].(bool) {
-		return tgbotRegister(table, botName, secret)
+		return tgbotRegister(table, botName, secret, url)
+	}
+	if args["poll"].(bool) {
+		timeout, err := strconv.Atoi(args["--timeout"].(string))
+		if err != nil || timeout < 1 {
+			return errors.New("--timeout must be a positive number")
+		}
+		return tgbotPoll(table, botName, secret, time.Duration(timeout)*time.Second)
+	}
+	if args["rotate-token"].(bool) {
+		return tgbotRotateToken(table, botName, url)
 	}
 	if args["invite"].(bool) {
 		var title, tel, email string
@@ -205,15 +255,131 @@ func tgbot(args map[string]interface{}) error {
 	return nil
 }
 
-func tgbotRegister(table *awsapi.DTable, botName, secret string) error {
+func tgbotRegister(table *awsapi.DTable, botName, secret, url string) error {
 	fmt.Println("Registering ", botName)
 	bot, _ := awsapi.NewBot(awsapi.TGBotKind, botName)
 	bot.Secret = secret
-	err := table.StoreItem(bot, awsapi.UniqueOp())
+	var err error
+	// tgwebhook rejects updates of bot without token
+	bot.WebhookToken, err = awsapi.NewWebhookToken()
 	if err != nil {
 		return err
 	}
-	return nil
+	err = table.StoreItem(bot, awsapi.UniqueOp())
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		fmt.Println("Webhook is not set, run wtctrl tgbot rotate-token --url=<url> to set it")
+		return nil
+	}
+	tgbot, err := tb.NewBot(tb.Settings{Token: secret, Synchronous: true})
+	if err != nil {
+		return err
+	}
+	hook, err := tgbot.GetWebhook()
+	if err != nil {
+		return err
+	}
+	return setTGWebhook(tgbot, botName, url, bot.WebhookToken, hook)
+}
+
+// Sets webhook of the bot with secret token, the rest of settings
+// are kept as the bot had them
+func setTGWebhook(tgbot *tb.Bot, botName, url, token string, prev *tb.Webhook) error {
+	fmt.Printf("Setting webhook of %s to %s\n", botName, url)
+	return tgbot.SetWebhook(&tb.Webhook{
+		Endpoint:       &tb.WebhookEndpoint{PublicURL: url},
+		SecretToken:    token,
+		MaxConnections: prev.MaxConnections,
+		AllowedUpdates: prev.AllowedUpdates,
+	})
+}
+
+// Registers commands of the bot with Telegram so they show up in the menu
+func tgbotSetCommands(secret string) error {
+	bot, err := tb.NewBot(tb.Settings{Token: secret, Synchronous: true})
+	if err != nil {
+		return err
+	}
+	return awsapi.SetTGCommands(bot)
+}
+
+// Sets new webhook secret token of the bot, updates with the old one
+// are rejected by tgwebhook from then on
+func tgbotRotateToken(table *awsapi.DTable, botName, url string) error {
+	ctx := context.Background()
+	bot := &awsapi.Bot{}
+	err := table.FetchTGBotWithContext(ctx, botName, bot)
+	if err != nil {
+		return err
+	}
+	tgbot, err := tb.NewBot(tb.Settings{Token: bot.Secret, Synchronous: true})
+	if err != nil {
+		return err
+	}
+	hook, err := tgbot.GetWebhook()
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		url = hook.Listen
+	}
+	if url == "" {
+		return errors.New("Bot has no webhook, --url must be provided")
+	}
+	oldToken := bot.WebhookToken
+	bot.WebhookToken, err = awsapi.NewWebhookToken()
+	if err != nil {
+		return err
+	}
+	// stored first, Telegram retries updates rejected meanwhile
+	if err = table.StoreItemWithContext(ctx, bot); err != nil {
+		return err
+	}
+	err = setTGWebhook(tgbot, botName, url, bot.WebhookToken, hook)
+	if err == nil {
+		return nil
+	}
+	// Telegram still sends the old token
+	bot.WebhookToken = oldToken
+	if serr := table.StoreItemWithContext(ctx, bot); serr != nil {
+		return fmt.Errorf("%s, could not restore old token: %s", err.Error(), serr.Error())
+	}
+	return err
+}
+
+// Handles updates of the bot without webhook, for local development.
+// Stops on Ctrl+C, next run resumes from the last handled update
+func tgbotPoll(table *awsapi.DTable, botName, secret string, timeout time.Duration) error {
+	// the bot works here as it does in the lambda
+	if err := awsapi.ConfigureFromEnv(); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	bot := &awsapi.Bot{}
+	err := table.FetchTGBotWithContext(ctx, botName, bot)
+	if errors.Is(err, awsapi.ErrNotFound) {
+		return fmt.Errorf("Bot %s is not registered, run wtctrl tgbot register", botName)
+	}
+	if err != nil {
+		return err
+	}
+	if bot.Secret == "" {
+		bot.Secret = secret
+	}
+	tgbot, err := tb.NewBot(tb.Settings{
+		Token:       bot.Secret,
+		Synchronous: true,
+		// request is held open by Telegram for timeout
+		Client: &http.Client{Timeout: timeout + 10*time.Second},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Polling updates of %s, webhook is removed\n", botName)
+	return awsapi.PollTG(ctx, bot, table, tgbot, timeout)
 }
 
 func tgbotInvite(table *awsapi.DTable, botName, title, email, tel string) error {
@@ -245,3 +411,119 @@ func tgbotInvite(table *awsapi.DTable, botName, title, email, tel string) error
 	fmt.Printf("Please, use this url to start messaging: %s \n", inv.Url)
 	return nil
 }
+
+func db(args map[string]interface{}) error {
+	table, err := tableFromArgs(args)
+	if err != nil {
+		return err
+	}
+	if args["migrate"].(bool) {
+		m := awsapi.NewMigrator(table, os.Stdout)
+		m.DryRun = args["--dry-run"].(bool)
+		if args["status"].(bool) {
+			return dbMigrateStatus(m)
+		}
+		if args["up"].(bool) {
+			applied, err := m.Up(context.Background())
+			fmt.Printf("%d migrations applied\n", len(applied))
+			return err
+		}
+		if args["check"].(bool) {
+			return m.Check(context.Background())
+		}
+	}
+	if args["export"].(bool) {
+		return dbExport(table, args)
+	}
+	if args["import"].(bool) {
+		return dbImport(table, args)
+	}
+	return errors.New("No proper command was given.")
+}
+
+func dbExport(table *awsapi.DTable, args map[string]interface{}) error {
+	segments, err := strconv.ParseInt(args["--segments"].(string), 10, 64)
+	if err != nil {
+		return errors.New("--segments must be a number")
+	}
+	out := os.Stdout
+	if file, _ := args["--file"].(string); file != "" {
+		out, err = os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	count, err := table.Export(context.Background(), w, awsapi.ExportOpts{
+		Segments: segments, Prefixes: args["--prefix"].([]string)})
+	if err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d items exported\n", count)
+	return nil
+}
+
+func dbImport(table *awsapi.DTable, args map[string]interface{}) error {
+	opts := awsapi.ImportOpts{Prefixes: args["--prefix"].([]string), RewritePK: make(map[string]string)}
+	for _, rule := range args["--rewrite-pk"].([]string) {
+		parts := strings.SplitN(rule, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("--rewrite-pk %s must look like from:to", rule)
+		}
+		opts.RewritePK[parts[0]] = parts[1]
+	}
+	in := os.Stdin
+	if file, _ := args["--file"].(string); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	count, err := table.Import(context.Background(), in, opts)
+	fmt.Fprintf(os.Stderr, "%d items imported\n", count)
+	return err
+}
+
+func dbMigrateStatus(m *awsapi.Migrator) error {
+	status, err := m.Status(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, s := range status {
+		applied := "pending"
+		if s.AppliedAt > 0 {
+			applied = time.Unix(s.AppliedAt, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Printf("%s %-20s %s\n", s.ID, applied, s.Title)
+	}
+	return nil
+}
+
+// Runs what scheduler lambda does in a loop, for local use
+func scheduler(args map[string]interface{}) error {
+	table, err := tableFromArgs(args)
+	if err != nil {
+		return err
+	}
+	interval, err := strconv.Atoi(args["--interval"].(string))
+	if err != nil || interval < 1 {
+		return errors.New("--interval must be a positive number")
+	}
+	for {
+		sent, err := table.SendDueReminders(time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s %d reminders sent\n", time.Now().Format(time.RFC3339), sent)
+		if args["--once"].(bool) {
+			return nil
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+	}
+}
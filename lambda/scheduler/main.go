@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/dmitriko/wtctrl/pkg/awsapi"
+)
+
+var table *awsapi.DTable
+
+func init() {
+	table, _ = awsapi.NewDTable(os.Getenv("TABLE_NAME"))
+	err := table.Connect()
+	if err != nil {
+		panic("Could not connect to Dynamo")
+	}
+}
+
+// It is run by CloudWatch scheduled event
+func handleRequest(ctx context.Context, e events.CloudWatchEvent) error {
+	sent, err := table.SendDueRemindersWithContext(ctx, time.Now())
+	log.Printf("%d reminders sent", sent)
+	return err
+}
+
+func main() {
+	lambda.Start(handleRequest)
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -13,53 +15,116 @@ import (
 	tb "github.com/dmitriko/wtctrl/pkg/telebot"
 )
 
-const TGBOT_NAME = "wtctrlbot"
+var (
+	errUnknownBot = errors.New("Bot is not registered")
+	errBadToken   = errors.New("Secret token does not match")
+)
+
+func init() {
+	if err := awsapi.ConfigureFromEnv(); err != nil {
+		panic(err.Error())
+	}
+}
+
+// Telegram bots by token, kept while lambda is warm
+var tgBots = map[string]*tb.Bot{}
+
+func tgBot(token string) (*tb.Bot, error) {
+	if bot, ok := tgBots[token]; ok {
+		return bot, nil
+	}
+	bot, err := tb.NewBot(tb.Settings{
+		Token:       token,
+		Synchronous: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tgBots[token] = bot
+	return bot, nil
+}
+
+// Webhook of each bot is set to <api url>/<bot name>, updates posted
+// to the root are for $TGBOT_NAME bot
+func botName(req events.APIGatewayProxyRequest) string {
+	if name := req.PathParameters["bot"]; name != "" {
+		return name
+	}
+	if name := path.Base(strings.TrimRight(req.Path, "/")); name != "." && name != "/" && name != "" {
+		return name
+	}
+	return os.Getenv("TGBOT_NAME")
+}
 
-func handleMessage(body string) error {
+// Secret token Telegram sent, API Gateway may change case of headers
+func secretToken(req events.APIGatewayProxyRequest) string {
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, tb.SecretTokenHeader) {
+			return v
+		}
+	}
+	return ""
+}
+
+func handleMessage(ctx context.Context, name, token, body string) error {
 	var err error
 	table_name := os.Getenv("TABLE_NAME")
 	if table_name == "" {
-		return errors.New("BOT_SECRET or TABLE_NAME not set")
+		return errors.New("TABLE_NAME not set")
+	}
+	if name == "" {
+		return errUnknownBot
 	}
 	table, _ := awsapi.NewDTable(table_name)
 	err = table.Connect()
 	if err != nil {
 		return err
 	}
-	dbBot, _ := awsapi.NewBot(awsapi.TGBotKind, TGBOT_NAME)
-	resp, err := awsapi.HandleTGMsg(dbBot, table, body)
+	dbBot := &awsapi.Bot{}
+	err = table.FetchTGBotWithContext(ctx, name, dbBot)
+	if errors.Is(err, awsapi.ErrNotFound) {
+		return errUnknownBot
+	}
 	if err != nil {
 		return err
 	}
-
-	if resp != "" {
-		bot_secret := os.Getenv("TGBOT_SECRET")
-		var upd tb.Update
-		_ = json.Unmarshal([]byte(body), &upd)
-		bot, err := tb.NewBot(tb.Settings{
-			Token:       bot_secret,
-			Synchronous: true,
-		})
+	// anyone who knows the URL could post updates otherwise
+	if !dbBot.CheckWebhookToken(token) {
+		return errBadToken
+	}
+	return awsapi.ProcessTGUpdate(ctx, dbBot, table, body, func(reply *awsapi.TGReply, upd *tb.Update) error {
+		bot, err := tgBot(dbBot.Secret)
 		if err != nil {
-			log.Printf("Could not init Bot %s", err.Error())
-			return nil
-		}
-		if upd.Message != nil {
-			tr, _ := bot.Send(upd.Message.Chat, resp)
-			log.Printf("got response from TG %+v", tr)
+			return err
 		}
-	}
-	return nil
+		return reply.Send(bot, upd)
+	})
 }
 
-func handleRequest(req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func handleRequest(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
 	res := events.APIGatewayProxyResponse{
 		StatusCode: http.StatusInternalServerError,
 	}
 	log.Println(req.Body)
-	err := handleMessage(req.Body)
+	name := botName(req)
+	err := handleMessage(ctx, name, secretToken(req), req.Body)
 
+	// Telegram would retry updates for unknown bot forever
+	if errors.Is(err, errUnknownBot) {
+		log.Printf("Update for unknown bot %q", name)
+		res.StatusCode = http.StatusNotFound
+		return res, nil
+	}
+	if errors.Is(err, awsapi.ErrTGUpdateNotSupported) {
+		log.Printf("Skipping update for bot %q: %s", name, err.Error())
+		err = nil
+	}
+	if errors.Is(err, errBadToken) {
+		log.Printf("Update for bot %q with wrong secret token", name)
+		res.StatusCode = http.StatusUnauthorized
+		return res, nil
+	}
 	if err != nil {
 		log.Println("ERROR processing:")
 		log.Println(req.Body)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"os"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -16,10 +17,14 @@ func init() {
 	if err != nil {
 		panic("Could not connect to Dynamo")
 	}
+	if err := awsapi.ConfigureFromEnv(); err != nil {
+		panic(err.Error())
+	}
 }
 
-func handleRequest(req events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-	return awsapi.HandleWSDefaultReq(req, table)
+func handleRequest(ctx context.Context, req events.APIGatewayWebsocketProxyRequest) (
+	events.APIGatewayProxyResponse, error) {
+	return awsapi.HandleWSDefaultReqWithContext(ctx, req, table)
 }
 
 func main() {
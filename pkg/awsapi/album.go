@@ -0,0 +1,175 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const (
+	AlbumKeyPrefix     = "album#"
+	AlbumItemKeyPrefix = "albm#"
+)
+
+// Telegram sends all updates of album at once, so the ref
+// is needed only for a while
+var AlbumRefTTL = 24 * time.Hour
+
+// Maps Telegram media group to Msg it is collected into,
+// PK is album#<bot PK>#<chat id>#<media group id>
+type AlbumRef struct {
+	PK        string
+	SK        string
+	MsgPK     string `dynamodbav:"M"`
+	CreatedAt int64  `dynamodbav:"CRTD"`
+	TTL       int64  `dynamodbav:"TTL"`
+}
+
+func NewAlbumRef(botPK string, tgmsg *tb.Message, msgPK string) *AlbumRef {
+	var chatID int64
+	if tgmsg.Chat != nil {
+		chatID = tgmsg.Chat.ID
+	}
+	pk := fmt.Sprintf("%s%s#%d#%s", AlbumKeyPrefix, botPK, chatID, tgmsg.AlbumID)
+	now := time.Now()
+	return &AlbumRef{PK: pk, SK: pk, MsgPK: msgPK, CreatedAt: now.Unix(), TTL: now.Add(AlbumRefTTL).Unix()}
+}
+
+// Item of album, sub-item of Msg. Position is Telegram message id,
+// ids of album messages go in the order they were sent
+type AlbumItem struct {
+	PK        string
+	SK        string
+	Position  int64  `dynamodbav:"POS"`
+	Orig      string `dynamodbav:"O"`
+	CreatedAt int64  `dynamodbav:"CRTD"`
+}
+
+func albumItemSK(position int64) string {
+	return fmt.Sprintf("%s%010d", AlbumItemKeyPrefix, position)
+}
+
+// Files of album item are keyed by position, so they go in album order
+func albumFileSK(position int64, kind string) string {
+	return fmt.Sprintf("%s%010d#%s", MsgFileKeyPrefix, position, kind)
+}
+
+func NewAlbumItem(msgPK string, tgmsg *tb.Message, orig string) *AlbumItem {
+	pos := int64(tgmsg.ID)
+	return &AlbumItem{PK: msgPK, SK: albumItemSK(pos), Position: pos, Orig: orig, CreatedAt: tgmsg.Unixtime}
+}
+
+// Collects update of Telegram album into one Msg. The first update
+// stores new Msg along with album ref, the rest add items to it and
+// set caption as text if Msg has no text yet. Only the first update
+// is replied to
+func handleTGAlbumMsg(ctx context.Context, bot *Bot, table *DTable, upd *tb.Update, msg *Msg) (*TGReply, error) {
+	tgmsg := upd.Message
+	orig, _ := msg.Data["orig"].(string)
+	msg.Kind = TGAlbumMsgKind
+	msg.Data["album"] = tgmsg.AlbumID
+	// update ref goes first, album ref is the third
+	err := table.StoreTGUpdateMsgWithContext(ctx, bot.PK, upd.ID, msg,
+		NewAlbumRef(bot.PK, tgmsg, msg.PK), NewAlbumItem(msg.PK, tgmsg, orig))
+	if err == nil {
+		return finishTGMsg(ctx, bot, table, tgmsg, msg)
+	}
+	if isTGUpdateStored(err) {
+		reply, _, err := replayTGUpdate(ctx, bot, table, upd)
+		return reply, err
+	}
+	var tcErr *TransactionCanceledError
+	if !errors.As(err, &tcErr) || !tcErr.Failed(2) {
+		return nil, err
+	}
+	ref := &AlbumRef{}
+	if err = table.FetchItemWithContext(ctx, NewAlbumRef(bot.PK, tgmsg, "").PK, ref); err != nil {
+		return nil, err
+	}
+	for _, err := range table.BatchStoreWithContext(ctx,
+		NewAlbumItem(ref.MsgPK, tgmsg, orig), NewTGMsgRef(bot.PK, tgmsg, ref.MsgPK)) {
+		if err != nil {
+			return nil, err
+		}
+	}
+	text, entities := tgMsgText(tgmsg)
+	if text == "" {
+		return nil, nil
+	}
+	return nil, setAlbumCaption(ctx, table, ref.MsgPK, text, entities)
+}
+
+func setAlbumCaption(ctx context.Context, table *DTable, pk, text string, entities []tb.MessageEntity) error {
+	for attempt := 1; ; attempt++ {
+		msg := &Msg{}
+		if err := table.FetchItemWithContext(ctx, pk, msg); err != nil {
+			return err
+		}
+		if old, _ := msg.Data["text"].(string); old != "" {
+			return nil
+		}
+		msg.Data["text"] = text
+		for _, tag := range ExtractTags(text, entities) {
+			msg.AddTag(tag)
+		}
+		err := table.StoreMsgIfVersionWithContext(ctx, msg, msg.Version)
+		if err == nil || attempt == msgUpdateAttempts || !errors.Is(err, ErrVersionConflict) {
+			return err
+		}
+	}
+}
+
+// Downloads files of album item to the bucket
+func handleAlbumItem(ctx context.Context, pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
+	if item["O"].DataType() != events.DataTypeString || item["POS"].DataType() != events.DataTypeNumber {
+		return
+	}
+	pos, _ := item["POS"].Integer()
+	// album item does not keep the bot, Msg does
+	msg := &Msg{}
+	if err := table.FetchItemWithContext(ctx, pk, msg); err != nil {
+		fmt.Printf("ERROR: %s", err.Error())
+		return
+	}
+	downloadTGOrig(ctx, table, pk, msg.ChannelPK, item["O"].String(), pos)
+}
+
+// Deletes album items of removed Msg
+func purgeAlbumItems(ctx context.Context, table *DTable, pk string) error {
+	var items []*AlbumItem
+	if err := table.FetchItemsWithPrefixWithContext(ctx, pk, AlbumItemKeyPrefix, &items); err != nil {
+		return err
+	}
+	var keys []ItemKey
+	for _, item := range items {
+		keys = append(keys, ItemKey{PK: item.PK, SK: item.SK})
+	}
+	for _, err := range table.BatchDeleteWithContext(ctx, keys...) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Groups files of album by position, in album order
+func albumFiles(files []*MsgFile) [][]*MsgFile {
+	var out [][]*MsgFile
+	var last int64
+	for _, f := range files {
+		if f.Position == 0 || !strings.HasPrefix(f.SK, MsgFileKeyPrefix) {
+			continue
+		}
+		if len(out) == 0 || f.Position != last {
+			out = append(out, nil)
+			last = f.Position
+		}
+		out[len(out)-1] = append(out[len(out)-1], f)
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// %[1]d tgid, %[2]d message_id, %[3]s caption
+const TGAlbumPhotoTmpl = `{"update_id": %[2]d,
+  "message": {
+    "message_id": %[2]d,
+    "from": {"id": %[1]d, "is_bot": false, "first_name": "D"},
+    "chat": {"id": %[1]d, "first_name": "D", "type": "private"},
+    "date": 1597084525,
+    "media_group_id": "12788585599371730",
+    "photo": [
+      {"file_id": "small%[2]d", "file_unique_id": "us%[2]d", "file_size": 1000, "width": 90, "height": 60},
+      {"file_id": "medium%[2]d", "file_unique_id": "um%[2]d", "file_size": 9000, "width": 320, "height": 240},
+      {"file_id": "big%[2]d", "file_unique_id": "ub%[2]d", "file_size": 90000, "width": 1280, "height": 960}
+    ],
+    "caption": "%[3]s"}
+}`
+
+func TestScenarioTGAlbum(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	for i, caption := range []string{"", "trip to the #mountains", "ignored"} {
+		_, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGAlbumPhotoTmpl, tgid, 30+i, caption))
+		require.Nil(t, err)
+	}
+	var pks []string
+	for i := 0; i < 3; i++ {
+		msg := &Msg{}
+		require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 30 + i, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+		pks = append(pks, msg.PK)
+	}
+	assert.Equal(t, pks[0], pks[1])
+	assert.Equal(t, pks[0], pks[2])
+	msg := &Msg{}
+	require.Nil(t, table.FetchItem(pks[0], msg))
+	assert.Equal(t, int64(TGAlbumMsgKind), msg.Kind)
+	assert.Equal(t, "trip to the #mountains", msg.Data["text"])
+	assert.Equal(t, []string{"mountains"}, msg.Tags)
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchByUMS(table, user.PK, msg.UMS.String(), 0, time.Now().Unix()+1))
+	assert.Equal(t, 1, lm.Len())
+
+	var items []*AlbumItem
+	require.Nil(t, table.FetchItemsWithPrefix(msg.PK, AlbumItemKeyPrefix, &items))
+	require.Equal(t, 3, len(items))
+	for i, item := range items {
+		assert.Equal(t, int64(30+i), item.Position)
+	}
+
+	// files are downloaded from album items by stream handler
+	origUpload := uploadS3
+	uploadS3 = func(ctx context.Context, bucket, key, contentType string, file io.ReadCloser) error {
+		return file.Close()
+	}
+	defer func() { uploadS3 = origUpload }()
+	getFile := func(f *tb.File) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(f.FileID)), nil
+	}
+	for _, i := range []int{2, 0, 1} {
+		upd := &tb.Update{}
+		require.Nil(t, json.Unmarshal([]byte(items[i].Orig), upd))
+		downloadTGMedia(ctx, table, msg.PK, items[i].Position, upd.Message, getFile, "bucket")
+	}
+	var files []*MsgFile
+	require.Nil(t, table.FetchItemsWithPrefix(msg.PK, MsgFileKeyPrefix, &files))
+	require.Equal(t, 9, len(files))
+	assert.Equal(t, albumFileSK(30, FileKindTgBigPic), files[0].SK)
+	view, err := NewMsgView(msg, files)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(view.Album))
+	assert.Equal(t, 0, len(view.Files))
+	for i, item := range view.Album {
+		big := item[FileKindTgBigPic].(map[string]interface{})
+		assert.Equal(t, "image/jpeg", big["mime"])
+		assert.True(t, strings.Contains(big["url"].(string), fmt.Sprintf("ub%d.jpg", 30+i)))
+	}
+
+	require.Nil(t, purgeAlbumItems(ctx, table, msg.PK))
+	items = nil
+	require.Nil(t, table.FetchItemsWithPrefix(msg.PK, AlbumItemKeyPrefix, &items))
+	assert.Equal(t, 0, len(items))
+}
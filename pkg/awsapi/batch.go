@@ -0,0 +1,260 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// DynamoDB limits for one batch request
+const (
+	BatchWriteSize = 25
+	BatchGetSize   = 100
+)
+
+// How many times unprocessed items are resent and the delay before
+// the first retry, it doubles with every attempt
+var (
+	BatchMaxRetries = 6
+	BatchRetryDelay = 50 * time.Millisecond
+)
+
+// Primary key of an item
+type ItemKey struct {
+	PK string
+	SK string
+}
+
+func (k ItemKey) attrs() map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {S: aws.String(k.PK)},
+		"SK": {S: aws.String(k.SK)},
+	}
+}
+
+func itemKeyOf(item map[string]*dynamodb.AttributeValue) (ItemKey, error) {
+	pk, sk := item["PK"], item["SK"]
+	if pk == nil || pk.S == nil || sk == nil || sk.S == nil {
+		return ItemKey{}, errors.New("Item has no PK or SK")
+	}
+	return ItemKey{PK: *pk.S, SK: *sk.S}, nil
+}
+
+func writeReqKey(r *dynamodb.WriteRequest) ItemKey {
+	var key ItemKey
+	if r.PutRequest != nil {
+		key, _ = itemKeyOf(r.PutRequest.Item)
+	} else {
+		key, _ = itemKeyOf(r.DeleteRequest.Key)
+	}
+	return key
+}
+
+// Stores items with BatchWriteItem requests, 25 items each.
+// Returns error for every item in the same order, nil if item is stored.
+// Conditions are not supported, use StoreItem for that.
+func (t *DTable) BatchStore(items ...interface{}) []error {
+	return t.BatchStoreWithContext(context.Background(), items...)
+}
+
+func (t *DTable) BatchStoreWithContext(ctx context.Context, items ...interface{}) []error {
+	errs := make([]error, len(items))
+	reqs := make([]*dynamodb.WriteRequest, len(items))
+	for i, item := range items {
+		av, err := dattr.MarshalMap(item)
+		if err == nil {
+			_, err = itemKeyOf(av)
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		reqs[i] = &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: av}}
+	}
+	t.batchWrite(ctx, reqs, errs)
+	return errs
+}
+
+// Deletes items with BatchWriteItem requests, returns error for every key
+func (t *DTable) BatchDelete(keys ...ItemKey) []error {
+	return t.BatchDeleteWithContext(context.Background(), keys...)
+}
+
+func (t *DTable) BatchDeleteWithContext(ctx context.Context, keys ...ItemKey) []error {
+	errs := make([]error, len(keys))
+	reqs := make([]*dynamodb.WriteRequest, len(keys))
+	for i, key := range keys {
+		reqs[i] = &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key.attrs()}}
+	}
+	t.batchWrite(ctx, reqs, errs)
+	return errs
+}
+
+// Sends non nil requests in chunks, a chunk never has the same key twice
+// so later request for a key wins like with sequential calls
+func (t *DTable) batchWrite(ctx context.Context, reqs []*dynamodb.WriteRequest, errs []error) {
+	var chunk []*dynamodb.WriteRequest
+	pos := make(map[ItemKey]int)
+	flush := func() {
+		if len(chunk) > 0 {
+			t.writeChunk(ctx, chunk, pos, errs)
+		}
+		chunk = nil
+		pos = make(map[ItemKey]int)
+	}
+	for i, r := range reqs {
+		if r == nil {
+			continue
+		}
+		key := writeReqKey(r)
+		if _, dup := pos[key]; dup || len(chunk) == BatchWriteSize {
+			flush()
+		}
+		chunk = append(chunk, r)
+		pos[key] = i
+	}
+	flush()
+}
+
+func (t *DTable) writeChunk(ctx context.Context, chunk []*dynamodb.WriteRequest,
+	pos map[ItemKey]int, errs []error) {
+	delay := BatchRetryDelay
+	for attempt := 0; ; attempt++ {
+		unprocessed, err := t.BatchWriteWithContext(ctx, chunk)
+		if err != nil && !errors.Is(err, ErrThrottled) {
+			for _, r := range chunk {
+				errs[pos[writeReqKey(r)]] = err
+			}
+			return
+		}
+		if err != nil {
+			unprocessed = chunk
+		}
+		if len(unprocessed) == 0 {
+			return
+		}
+		if attempt == BatchMaxRetries {
+			err = &StorageError{Kind: ErrThrottled, Cause: err}
+		} else {
+			err = sleepWithContext(ctx, delay)
+		}
+		if err != nil {
+			for _, r := range unprocessed {
+				errs[pos[writeReqKey(r)]] = err
+			}
+			return
+		}
+		delay *= 2
+		chunk = unprocessed
+	}
+}
+
+// Fetches items with BatchGetItem requests, 100 keys each, and unmarshals
+// found ones to out in the order of keys.
+// Returns error for every key, ErrNotFound if there is no such item.
+func (t *DTable) BatchFetch(keys []ItemKey, out interface{}) []error {
+	return t.BatchFetchWithContext(context.Background(), keys, out)
+}
+
+func (t *DTable) BatchFetchWithContext(ctx context.Context, keys []ItemKey, out interface{}) []error {
+	errs := make([]error, len(keys))
+	found := make(map[ItemKey]map[string]*dynamodb.AttributeValue)
+	failed := make(map[ItemKey]error)
+	var uniq []ItemKey
+	seen := make(map[ItemKey]bool)
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			uniq = append(uniq, key)
+		}
+	}
+	for start := 0; start < len(uniq); start += BatchGetSize {
+		end := start + BatchGetSize
+		if end > len(uniq) {
+			end = len(uniq)
+		}
+		var chunk []map[string]*dynamodb.AttributeValue
+		for _, key := range uniq[start:end] {
+			chunk = append(chunk, key.attrs())
+		}
+		t.fetchChunk(ctx, chunk, found, failed)
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	added := make(map[ItemKey]bool)
+	for _, key := range keys {
+		if item, ok := found[key]; ok && !added[key] {
+			added[key] = true
+			items = append(items, item)
+		}
+	}
+	var unmarshalErr error
+	if len(items) > 0 {
+		unmarshalErr = dattr.UnmarshalListOfMaps(items, out)
+	}
+	for i, key := range keys {
+		if err, ok := failed[key]; ok {
+			errs[i] = err
+		} else if _, ok := found[key]; !ok {
+			errs[i] = newNotFoundErr()
+		} else {
+			errs[i] = unmarshalErr
+		}
+	}
+	return errs
+}
+
+func (t *DTable) fetchChunk(ctx context.Context, chunk []map[string]*dynamodb.AttributeValue,
+	found map[ItemKey]map[string]*dynamodb.AttributeValue, failed map[ItemKey]error) {
+	delay := BatchRetryDelay
+	for attempt := 0; ; attempt++ {
+		items, unprocessed, err := t.BatchGetWithContext(ctx, chunk)
+		if err != nil && !errors.Is(err, ErrThrottled) {
+			for _, k := range chunk {
+				key, _ := itemKeyOf(k)
+				failed[key] = err
+			}
+			return
+		}
+		if err != nil {
+			unprocessed = chunk
+		}
+		for _, item := range items {
+			if key, err := itemKeyOf(item); err == nil {
+				found[key] = item
+			}
+		}
+		if len(unprocessed) == 0 {
+			return
+		}
+		if attempt == BatchMaxRetries {
+			err = &StorageError{Kind: ErrThrottled, Cause: err}
+		} else {
+			err = sleepWithContext(ctx, delay)
+		}
+		if err != nil {
+			for _, k := range unprocessed {
+				key, _ := itemKeyOf(k)
+				failed[key] = err
+			}
+			return
+		}
+		delay *= 2
+		chunk = unprocessed
+	}
+}
+
+// Waits for given time, returns earlier with error if context is done
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+package awsapi
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchStoreFetchDelete(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	mem := table.Storage.(*MemStorage)
+	mem.MaxBatchItems = 20
+	defer func(d time.Duration) { BatchRetryDelay = d }(BatchRetryDelay)
+	BatchRetryDelay = time.Millisecond
+
+	var items []interface{}
+	var keys []ItemKey
+	for i := 0; i < 60; i++ {
+		item, _ := NewTestItem(fmt.Sprintf("foo%d", i), "bar")
+		items = append(items, item)
+		keys = append(keys, ItemKey{PK: item.PK, SK: item.SK})
+	}
+	items = append(items, &TItem{})
+	errs := table.BatchStore(items...)
+	require.Equal(t, 61, len(errs))
+	for _, err := range errs[:60] {
+		assert.Nil(t, err)
+	}
+	assert.NotNil(t, errs[60], "item without keys")
+
+	var fetched []*TItem
+	fetchKeys := append([]ItemKey{{PK: "nosuch", SK: "nosuch"}}, keys...)
+	fetchKeys = append(fetchKeys, keys[0])
+	errs = table.BatchFetch(fetchKeys, &fetched)
+	require.Equal(t, 62, len(errs))
+	assert.True(t, errors.Is(errs[0], ErrNotFound))
+	for _, err := range errs[1:] {
+		assert.Nil(t, err)
+	}
+	require.Equal(t, 60, len(fetched))
+	assert.Equal(t, "foo0", fetched[0].PK)
+	assert.Equal(t, "foo59", fetched[59].PK)
+
+	for _, err := range table.BatchDelete(keys[:30]...) {
+		assert.Nil(t, err)
+	}
+	fetched = nil
+	errs = table.BatchFetch(keys, &fetched)
+	assert.Equal(t, 30, len(fetched))
+	assert.True(t, errors.Is(errs[0], ErrNotFound))
+	assert.Nil(t, errs[30])
+}
+
+func TestBatchStoreSameKey(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	item1, _ := NewTestItem("foo", "bar")
+	item2, _ := NewTestItem("foo", "baz")
+	for _, err := range table.BatchStore(item1, item2) {
+		assert.Nil(t, err)
+	}
+	fetched := &TItem{}
+	require.Nil(t, table.FetchItem("foo", fetched))
+	assert.Equal(t, "baz", fetched.UMS, "last one wins")
+}
+
+func TestBatchRetriesExhausted(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	table.Storage.(*MemStorage).MaxBatchItems = 1
+	defer func(n int) { BatchMaxRetries = n }(BatchMaxRetries)
+	BatchMaxRetries = 0
+	item1, _ := NewTestItem("foo1", "bar")
+	item2, _ := NewTestItem("foo2", "bar")
+	errs := table.BatchStore(item1, item2)
+	assert.Nil(t, errs[0])
+	assert.True(t, errors.Is(errs[1], ErrThrottled))
+}
@@ -0,0 +1,32 @@
+package awsapi
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	// lambda runtime may have no zoneinfo
+	_ "time/tzdata"
+)
+
+// Sets up package from environment, every lambda calls it on init so
+// they all behave the same:
+// TRASH_RETENTION_DAYS - how many days Msg stays in Trash, see TrashRetention
+// REMINDER_TZ - time zone of users who have not set one, see ReminderLocation
+func ConfigureFromEnv() error {
+	if val := os.Getenv("TRASH_RETENTION_DAYS"); val != "" {
+		days, err := strconv.Atoi(val)
+		if err != nil || days <= 0 {
+			return fmt.Errorf("TRASH_RETENTION_DAYS is not a positive number: %q", val)
+		}
+		TrashRetention = time.Duration(days) * 24 * time.Hour
+	}
+	if val := os.Getenv("REMINDER_TZ"); val != "" {
+		loc, err := time.LoadLocation(val)
+		if err != nil {
+			return fmt.Errorf("REMINDER_TZ is not a time zone: %q", val)
+		}
+		ReminderLocation = loc
+	}
+	return nil
+}
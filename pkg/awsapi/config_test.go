@@ -0,0 +1,41 @@
+package awsapi
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureFromEnv(t *testing.T) {
+	orig, origLoc := TrashRetention, ReminderLocation
+	defer func() {
+		TrashRetention, ReminderLocation = orig, origLoc
+		os.Unsetenv("TRASH_RETENTION_DAYS")
+		os.Unsetenv("REMINDER_TZ")
+	}()
+	require.Nil(t, ConfigureFromEnv())
+	assert.Equal(t, orig, TrashRetention)
+
+	os.Setenv("TRASH_RETENTION_DAYS", "7")
+	require.Nil(t, ConfigureFromEnv())
+	assert.Equal(t, 7*24*time.Hour, TrashRetention)
+	msg, _ := NewMsg("bot1", "user1", TGTextMsgKind)
+	msg.MoveTo(UMSField{PK: "user1"}, true)
+	assert.Equal(t, msg.TrashedAt+7*24*3600, msg.TTL)
+
+	os.Setenv("TRASH_RETENTION_DAYS", "week")
+	assert.NotNil(t, ConfigureFromEnv())
+	assert.Equal(t, 7*24*time.Hour, TrashRetention)
+	os.Unsetenv("TRASH_RETENTION_DAYS")
+
+	os.Setenv("REMINDER_TZ", "Europe/Berlin")
+	require.Nil(t, ConfigureFromEnv())
+	assert.Equal(t, "Europe/Berlin", ReminderLocation.String())
+	user, _ := NewUser("user1")
+	assert.Equal(t, ReminderLocation, user.Location())
+	os.Setenv("REMINDER_TZ", "Mars/Olympus")
+	assert.NotNil(t, ConfigureFromEnv())
+}
@@ -12,6 +12,9 @@ import (
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/dmitriko/wtctrl/pkg/azr"
 	tb "github.com/dmitriko/wtctrl/pkg/telebot"
@@ -33,8 +36,8 @@ func voiceToText(bot *tb.Bot, voice *tb.Voice) (string, error) {
 }
 
 // Updates Msg.Data with recognized text
-func updateMsgData(pk string, table *DTable, txt string) error {
-	_, err := table.UpdateItemData(pk, RecognizedTextFieldName, txt)
+func updateMsgData(ctx context.Context, pk string, table *DTable, txt string) error {
+	_, err := table.UpdateMsgDataWithContext(ctx, pk, RecognizedTextFieldName, txt)
 	return err
 }
 
@@ -43,14 +46,14 @@ func replyUser(bot *tb.Bot, tgmsg *tb.Message, txt string) error {
 	return err
 }
 
-func runSpeechRecogn(pk string, table *DTable, bot *tb.Bot, upd *tb.Update) {
+func runSpeechRecogn(ctx context.Context, pk string, table *DTable, bot *tb.Bot, upd *tb.Update) {
 	txt, err := voiceToText(bot, upd.Message.Voice)
 	if err != nil {
 		fmt.Printf("ERROR speech recognition: %s", err.Error())
 		return
 	}
 	if txt != "" {
-		if err = updateMsgData(pk, table, txt); err != nil {
+		if err = updateMsgData(ctx, pk, table, txt); err != nil {
 			fmt.Printf("ERROR updating msg %s with %s", pk, txt)
 			return
 		}
@@ -60,7 +63,7 @@ func runSpeechRecogn(pk string, table *DTable, bot *tb.Bot, upd *tb.Update) {
 	}
 }
 
-func downloadVoice(table *DTable, pk string, voice *tb.Voice, bot *tb.Bot) {
+func downloadVoice(ctx context.Context, table *DTable, pk string, voice *tb.Voice, bot *tb.Bot) {
 	bucket := os.Getenv("IMG_BUCKET")
 	if bucket == "" {
 		fmt.Println("IMG_BUCKET evn var is not set")
@@ -70,30 +73,27 @@ func downloadVoice(table *DTable, pk string, voice *tb.Voice, bot *tb.Bot) {
 	file, err := bot.GetFile(&voice.File)
 	if err == nil {
 		key := fmt.Sprintf("%s.ogg", voice.UniqueID)
-		err = storeS3(sess, bucket, key, voice.MIME, file)
+		err = storeS3(ctx, sess, bucket, key, voice.MIME, file)
 		if err == nil {
-			createMsgFileVoice(table, pk, voice, key, bucket)
+			createMsgFileVoice(ctx, table, pk, voice, key, bucket)
 		}
 	} else {
 		fmt.Println("ERROR", err.Error())
 	}
 }
 
-func createMsgFileVoice(table *DTable, pk string, voice *tb.Voice, key, bucket string) {
+func createMsgFileVoice(ctx context.Context, table *DTable, pk string, voice *tb.Voice, key, bucket string) {
 	f, _ := NewMsgFile(pk, FileKindTgVoice, voice.MIME, bucket, key)
 	f.Data["duration"] = voice.Duration
 	f.Data["size"] = voice.File.FileSize
-	err := table.StoreItem(f)
+	err := table.StoreItemWithContext(ctx, f)
 	if err != nil {
 		fmt.Println("ERROR storing MsgFile", err.Error())
 	}
 }
 
-func handleVoiceMsg(pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
-	bot, err := tb.NewBot(tb.Settings{
-		Token:       os.Getenv("TGBOT_SECRET"),
-		Synchronous: true,
-	})
+func handleVoiceMsg(ctx context.Context, pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
+	bot, err := msgTGBotWithContext(ctx, table, itemChannelPK(item))
 	if err != nil {
 		fmt.Printf("ERROR creating bot %s", err.Error())
 		return
@@ -124,20 +124,17 @@ func handleVoiceMsg(pk string, table *DTable, item map[string]events.DynamoDBAtt
 		return
 	}
 
-	runSpeechRecogn(pk, table, bot, upd)
-	downloadVoice(table, pk, upd.Message.Voice, bot)
+	runSpeechRecogn(ctx, pk, table, bot, upd)
+	downloadVoice(ctx, table, pk, upd.Message.Voice, bot)
 }
 
-func handleTGPhotoMsg(pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
+func handleTGPhotoMsg(ctx context.Context, pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
 	fmt.Println("Handling photo message.")
 	bucket := os.Getenv("IMG_BUCKET")
 	if bucket == "" {
-		fmt.Println("IMG_BUCKET evn var is not set")
+		fmt.Println("IMG_BUCKET env var is not set")
 	}
-	bot, err := tb.NewBot(tb.Settings{
-		Token:       os.Getenv("TGBOT_SECRET"),
-		Synchronous: true,
-	})
+	bot, err := msgTGBotWithContext(ctx, table, itemChannelPK(item))
 	if err != nil {
 		fmt.Printf("ERROR creating bot %s", err.Error())
 		return
@@ -152,15 +149,15 @@ func handleTGPhotoMsg(pk string, table *DTable, item map[string]events.DynamoDBA
 			return
 		}
 		if upd.Message != nil && upd.Message.Photo != nil {
-			downloadPics(table, pk, upd.Message.Photo, bot, bucket)
+			downloadPics(ctx, table, pk, upd.Message.Photo, bot, bucket)
 		}
 	}
 }
 
-func storeS3(sess *session.Session, bucket, key, contentType string, file io.ReadCloser) error {
+func storeS3(ctx context.Context, sess *session.Session, bucket, key, contentType string, file io.ReadCloser) error {
 	defer file.Close()
 	uploader := s3manager.NewUploader(sess)
-	_, err := uploader.Upload(&s3manager.UploadInput{
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 		Bucket:      aws.String(bucket),
 		Key:         aws.String(key),
 		Body:        file,
@@ -169,7 +166,55 @@ func storeS3(sess *session.Session, bucket, key, contentType string, file io.Rea
 	return err
 }
 
-func createMsgFilePic(table *DTable, pk string, pic *tb.PhotoSize, key, bucket string, i int) {
+// Deletes objects from S3 bucket, it is a var so tests could replace it
+var deleteS3Objects = func(ctx context.Context, bucket string, keys []string) error {
+	sess, err := session.NewSession()
+	if err != nil {
+		return err
+	}
+	var objects []*s3.ObjectIdentifier
+	for _, key := range keys {
+		objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+	}
+	_, err = s3.New(sess).DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	return err
+}
+
+// Deletes MsgFile items of removed Msg along with their S3 objects.
+// Items are kept if objects could not be deleted, so the next attempt
+// could find them
+func purgeMsgFiles(ctx context.Context, table *DTable, pk string) error {
+	var files []*MsgFile
+	if err := table.FetchItemsWithPrefixWithContext(ctx, pk, MsgFileKeyPrefix, &files); err != nil {
+		return err
+	}
+	byBucket := make(map[string][]string)
+	for _, f := range files {
+		if f.Bucket != "" && f.Key != "" {
+			byBucket[f.Bucket] = append(byBucket[f.Bucket], f.Key)
+		}
+	}
+	for bucket, keys := range byBucket {
+		if err := deleteS3Objects(ctx, bucket, keys); err != nil {
+			return err
+		}
+	}
+	var keys []ItemKey
+	for _, f := range files {
+		keys = append(keys, ItemKey{PK: f.PK, SK: f.SK})
+	}
+	for _, err := range table.BatchDeleteWithContext(ctx, keys...) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createMsgFilePic(ctx context.Context, table *DTable, pk string, pic *tb.PhotoSize, key, bucket string, i int) {
 	kindMap := map[int]string{
 		0: FileKindTgThumb,
 		1: FileKindTgMediumPic,
@@ -183,13 +228,13 @@ func createMsgFilePic(table *DTable, pk string, pic *tb.PhotoSize, key, bucket s
 	f.Data["height"] = pic.Height
 	f.Data["width"] = pic.Width
 	f.Data["size"] = pic.FileSize
-	err := table.StoreItem(f)
+	err := table.StoreItemWithContext(ctx, f)
 	if err != nil {
 		fmt.Println("ERROR storing MsgFile", err.Error())
 	}
 }
 
-func downloadPics(table *DTable, pk string, photo *tb.Photo, bot *tb.Bot, bucket string) {
+func downloadPics(ctx context.Context, table *DTable, pk string, photo *tb.Photo, bot *tb.Bot, bucket string) {
 	fmt.Printf("Going to download pics for %#v", photo)
 	sess, _ := session.NewSession()
 
@@ -197,9 +242,9 @@ func downloadPics(table *DTable, pk string, photo *tb.Photo, bot *tb.Bot, bucket
 		file, err := bot.GetFile(&pic.File)
 		if err == nil {
 			key := fmt.Sprintf("%s.jpg", pic.UniqueID)
-			err = storeS3(sess, bucket, key, "image/jpeg", file)
+			err = storeS3(ctx, sess, bucket, key, "image/jpeg", file)
 			if err == nil {
-				createMsgFilePic(table, pk, &pic, key, bucket, i)
+				createMsgFilePic(ctx, table, pk, &pic, key, bucket, i)
 			}
 		} else {
 			fmt.Println("ERROR", err.Error())
@@ -207,21 +252,25 @@ func downloadPics(table *DTable, pk string, photo *tb.Photo, bot *tb.Bot, bucket
 	}
 }
 
-func handleNewMsg(pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
+func handleNewMsg(ctx context.Context, pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
 	if item["K"].DataType() == events.DataTypeNumber {
 		kind, _ := item["K"].Integer()
 		if kind == TGVoiceMsgKind {
-			handleVoiceMsg(pk, table, item)
+			handleVoiceMsg(ctx, pk, table, item)
 			return
 		}
 		if kind == TGPhotoMsgKind {
-			handleTGPhotoMsg(pk, table, item)
+			handleTGPhotoMsg(ctx, pk, table, item)
+			return
+		}
+		if isTGMediaKind(kind) {
+			handleTGMediaMsg(ctx, pk, table, item)
 			return
 		}
 	}
 }
 
-func notifySubsciptions(table *DTable, pk, eventName string, item map[string]events.DynamoDBAttributeValue) {
+func notifySubsciptions(ctx context.Context, table *DTable, pk, eventName string, item map[string]events.DynamoDBAttributeValue) {
 	var kind int64
 	if item["K"].DataType() == events.DataTypeNumber {
 		kind, _ = item["K"].Integer()
@@ -229,13 +278,13 @@ func notifySubsciptions(table *DTable, pk, eventName string, item map[string]eve
 	var subs Subscriptions
 	if item["UMS"].DataType() == events.DataTypeString {
 		ums := item["UMS"].String()
-		err := table.FetchItemsWithPrefix(ums, SubscriptionKeyPrefix, &subs)
+		err := table.FetchItemsWithPrefixWithContext(ctx, ums, SubscriptionKeyPrefix, &subs)
 		if err != nil {
 			fmt.Println("ERROR", err.Error())
 			return
 		}
 		for _, s := range subs {
-			err = s.SendDBEvent(pk, eventName, ums, kind)
+			err = s.SendDBEventWithContext(ctx, pk, eventName, ums, kind)
 			if err != nil {
 				fmt.Println("ERROR", err.Error())
 			}
@@ -243,15 +292,115 @@ func notifySubsciptions(table *DTable, pk, eventName string, item map[string]eve
 	}
 }
 
+func streamValue(v events.DynamoDBAttributeValue) *dynamodb.AttributeValue {
+	av := &dynamodb.AttributeValue{}
+	switch v.DataType() {
+	case events.DataTypeString:
+		av.S = aws.String(v.String())
+	case events.DataTypeNumber:
+		av.N = aws.String(v.Number())
+	case events.DataTypeBinary:
+		av.B = v.Binary()
+	case events.DataTypeBoolean:
+		av.BOOL = aws.Bool(v.Boolean())
+	case events.DataTypeStringSet:
+		av.SS = aws.StringSlice(v.StringSet())
+	case events.DataTypeNumberSet:
+		av.NS = aws.StringSlice(v.NumberSet())
+	case events.DataTypeBinarySet:
+		av.BS = v.BinarySet()
+	case events.DataTypeList:
+		for _, item := range v.List() {
+			av.L = append(av.L, streamValue(item))
+		}
+		if av.L == nil {
+			av.L = []*dynamodb.AttributeValue{}
+		}
+	case events.DataTypeMap:
+		av.M = streamImage(v.Map())
+	default:
+		av.NULL = aws.Bool(true)
+	}
+	return av
+}
+
+// Converts stream image to attributes dattr can unmarshal
+func streamImage(image map[string]events.DynamoDBAttributeValue) map[string]*dynamodb.AttributeValue {
+	out := make(map[string]*dynamodb.AttributeValue, len(image))
+	for name, v := range image {
+		out[name] = streamValue(v)
+	}
+	return out
+}
+
+func indexMsg(ctx context.Context, table *DTable, image map[string]events.DynamoDBAttributeValue) error {
+	msg := &Msg{}
+	if err := dattr.UnmarshalMap(streamImage(image), msg); err != nil {
+		return err
+	}
+	if err := table.IndexMsgWithContext(ctx, msg); err != nil {
+		return err
+	}
+	if err := table.IndexMsgTagsWithContext(ctx, msg); err != nil {
+		return err
+	}
+	return table.IndexMsgDueWithContext(ctx, msg)
+}
+
+func unthreadMsg(ctx context.Context, table *DTable, image map[string]events.DynamoDBAttributeValue) error {
+	msg := &Msg{}
+	if err := dattr.UnmarshalMap(streamImage(image), msg); err != nil {
+		return err
+	}
+	return table.RemoveFromThreadWithContext(ctx, msg)
+}
+
 func HandleDBEvent(ctx context.Context, table *DTable, e events.DynamoDBEvent) {
 	for _, record := range e.Records {
+		if ctx.Err() != nil {
+			fmt.Println("ERROR", ctx.Err().Error())
+			return
+		}
 		pk := record.Change.Keys["PK"].String()
 		sk := record.Change.Keys["SK"].String()
 		fmt.Println("Processing", pk, sk)
+		if strings.HasPrefix(pk, MsgKeyPrefix) && strings.HasPrefix(sk, AlbumItemKeyPrefix) &&
+			record.EventName == "INSERT" {
+			handleAlbumItem(ctx, pk, table, record.Change.NewImage)
+		}
 		if strings.HasPrefix(pk, MsgKeyPrefix) && strings.HasPrefix(sk, MsgKeyPrefix) {
-			notifySubsciptions(table, pk, record.EventName, record.Change.NewImage)
+			image := record.Change.NewImage
+			if record.EventName == "REMOVE" {
+				image = record.Change.OldImage
+			}
+			notifySubsciptions(ctx, table, pk, record.EventName, image)
 			if record.EventName == "INSERT" {
-				handleNewMsg(pk, table, record.Change.NewImage)
+				handleNewMsg(ctx, pk, table, record.Change.NewImage)
+			}
+			if record.EventName == "INSERT" || record.EventName == "MODIFY" {
+				if err := indexMsg(ctx, table, record.Change.NewImage); err != nil {
+					fmt.Println("ERROR indexing", pk, err.Error())
+				}
+			}
+			if record.EventName == "REMOVE" {
+				if err := purgeMsgFiles(ctx, table, pk); err != nil {
+					fmt.Println("ERROR purging files of", pk, err.Error())
+				}
+				if err := purgeAlbumItems(ctx, table, pk); err != nil {
+					fmt.Println("ERROR purging album items of", pk, err.Error())
+				}
+				if err := table.UnindexMsgWithContext(ctx, pk); err != nil {
+					fmt.Println("ERROR unindexing", pk, err.Error())
+				}
+				if err := table.UnindexMsgTagsWithContext(ctx, pk); err != nil {
+					fmt.Println("ERROR unindexing tags of", pk, err.Error())
+				}
+				if err := table.UnindexMsgDueWithContext(ctx, pk); err != nil {
+					fmt.Println("ERROR unscheduling", pk, err.Error())
+				}
+				if err := unthreadMsg(ctx, table, image); err != nil {
+					fmt.Println("ERROR removing from thread", pk, err.Error())
+				}
 			}
 		}
 
@@ -1,11 +1,13 @@
 package awsapi
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const TGPicDBEvent = `
@@ -196,3 +198,32 @@ func TestDBeventUnmarhal(t *testing.T) {
 	_, err = GetDBEvent(TGVoiceDBEvent)
 	assert.Nil(t, err)
 }
+
+func TestDBEventRemovePurgesFiles(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	msg, _ := NewMsg("bot1", "user#foo", TGPhotoMsgKind)
+	f1, _ := NewMsgFile(msg.PK, FileKindTgThumb, "image/jpeg", "bucket", "thumb.jpg")
+	f2, _ := NewMsgFile(msg.PK, FileKindTgBigPic, "image/jpeg", "bucket", "big.jpg")
+	for _, err := range table.StoreItems(f1, f2) {
+		require.Nil(t, err)
+	}
+	deleted := make(map[string][]string)
+	origDelete := deleteS3Objects
+	defer func() { deleteS3Objects = origDelete }()
+	deleteS3Objects = func(ctx context.Context, bucket string, keys []string) error {
+		deleted[bucket] = append(deleted[bucket], keys...)
+		return nil
+	}
+	keys := map[string]events.DynamoDBAttributeValue{
+		"PK": events.NewStringAttribute(msg.PK),
+		"SK": events.NewStringAttribute(msg.PK),
+	}
+	e := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		{EventName: "REMOVE", Change: events.DynamoDBStreamRecord{Keys: keys, OldImage: keys}},
+	}}
+	HandleDBEvent(context.Background(), table, e)
+	assert.ElementsMatch(t, []string{"thumb.jpg", "big.jpg"}, deleted["bucket"])
+	var files []*MsgFile
+	require.Nil(t, table.FetchItemsWithPrefix(msg.PK, MsgFileKeyPrefix, &files))
+	assert.Equal(t, 0, len(files))
+}
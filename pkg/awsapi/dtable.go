@@ -1,6 +1,7 @@
 package awsapi
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -39,20 +40,28 @@ const (
 )
 
 const (
-	TGTextMsgKind     = 1
-	TGVoiceMsgKind    = 2
-	TGPhotoMsgKind    = 3
-	TGUnknownMsgKind  = 4
-	TGDocMsgKind      = 5
-	FolderStreamKind  = 6
-	FolderArchiveKind = 7
-	FolderTrashKind   = 8
+	TGTextMsgKind      = 1
+	TGVoiceMsgKind     = 2
+	TGPhotoMsgKind     = 3
+	TGUnknownMsgKind   = 4
+	TGDocMsgKind       = 5
+	FolderStreamKind   = 6
+	FolderArchiveKind  = 7
+	FolderTrashKind    = 8
+	TGAudioMsgKind     = 9
+	TGVideoMsgKind     = 10 // video and animation
+	TGVideoNoteMsgKind = 11
+	TGStickerMsgKind   = 12
+	TGLocationMsgKind  = 13
+	TGContactMsgKind   = 14
+	TGAlbumMsgKind     = 15
 )
 
 type Subscriptions []*Subscription
 
 //Provides access to DynamoDB table
 type DTable struct {
+	Storage
 	db       *dynamodb.DynamoDB
 	Name     string
 	Region   string
@@ -75,19 +84,38 @@ func (table *DTable) Connect() error {
 		return err
 	}
 	table.db = dynamodb.New(sess)
+	table.Storage = &dynamoStorage{db: table.db, name: table.Name}
 	return nil
 }
 
+// Creates DTable on top of MemStorage, no connection is needed
+func NewMemDTable(name string) (*DTable, error) {
+	table, err := NewDTable(name)
+	if err != nil {
+		return nil, err
+	}
+	table.Storage = NewMemStorage()
+	return table, nil
+}
+
 func (t *DTable) Create() error {
+	return t.CreateWithContext(context.Background())
+}
+
+func (t *DTable) CreateWithContext(ctx context.Context) error {
 	input := createTableInput // TODO make it copy
 	input.TableName = aws.String(t.Name)
-	_, err := t.db.CreateTable(input)
+	_, err := t.db.CreateTableWithContext(ctx, input)
 	return err
 }
 
 func (t *DTable) EnableTTL() error {
+	return t.EnableTTLWithContext(context.Background())
+}
+
+func (t *DTable) EnableTTLWithContext(ctx context.Context) error {
 	timeToLiveInput.TableName = aws.String(t.Name)
-	_, err := t.db.UpdateTimeToLive(timeToLiveInput)
+	_, err := t.db.UpdateTimeToLiveWithContext(ctx, timeToLiveInput)
 	return err
 }
 
@@ -99,206 +127,95 @@ func UniqueOp() func(*dynamodb.PutItemInput) error {
 	}
 }
 
-func (t *DTable) StoreItem(item interface{},
-	options ...func(*dynamodb.PutItemInput) error) error {
-	av, err := dattr.MarshalMap(item)
-	if err != nil {
-		return err
-	}
-	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(t.Name),
-	}
-	for _, ops := range options {
-		err := ops(input)
-		if err != nil {
-			return err
+const (
+	VersionField = "V"
+	// Skips version check of versioned update
+	AnyVersion = int64(-1)
+)
+
+// Condition that stored item has given version, version 0
+// matches items that were never versioned as well
+func versionCond(version int64, mustExist bool) string {
+	var cond string
+	switch {
+	case version == 0:
+		cond = "(attribute_not_exists(#V) OR #V = :ver)"
+	case version > 0:
+		cond = "#V = :ver"
+	}
+	if mustExist {
+		if cond == "" {
+			return "attribute_exists(PK)"
 		}
+		return "attribute_exists(PK) AND " + cond
 	}
-	_, err = t.db.PutItem(input)
-	if err != nil && strings.HasPrefix(err.Error(), "ConditionalCheckFailedException") {
-		return errors.New(ALREADY_EXISTS)
-	}
-	return err
+	return cond
 }
 
-//Store bunch of items in transactions, make sure they are new
-// by checking PK uniqueness
-func (t *DTable) StoreInTransUniq(items ...interface{}) error {
-	titems := []*dynamodb.TransactWriteItem{}
-	for _, i := range items {
-		av, err := dattr.MarshalMap(i)
+// Option to store item only if stored one has given version
+func VersionOp(version int64) func(*dynamodb.PutItemInput) error {
+	return func(pii *dynamodb.PutItemInput) error {
+		ver, err := dattr.Marshal(version)
 		if err != nil {
 			return err
 		}
-		titems = append(titems, &dynamodb.TransactWriteItem{
-			Put: &dynamodb.Put{
-				ConditionExpression: aws.String("attribute_not_exists(PK)"),
-				Item:                av,
-				TableName:           aws.String(t.Name),
-			},
-		})
+		pii.ConditionExpression = aws.String(versionCond(version, false))
+		pii.ExpressionAttributeNames = map[string]*string{"#V": aws.String(VersionField)}
+		pii.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":ver": ver}
+		return nil
 	}
-	_, err := t.db.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
-		TransactItems: titems})
-	return err
 }
 
 func (t *DTable) StoreItems(items ...interface{}) []error {
-	var output []error
-	for _, item := range items {
-		err := t.StoreItem(item)
-		output = append(output, err)
-	}
-	return output
+	return t.BatchStore(items...)
 }
 
-func (t *DTable) FetchItem(pk string, item interface{}) error {
-	return t.FetchSubItem(pk, pk, item)
+func (t *DTable) StoreItemsWithContext(ctx context.Context, items ...interface{}) []error {
+	return t.BatchStoreWithContext(ctx, items...)
 }
 
-func (t *DTable) FetchSubItem(pk, sk string, item interface{}) error {
-	result, err := t.db.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(t.Name),
-		Key: map[string]*dynamodb.AttributeValue{
-			"PK": {
-				S: aws.String(pk),
-			},
-			"SK": {
-				S: aws.String(sk),
-			},
-		},
-	})
-	if err != nil {
-		return err
-	}
-	if len(result.Item) == 0 {
-		return errors.New(NO_SUCH_ITEM)
-	}
-	err = dattr.UnmarshalMap(result.Item, item)
-	if err != nil {
-		return err
-	}
-
-	return nil
+func (t *DTable) UpdateItemData(pk, key string, value interface{}) (*dynamodb.UpdateItemOutput, error) {
+	return t.UpdateItemDataWithContext(context.Background(), pk, key, value)
 }
 
-func (t *DTable) FetchItemsWithPrefix(pk, prefix string, out interface{}) error {
-	cond := "PK = :pk AND begins_with(SK, :prefix)"
-	qi := &dynamodb.QueryInput{
-		TableName:              aws.String(t.Name),
-		KeyConditionExpression: aws.String(cond),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":prefix": {
-				S: aws.String(prefix),
-			},
-			":pk": {
-				S: aws.String(pk),
-			},
-		},
-	}
-
-	resp, err := t.db.Query(qi)
-	if err != nil {
-		return err
-	}
-	if len(resp.Items) > 0 {
-		return dattr.UnmarshalListOfMaps(resp.Items, out)
-	}
-	return nil
+func (t *DTable) UpdateItemDataWithContext(ctx context.Context, pk, key string, value interface{}) (
+	*dynamodb.UpdateItemOutput, error) {
+	return t.UpdateItemMapWithContext(ctx, pk, pk, "D", key, value)
 }
 
-func (t *DTable) UpdateItemData(pk, key string, value interface{}) (*dynamodb.UpdateItemOutput, error) {
-	return t.UpdateItemMap(pk, pk, "D", key, value)
+// Updates Data if item has given version, increments the version.
+// Returns error matching ErrVersionConflict if version is different
+func (t *DTable) UpdateItemDataIfVersion(pk, key string, value interface{}, version int64) (
+	*dynamodb.UpdateItemOutput, error) {
+	return t.UpdateItemDataIfVersionWithContext(context.Background(), pk, key, value, version)
 }
 
-const UpdatedAtField = "updated_at"
+func (t *DTable) UpdateItemDataIfVersionWithContext(ctx context.Context, pk, key string,
+	value interface{}, version int64) (*dynamodb.UpdateItemOutput, error) {
+	out, err := t.UpdateItemMapVersionWithContext(ctx, pk, pk, "D", key, value, version)
+	return out, versionConflictErr(err)
+}
 
-func (t *DTable) UpdateItemMap(pk, sk, fName, key string, value interface{}) (*dynamodb.UpdateItemOutput, error) {
-	val, err := dattr.Marshal(value)
-	if err != nil {
-		return nil, err
-	}
-	uii := &dynamodb.UpdateItemInput{
-		TableName:    aws.String(t.Name),
-		ReturnValues: aws.String("ALL_NEW"),
-		ExpressionAttributeNames: map[string]*string{
-			"#Data":      aws.String(fName),
-			"#Key":       aws.String(key),
-			"#UpdatedAt": aws.String(UpdatedAtField),
-		},
-		UpdateExpression: aws.String("SET #Data.#Key = :v, #Data.#UpdatedAt = :t"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":v": val,
-			":t": {
-				N: aws.String(fmt.Sprintf("%d", time.Now().Unix())),
-			},
-		},
-		Key: map[string]*dynamodb.AttributeValue{
-			"PK": {S: aws.String(pk)},
-			"SK": {S: aws.String(sk)},
-		},
-	}
-	return t.db.UpdateItem(uii)
-}
-
-func (t *DTable) IncrProp(pk, sk, propName string, amount int64) error {
-	exprVals, err := dattr.MarshalMap(map[string]int64{
-		":v": amount},
-	)
-	if err != nil {
-		return err
-	}
-	uii := &dynamodb.UpdateItemInput{
-		TableName: aws.String(t.Name),
-		ExpressionAttributeNames: map[string]*string{
-			"#PropName": aws.String(propName),
-		},
-		UpdateExpression:          aws.String("ADD #PropName :v"),
-		ExpressionAttributeValues: exprVals,
-		Key: map[string]*dynamodb.AttributeValue{
-			"PK": {S: aws.String(pk)},
-			"SK": {S: aws.String(sk)},
-		},
-	}
-	_, err = t.db.UpdateItem(uii)
-	return err
+// Updates Msg.Data incrementing its version, so concurrent
+// versioned writes of the Msg fail instead of clobbering it
+func (t *DTable) UpdateMsgData(pk, key string, value interface{}) (*dynamodb.UpdateItemOutput, error) {
+	return t.UpdateMsgDataWithContext(context.Background(), pk, key, value)
 }
 
-func (t *DTable) FetchTGAcc(tgid int, tgacc *TGAcc) error {
-	pk := fmt.Sprintf("%s%d", TGAccKeyPrefix, tgid)
-	return t.FetchItem(pk, tgacc)
+func (t *DTable) UpdateMsgDataWithContext(ctx context.Context, pk, key string, value interface{}) (
+	*dynamodb.UpdateItemOutput, error) {
+	return t.UpdateItemMapVersionWithContext(ctx, pk, pk, "D", key, value, AnyVersion)
 }
 
-func (t *DTable) QueryIndex(
-	name string, cond string, exprValues map[string]interface{}) (*dynamodb.QueryOutput, error) {
-	av, err := dattr.MarshalMap(exprValues)
-	if err != nil {
-		return nil, err
-	}
-	qi := &dynamodb.QueryInput{
-		TableName:                 aws.String(t.Name),
-		IndexName:                 aws.String(name),
-		KeyConditionExpression:    aws.String(cond),
-		ExpressionAttributeValues: av,
-	}
-	return t.db.Query(qi)
+const UpdatedAtField = "updated_at"
+
+func (t *DTable) FetchTGAcc(tgid int, tgacc *TGAcc) error {
+	return t.FetchTGAccWithContext(context.Background(), tgid, tgacc)
 }
 
-func (t *DTable) DeleteSubItem(pk, sk string) error {
-	input := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"PK": {
-				S: aws.String(pk),
-			},
-			"SK": {
-				S: aws.String(sk),
-			},
-		},
-		TableName: aws.String(t.Name),
-	}
-	_, err := t.db.DeleteItem(input)
-	return err
+func (t *DTable) FetchTGAccWithContext(ctx context.Context, tgid int, tgacc *TGAcc) error {
+	pk := fmt.Sprintf("%s%d", TGAccKeyPrefix, tgid)
+	return t.FetchItemWithContext(ctx, pk, tgacc)
 }
 
 type UMSField struct {
@@ -346,14 +263,89 @@ func (ums *UMSField) Parse(s string) error {
 }
 
 type Msg struct {
-	PK        string
-	SK        string
-	ChannelPK string                 `dynamodbav:"Ch"`
-	AuthorPK  string                 `dynamodbav:"A"`
-	Kind      int64                  `dynamodbav:"K"`
-	UMS       UMSField               `dynamodbav:"UMS"`
-	CreatedAt int64                  `dynamodbav:"CRTD"`
-	Data      map[string]interface{} `dynamodbav:"D"`
+	PK          string
+	SK          string
+	ChannelPK   string                 `dynamodbav:"Ch"`
+	AuthorPK    string                 `dynamodbav:"A"`
+	Kind        int64                  `dynamodbav:"K"`
+	UMS         UMSField               `dynamodbav:"UMS"`
+	CreatedAt   int64                  `dynamodbav:"CRTD"`
+	Data        map[string]interface{} `dynamodbav:"D"`
+	Version     int64                  `dynamodbav:"V,omitempty"`
+	OMS         string                 `dynamodbav:"OMS,omitempty"` // PK of Org which stream Msg belongs to
+	TrashedAt   int64                  `dynamodbav:"TRSH,omitempty"`
+	RestoreUMS  string                 `dynamodbav:"RUMS,omitempty"` // UMS Msg had before it was trashed
+	TTL         int64                  `dynamodbav:"TTL,omitempty"`
+	Tags        []string               `dynamodbav:"TG,omitempty"`
+	ParentPK    string                 `dynamodbav:"PRNT,omitempty"` // PK of Msg this one replies to
+	ThreadPK    string                 `dynamodbav:"THR,omitempty"`  // PK of the first Msg of the thread
+	DueAt       int64                  `dynamodbav:"DUE,omitempty"`  // when to remind about Msg
+	TaskState   string                 `dynamodbav:"TS,omitempty"`
+	Assignee    string                 `dynamodbav:"ASG,omitempty"`  // PK of User task is assigned to
+	CompletedAt int64                  `dynamodbav:"CMPL,omitempty"` // when task was done
+	TaskKey     string                 `dynamodbav:"TSK,omitempty"`  // <Assignee>#<TaskState>, key of TaskIndex
+}
+
+const NOT_IN_TRASH = "Msg is not in trash"
+
+// How long Msg stays in Trash before DynamoDB purges it by TTL
+var TrashRetention = 30 * 24 * time.Hour
+
+// Moves Msg to folder given by ums, trash tells if the folder is Trash.
+// Trashed Msg remembers where it was and gets TTL, moving it out of Trash
+// clears that
+func (m *Msg) MoveTo(ums UMSField, trash bool) {
+	if trash && m.TrashedAt == 0 {
+		m.RestoreUMS = m.UMS.String()
+		m.TrashedAt = time.Now().Unix()
+		m.TTL = m.TrashedAt + int64(TrashRetention.Seconds())
+	}
+	if !trash {
+		m.TrashedAt = 0
+		m.RestoreUMS = ""
+		m.TTL = 0
+	}
+	m.UMS = ums
+}
+
+// Moves trashed Msg back to the folder it was in, INBOX if that is unknown
+func (m *Msg) Restore() error {
+	if m.TrashedAt == 0 {
+		return errors.New(NOT_IN_TRASH)
+	}
+	ums := UMSField{PK: m.UMS.PK}
+	if err := ums.Parse(m.RestoreUMS); err != nil {
+		ums = UMSField{PK: m.UMS.PK}
+	}
+	m.MoveTo(ums, false)
+	return nil
+}
+
+// Returns true if UMS points to a folder of Trash kind
+func (t *DTable) IsTrashFolder(ums UMSField) (bool, error) {
+	return t.IsTrashFolderWithContext(context.Background(), ums)
+}
+
+func (t *DTable) IsTrashFolderWithContext(ctx context.Context, ums UMSField) (bool, error) {
+	folder := &Folder{}
+	err := t.FetchSubItemWithContext(ctx, ums.PK, fmt.Sprintf("%s%d", FolderKeyPrefix, ums.Status), folder)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return folder.Kind == FolderTrashKind, nil
+}
+
+// Deletes Msg right away, its files are deleted by HandleDBEvent
+// on REMOVE event the same way as for Msgs purged by TTL
+func (t *DTable) PurgeMsg(pk string) error {
+	return t.PurgeMsgWithContext(context.Background(), pk)
+}
+
+func (t *DTable) PurgeMsgWithContext(ctx context.Context, pk string) error {
+	return t.DeleteSubItemWithContext(ctx, pk, pk)
 }
 
 //Option for new msg
@@ -375,6 +367,14 @@ func UserStatusOp(s int) func(*Msg) error {
 	}
 }
 
+// Option to put new Msg to Org stream
+func OrgOp(orgPK string) func(*Msg) error {
+	return func(m *Msg) error {
+		m.OMS = orgPK
+		return nil
+	}
+}
+
 func DataOp(d map[string]interface{}) func(m *Msg) error {
 	return func(m *Msg) error {
 		m.Data = d
@@ -406,8 +406,33 @@ func NewMsg(channel string, pk string, kind int64, options ...func(*Msg) error)
 	return msg, nil
 }
 
+// Stores Msg if stored one has given version, Msg.Version is incremented.
+// Returns error matching ErrVersionConflict if version is different
+func (t *DTable) StoreMsgIfVersion(msg *Msg, version int64) error {
+	return t.StoreMsgIfVersionWithContext(context.Background(), msg, version)
+}
+
+func (t *DTable) StoreMsgIfVersionWithContext(ctx context.Context, msg *Msg, version int64) error {
+	msg.Version = version + 1
+	err := t.StoreItemWithContext(ctx, msg, VersionOp(version))
+	if err != nil {
+		msg.Version = version
+	}
+	return versionConflictErr(err)
+}
+
 func (m *Msg) Reload(table *DTable) error {
-	return table.FetchItem(m.PK, m)
+	return m.ReloadWithContext(context.Background(), table)
+}
+
+// Attributes missing in stored Msg are reset too, like TTL of restored one
+func (m *Msg) ReloadWithContext(ctx context.Context, table *DTable) error {
+	fresh := &Msg{}
+	if err := table.FetchItemWithContext(ctx, m.PK, fresh); err != nil {
+		return err
+	}
+	*m = *fresh
+	return nil
 }
 
 func (m *Msg) UpdatedAt() int64 {
@@ -449,13 +474,57 @@ func (lm *ListMsg) FetchByUserStatus(t *DTable, userPK string, status int, start
 	return lm.FetchByUMS(t, userPK, ums, start_time.Unix(), end_time.Unix())
 }
 
+// Fetches all Msgs for UMS created in between start and end
 func (lm *ListMsg) FetchByUMS(t *DTable, userPK, ums string, start, end int64) error {
-	exprValues := map[string]interface{}{":ums": ums, ":start": start, ":end": end}
-	resp, err := t.QueryIndex("UMSIndex", "UMS = :ums and CRTD BETWEEN :start AND :end", exprValues)
+	return lm.FetchByUMSPageWithContext(context.Background(), t, userPK, ums, start, end, PageOpts{})
+}
+
+// Fetches one page of Msgs for UMS, where the page stopped is kept
+// in LastEvaluatedKey, use Cursor() to get it for the next page
+func (lm *ListMsg) FetchByUMSPage(t *DTable, userPK, ums string, start, end int64, page PageOpts) error {
+	return lm.FetchByUMSPageWithContext(context.Background(), t, userPK, ums, start, end, page)
+}
+
+func (lm *ListMsg) FetchByUMSPageWithContext(ctx context.Context, t *DTable,
+	userPK, ums string, start, end int64, page PageOpts) error {
+	return lm.fetchPage(ctx, t, QueryParams{
+		Index:  "UMSIndex",
+		Cond:   "UMS = :ums and CRTD BETWEEN :start AND :end",
+		Values: map[string]interface{}{":ums": ums, ":start": start, ":end": end},
+	}, page)
+}
+
+// Fetches all Msgs of Org stream created in between start and end
+func (lm *ListMsg) FetchByOMS(t *DTable, orgPK string, start, end int64) error {
+	return lm.FetchByOMSPageWithContext(context.Background(), t, orgPK, start, end, PageOpts{})
+}
+
+// Fetches one page of Msgs of Org stream, works like FetchByUMSPage
+func (lm *ListMsg) FetchByOMSPage(t *DTable, orgPK string, start, end int64, page PageOpts) error {
+	return lm.FetchByOMSPageWithContext(context.Background(), t, orgPK, start, end, page)
+}
+
+func (lm *ListMsg) FetchByOMSPageWithContext(ctx context.Context, t *DTable,
+	orgPK string, start, end int64, page PageOpts) error {
+	return lm.fetchPage(ctx, t, QueryParams{
+		Index:  "OMSIndex",
+		Cond:   "OMS = :oms and CRTD BETWEEN :start AND :end",
+		Values: map[string]interface{}{":oms": orgPK, ":start": start, ":end": end},
+	}, page)
+}
+
+func (lm *ListMsg) fetchPage(ctx context.Context, t *DTable, params QueryParams, page PageOpts) error {
+	params.Limit = page.Limit
+	params.Desc = page.Desc
+	startKey, err := DecodeCursor(page.Cursor)
 	if err != nil {
 		return err
 	}
-	for _, item := range resp.Items {
+	items, lastKey, err := t.queryPages(ctx, params, startKey)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
 		msg := &Msg{}
 		err = dattr.UnmarshalMap(item, msg)
 		if err != nil {
@@ -463,9 +532,22 @@ func (lm *ListMsg) FetchByUMS(t *DTable, userPK, ums string, start, end int64) e
 		}
 		lm.Items[msg.PK] = msg
 	}
+	if lastKey == nil {
+		lastKey = map[string]*dynamodb.AttributeValue{}
+	}
+	lm.LastEvaluatedKey = lastKey
 	return nil
 }
 
+// Cursor for the next page, empty if everything is fetched
+func (lm *ListMsg) Cursor() string {
+	cursor, err := EncodeCursor(lm.LastEvaluatedKey)
+	if err != nil {
+		return ""
+	}
+	return cursor
+}
+
 func (lm *ListMsg) GetPKs() []string {
 	keys := make([]string, 0, len(lm.Items))
 	for k := range lm.Items {
@@ -534,6 +616,20 @@ func (u *User) SetEmail(e string) error {
 	return nil
 }
 
+// Key of User.Data with time zone of the user, like "Europe/Moscow"
+const UserTZKey = "tz"
+
+// Location the user reads and writes times in, ReminderLocation if
+// the user has not set time zone
+func (u *User) Location() *time.Location {
+	if name, ok := u.Data[UserTZKey].(string); ok && name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return ReminderLocation
+}
+
 // interface for telebot
 func (u *User) Recipient() string {
 	return u.TGID
@@ -552,6 +648,10 @@ func (t *TGAcc) String() string {
 }
 
 func (t *DTable) StoreUserTG(user *User, tgid int, bot *Bot) error {
+	return t.StoreUserTGWithContext(context.Background(), user, tgid, bot)
+}
+
+func (t *DTable) StoreUserTGWithContext(ctx context.Context, user *User, tgid int, bot *Bot) error {
 	tg, err := NewTGAcc(tgid, user.PK)
 	if err != nil {
 		return err
@@ -563,18 +663,22 @@ func (t *DTable) StoreUserTG(user *User, tgid int, bot *Bot) error {
 
 	}
 
-	err = t.StoreItem(tg, UniqueOp())
+	err = t.StoreItemWithContext(ctx, tg, UniqueOp())
 	if err != nil {
 		return err
 	}
 	user.TGID = tg.TGID
-	err = t.StoreItem(user)
+	err = t.StoreItemWithContext(ctx, user)
 	return err
 }
 
 //Store user, telephon number, email in one transaction
 //it fails if number or email already exist
 func (t *DTable) StoreNewUser(user *User) error {
+	return t.StoreNewUserWithContext(context.Background(), user)
+}
+
+func (t *DTable) StoreNewUserWithContext(ctx context.Context, user *User) error {
 	items := []interface{}{user}
 	if user.Tel != "" {
 		tel, err := NewTel(user.Tel, user.PK)
@@ -590,7 +694,7 @@ func (t *DTable) StoreNewUser(user *User) error {
 		}
 		items = append(items, email)
 	}
-	return t.StoreInTransUniq(items...)
+	return t.StoreInTransUniqWithContext(ctx, items...)
 }
 
 func (u *User) FetchWSConns(table *DTable, out interface{}) error {
@@ -654,6 +758,8 @@ type Bot struct {
 	Secret    string                 `dynamodbav:"S"`
 	CreatedAt int64                  `dynamodbav:"CRTD"`
 	Data      map[string]interface{} `dynamodbav:"D"`
+	// Telegram sends it with every webhook request, see CheckWebhookToken
+	WebhookToken string `dynamodbav:"WT,omitempty"`
 }
 
 func GetBotPK(kind, name string) string {
@@ -668,6 +774,10 @@ func NewBot(kind, name string) (*Bot, error) {
 	return bot, nil
 }
 
+func (t *DTable) FetchTGBotWithContext(ctx context.Context, name string, bot *Bot) error {
+	return t.FetchItemWithContext(ctx, GetBotPK(TGBotKind, name), bot)
+}
+
 func (b *Bot) InviteUrl(otp string) string {
 	return fmt.Sprintf("%s/%s?start=%s", "https://t.me", b.Name, otp)
 }
@@ -718,18 +828,22 @@ func MakeInvPK(bot *Bot, code string) (string, error) {
 }
 
 func (t *DTable) FetchInvite(bot *Bot, code string, inv *Invite) error {
+	return t.FetchInviteWithContext(context.Background(), bot, code, inv)
+}
+
+func (t *DTable) FetchInviteWithContext(ctx context.Context, bot *Bot, code string, inv *Invite) error {
 	pk, err := MakeInvPK(bot, code)
 	if err != nil {
 		return err
 	}
-	err = t.FetchItem(pk, inv)
+	err = t.FetchItemWithContext(ctx, pk, inv)
 	if err != nil {
 		//	fmt.Printf("Could not fetch invite for PK %s", pk)
 		return err
 	}
 	if !inv.IsValid() {
 		fmt.Printf("%#v is expired \n", inv)
-		return errors.New(NO_SUCH_ITEM)
+		return newNotFoundErr()
 	}
 	if inv.Data == nil {
 		inv.Data = make(map[string]interface{})
@@ -771,9 +885,9 @@ type WSConn struct {
 	PK         string
 	SK         string
 	TTL        int64
-	DomainName string `dynamodbav":"D"`
-	Stage      string `dynamodbav":"S"`
-	CreatedAt  int64  `dynamodbav":"CRTD"`
+	DomainName string `dynamodbav:"D"`
+	Stage      string `dynamodbav:"S"`
+	CreatedAt  int64  `dynamodbav:"CRTD"`
 }
 
 func NewWSConn(userPK, id, domain, stage string) (*WSConn, error) {
@@ -851,6 +965,10 @@ type SubscrEvent struct {
 }
 
 func (s *Subscription) SendDBEvent(pk, name, ums string, kind int64) error {
+	return s.SendDBEventWithContext(context.Background(), pk, name, ums, kind)
+}
+
+func (s *Subscription) SendDBEventWithContext(ctx context.Context, pk, name, ums string, kind int64) error {
 	sender, _ := NewWSSender(s.Endpoint(), s.ConnectionId(), nil)
 	event := SubscrEvent{PK: pk, EventName: name, Name: "dbevent", UMS: ums, MsgKind: kind}
 	data, err := json.Marshal(event)
@@ -858,7 +976,7 @@ func (s *Subscription) SendDBEvent(pk, name, ums string, kind int64) error {
 	if err != nil {
 		return err
 	}
-	return sender.Send(data)
+	return sender.SendWithContext(ctx, data)
 }
 
 const (
@@ -867,6 +985,11 @@ const (
 	FileKindTgMediumPic = "mediumpic"
 	FileKindTgBigPic    = "bigpic"
 	FileKindTgVoice     = "voice"
+	FileKindTgDoc       = "doc"
+	FileKindTgAudio     = "audio"
+	FileKindTgVideo     = "video"
+	FileKindTgVideoNote = "videonote"
+	FileKindTgSticker   = "sticker"
 )
 
 type MsgFile struct {
@@ -878,6 +1001,8 @@ type MsgFile struct {
 	Mime      string                 `dynamodbav:"M"`
 	Bucket    string                 `dynamodbav:"B"`
 	Key       string                 `dynamodbav:"K"`
+	// Position of album item the file belongs to, 0 for other Msgs
+	Position int64 `dynamodbav:"POS,omitempty"`
 }
 
 func NewMsgFile(pk, kind, mime, bucket, key string) (*MsgFile, error) {
@@ -963,6 +1088,54 @@ func NewOrg(title, motto string, admins []*User) (*Org, error) {
 	return org, nil
 }
 
+// Membership of User in Org, stored under User's PK with Org's PK as SK
+type OrgMember struct {
+	PK        string
+	SK        string
+	Role      string `dynamodbav:"R"`
+	CreatedAt int64  `dynamodbav:"CRTD"`
+}
+
+const (
+	OrgAdminRole  = "admin"
+	OrgMemberRole = "member"
+)
+
+func NewOrgMember(org *Org, user *User, role string) (*OrgMember, error) {
+	if role != OrgAdminRole && role != OrgMemberRole {
+		return nil, fmt.Errorf("Unknown org role %s", role)
+	}
+	return &OrgMember{PK: user.PK, SK: org.PK, Role: role, CreatedAt: time.Now().Unix()}, nil
+}
+
+// Stores Org along with memberships of its admins
+func (t *DTable) StoreNewOrg(org *Org) error {
+	return t.StoreNewOrgWithContext(context.Background(), org)
+}
+
+func (t *DTable) StoreNewOrgWithContext(ctx context.Context, org *Org) error {
+	items := []interface{}{org}
+	for _, pk := range org.Admins {
+		items = append(items, &OrgMember{PK: pk, SK: org.PK, Role: OrgAdminRole, CreatedAt: org.CreatedAt})
+	}
+	return t.StoreInTransUniqWithContext(ctx, items...)
+}
+
+func (u *User) IsOrgMember(table *DTable, orgPK string) (bool, error) {
+	return u.IsOrgMemberWithContext(context.Background(), table, orgPK)
+}
+
+func (u *User) IsOrgMemberWithContext(ctx context.Context, table *DTable, orgPK string) (bool, error) {
+	if !strings.HasPrefix(orgPK, OrgKeyPrefix) {
+		return false, nil
+	}
+	err := table.FetchSubItemWithContext(ctx, u.PK, orgPK, &OrgMember{})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 type UserPerm struct {
 	PK        string
 	SK        string
@@ -1019,6 +1192,11 @@ func NewFolder(ownerPK, title string, id, kind int64) (*Folder, error) {
 }
 
 func (u *User) HasPerm(table *DTable, folderPK, folderSK, value string) (bool, error) {
+	return u.HasPermWithContext(context.Background(), table, folderPK, folderSK, value)
+}
+
+func (u *User) HasPermWithContext(ctx context.Context, table *DTable,
+	folderPK, folderSK, value string) (bool, error) {
 	if err := checkPermValue(value); err != nil {
 		return false, err
 	}
@@ -1027,7 +1205,7 @@ func (u *User) HasPerm(table *DTable, folderPK, folderSK, value string) (bool, e
 		return true, nil
 	}
 	prefix := fmt.Sprintf("%s%s#%s#%s", PermKeyPrefix, folderPK, folderSK, value)
-	if err := table.FetchItemsWithPrefix(u.PK, prefix, &perms); err != nil {
+	if err := table.FetchItemsWithPrefixWithContext(ctx, u.PK, prefix, &perms); err != nil {
 		return false, err
 	}
 	if len(perms) == 1 {
@@ -1055,6 +1233,10 @@ func (f *Folder) UserCanAdmin(table *DTable, u *User) (bool, error) {
 // Ensure User account has 4 default folders:
 // INBOX, Archive, Selected, Trash
 func (u *User) EnsureDefaultFolders(table *DTable) error {
+	return u.EnsureDefaultFoldersWithContext(context.Background(), table)
+}
+
+func (u *User) EnsureDefaultFoldersWithContext(ctx context.Context, table *DTable) error {
 
 	inbox, _ := NewFolder(u.PK, "INBOX", 0, FolderStreamKind)
 	archive, _ := NewFolder(u.PK, "Archive", 1, FolderArchiveKind)
@@ -1068,7 +1250,7 @@ func (u *User) EnsureDefaultFolders(table *DTable) error {
 	folderMap[trash.SK] = trash
 
 	var existed []*Folder
-	if err := table.FetchItemsWithPrefix(u.PK, FolderKeyPrefix, &existed); err != nil {
+	if err := table.FetchItemsWithPrefixWithContext(ctx, u.PK, FolderKeyPrefix, &existed); err != nil {
 		return err
 	}
 	existedMap := make(map[string]bool)
@@ -1076,19 +1258,28 @@ func (u *User) EnsureDefaultFolders(table *DTable) error {
 		existedMap[f.SK] = true
 	}
 
+	var missing []interface{}
 	for sk, folder := range folderMap {
 		if _, exists := existedMap[sk]; !exists {
-			if err := table.StoreItem(folder); err != nil {
-				return err
-			}
+			missing = append(missing, folder)
+		}
+	}
+	for _, err := range table.BatchStoreWithContext(ctx, missing...) {
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
 func (table *DTable) FetchFolderViews(userPK string, folderView *[]FolderView) error {
+	return table.FetchFolderViewsWithContext(context.Background(), userPK, folderView)
+}
+
+func (table *DTable) FetchFolderViewsWithContext(ctx context.Context, userPK string,
+	folderView *[]FolderView) error {
 	var folders []*Folder
-	if err := table.FetchItemsWithPrefix(userPK, FolderKeyPrefix, &folders); err != nil {
+	if err := table.FetchItemsWithPrefixWithContext(ctx, userPK, FolderKeyPrefix, &folders); err != nil {
 		return err
 	}
 	for _, folder := range folders {
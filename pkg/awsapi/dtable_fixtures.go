@@ -28,6 +28,10 @@ var createTableInput = &dynamodb.CreateTableInput{
 			AttributeName: aws.String("OMS"),
 			AttributeType: aws.String("S"),
 		},
+		{
+			AttributeName: aws.String("TSK"),
+			AttributeType: aws.String("S"),
+		},
 		/*	{
 			AttributeName: aws.String("TTL"),
 			AttributeType: aws.String("N"),
@@ -78,6 +82,24 @@ var createTableInput = &dynamodb.CreateTableInput{
 				},
 			},
 		},
+		{
+			IndexName: aws.String("TaskIndex"),
+			Projection: &dynamodb.Projection{
+				ProjectionType: aws.String("INCLUDE"),
+				NonKeyAttributes: []*string{aws.String("PK"), aws.String("K"), aws.String("UMS"),
+					aws.String("TS"), aws.String("ASG"), aws.String("CMPL")},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{
+					AttributeName: aws.String("TSK"),
+					KeyType:       aws.String("HASH"),
+				},
+				{
+					AttributeName: aws.String("CRTD"),
+					KeyType:       aws.String("RANGE"),
+				},
+			},
+		},
 	},
 }
 
@@ -1,6 +1,8 @@
 package awsapi
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"regexp"
@@ -398,12 +400,34 @@ func TestBot(t *testing.T) {
 	if !reflect.DeepEqual(bf, bot) {
 		t.Errorf("%+v != %+v", bot, bf)
 	}
+	bf = &Bot{}
+	err = testTable.FetchTGBotWithContext(context.Background(), "foo", bf)
+	if err != nil {
+		t.Error(err)
+	}
+	if bf.PK != bot.PK {
+		t.Errorf("Fetched %s instead of %s", bf.PK, bot.PK)
+	}
 	if bot.InviteUrl("111111") != "https://t.me/foo?start=111111" {
 		t.Errorf("Invite URL is not correct, got %s expected %s", bot.InviteUrl("111111"),
 			"http://t.me/foo?start=111111")
 	}
 }
 
+func TestBotWebhookToken(t *testing.T) {
+	bot, _ := NewBot(TGBotKind, "foo")
+	assert.False(t, bot.CheckWebhookToken(""))
+	token, err := NewWebhookToken()
+	require.Nil(t, err)
+	assert.Regexp(t, "^[0-9a-f]{64}$", token)
+	other, _ := NewWebhookToken()
+	assert.NotEqual(t, token, other)
+	bot.WebhookToken = token
+	assert.True(t, bot.CheckWebhookToken(token))
+	assert.False(t, bot.CheckWebhookToken(other))
+	assert.False(t, bot.CheckWebhookToken(""))
+}
+
 func TestInvite(t *testing.T) {
 	defer stopLocalDynamo()
 	testTable := startLocalDynamo(t)
@@ -647,3 +671,104 @@ func TestUserEnsureDefaultFolders(t *testing.T) {
 	assert.Equal(t, fmt.Sprintf("%s3", FolderKeyPrefix), folders[3].SK)
 
 }
+
+func TestMsgVersion(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	user, _ := NewUser("user1")
+	msg, _ := NewMsg("bot1", user.PK, TGVoiceMsgKind)
+	msg.Data["text"] = "foo"
+	require.Nil(t, table.StoreItem(msg))
+
+	stale := &Msg{}
+	require.Nil(t, table.FetchItem(msg.PK, stale))
+	assert.Equal(t, int64(0), stale.Version)
+
+	require.Nil(t, table.StoreMsgIfVersion(msg, 0))
+	assert.Equal(t, int64(1), msg.Version)
+	_, err := table.UpdateMsgData(msg.PK, RecognizedTextFieldName, "spam")
+	require.Nil(t, err)
+
+	err = table.StoreMsgIfVersion(stale, 0)
+	assert.True(t, errors.Is(err, ErrVersionConflict))
+	assert.Equal(t, int64(0), stale.Version)
+	_, err = table.UpdateItemDataIfVersion(msg.PK, "text", "bar", 1)
+	assert.True(t, errors.Is(err, ErrVersionConflict))
+
+	out, err := table.UpdateItemDataIfVersion(msg.PK, "text", "bar", 2)
+	require.Nil(t, err)
+	assert.Equal(t, "3", *out.Attributes[VersionField].N)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, "bar", msg.Data["text"])
+	assert.Equal(t, "spam", msg.Data[RecognizedTextFieldName])
+
+	_, err = table.UpdateItemDataIfVersion("nosuch", "text", "bar", 0)
+	assert.True(t, errors.Is(err, ErrConditionFailed))
+}
+
+func TestOrgStream(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	admin, _ := NewUser("admin")
+	user, _ := NewUser("user")
+	org, _ := NewOrg("team", "", []*User{admin})
+	require.Nil(t, table.StoreNewOrg(org))
+	member, err := admin.IsOrgMember(table, org.PK)
+	require.Nil(t, err)
+	assert.True(t, member)
+	member, err = user.IsOrgMember(table, org.PK)
+	require.Nil(t, err)
+	assert.False(t, member)
+
+	msg1, _ := NewMsg("bot1", user.PK, TGTextMsgKind, CreatedAtOp("-2d"), OrgOp(org.PK))
+	msg2, _ := NewMsg("bot1", admin.PK, TGTextMsgKind, CreatedAtOp("-1d"), OrgOp(org.PK))
+	msg3, _ := NewMsg("bot1", admin.PK, TGTextMsgKind, CreatedAtOp("-1d"))
+	for _, err := range table.StoreItems(msg1, msg2, msg3) {
+		require.Nil(t, err)
+	}
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchByOMS(table, org.PK, msg1.CreatedAt, time.Now().Unix()))
+	require.Equal(t, 2, lm.Len())
+	assert.Equal(t, msg1.PK, lm.Asc()[0].PK)
+	assert.Equal(t, org.PK, lm.Asc()[0].OMS)
+
+	lm = NewListMsg()
+	require.Nil(t, lm.FetchByOMSPage(table, org.PK, 0, time.Now().Unix(), PageOpts{Limit: 1, Desc: true}))
+	require.Equal(t, 1, lm.Len())
+	assert.Equal(t, msg2.PK, lm.Asc()[0].PK)
+	assert.NotEqual(t, "", lm.Cursor())
+}
+
+func TestMsgTrash(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	user, _ := NewUser("user")
+	require.Nil(t, user.EnsureDefaultFolders(table))
+	trash, err := table.IsTrashFolder(UMSField{PK: user.PK, Status: 3})
+	require.Nil(t, err)
+	assert.True(t, trash)
+	trash, err = table.IsTrashFolder(UMSField{PK: user.PK, Status: 2})
+	require.Nil(t, err)
+	assert.False(t, trash)
+
+	msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind, UserStatusOp(2))
+	assert.Equal(t, NOT_IN_TRASH, msg.Restore().Error())
+	msg.MoveTo(UMSField{PK: user.PK, Status: 3}, true)
+	assert.Equal(t, fmt.Sprintf("%s#2", user.PK), msg.RestoreUMS)
+	assert.NotEqual(t, int64(0), msg.TrashedAt)
+	assert.Equal(t, msg.TrashedAt+int64(TrashRetention.Seconds()), msg.TTL)
+	require.Nil(t, table.StoreItem(msg))
+
+	fetched := &Msg{}
+	require.Nil(t, table.FetchItem(msg.PK, fetched))
+	require.Nil(t, fetched.Restore())
+	assert.Equal(t, int64(2), fetched.UMS.Status)
+	assert.Equal(t, int64(0), fetched.TTL)
+	assert.Equal(t, "", fetched.RestoreUMS)
+
+	mem := table.Storage.(*MemStorage)
+	mem.Now = func() time.Time { return time.Now().Add(TrashRetention + time.Hour) }
+	removed := mem.PurgeExpired()
+	require.Equal(t, 1, len(removed))
+	assert.Equal(t, msg.PK, *removed[0]["PK"].S)
+	assert.True(t, errors.Is(table.FetchItem(msg.PK, fetched), ErrNotFound))
+}
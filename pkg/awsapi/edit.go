@@ -0,0 +1,97 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const (
+	EditsFieldName = "edits"
+	// How many previous versions of text Msg keeps
+	MaxEditHistory = 20
+)
+
+// Text of Telegram message as it is stored in Msg
+func tgMsgText(tgmsg *tb.Message) (string, []tb.MessageEntity) {
+	if tgmsg.Text != "" {
+		if strings.HasPrefix(tgmsg.Text, "/todo ") {
+			return strings.TrimSpace(strings.TrimPrefix(tgmsg.Text, "/todo")), nil
+		}
+		return tgmsg.Text, tgmsg.Entities
+	}
+	return tgmsg.Caption, tgmsg.CaptionEntities
+}
+
+// Sets new text of Msg, previous one goes to the history of edits
+// with time it was set at. Tags found in the old text are replaced
+// with tags of the new one, tags added other ways are kept
+func (m *Msg) EditText(text string, entities []tb.MessageEntity, editedAt int64) bool {
+	if m.Data == nil {
+		m.Data = make(map[string]interface{})
+	}
+	old, _ := m.Data["text"].(string)
+	if old == text {
+		return false
+	}
+	var edits []interface{}
+	if prev, ok := m.Data[EditsFieldName].([]interface{}); ok {
+		edits = prev
+	}
+	edits = append(edits, map[string]interface{}{"text": old, UpdatedAtField: m.UpdatedAt()})
+	if len(edits) > MaxEditHistory {
+		edits = edits[len(edits)-MaxEditHistory:]
+	}
+	m.Data[EditsFieldName] = edits
+	m.Data["text"] = text
+	// numbers of Data come back from DynamoDB as float64
+	m.Data[UpdatedAtField] = float64(editedAt)
+	for _, tag := range ExtractTags(old, nil) {
+		m.RemoveTag(tag)
+	}
+	for _, tag := range ExtractTags(text, entities) {
+		m.AddTag(tag)
+	}
+	return true
+}
+
+// Handles edited_message, text of stored Msg is replaced. Edits of
+// messages that were not stored are ignored
+func handleTGEditedMsg(ctx context.Context, bot *Bot, table *DTable, tgmsg *tb.Message) (string, error) {
+	tgacc := &TGAcc{}
+	err := table.FetchTGAccWithContext(ctx, tgmsg.Sender.ID, tgacc)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	text, entities := tgMsgText(tgmsg)
+	editedAt := tgmsg.LastEdit
+	if editedAt == 0 {
+		editedAt = time.Now().Unix()
+	}
+	for attempt := 1; ; attempt++ {
+		msg := &Msg{}
+		err = table.FetchMsgByTGWithContext(ctx, bot.PK, tgmsg, msg)
+		if errors.Is(err, ErrNotFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if msg.UMS.PK != tgacc.OwnerPK && msg.AuthorPK != tgacc.OwnerPK {
+			return "", nil
+		}
+		if !msg.EditText(text, entities, editedAt) {
+			return "", nil
+		}
+		err = table.StoreMsgIfVersionWithContext(ctx, msg, msg.Version)
+		if err == nil || attempt == msgUpdateAttempts || !errors.Is(err, ErrVersionConflict) {
+			return "", err
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgEditText(t *testing.T) {
+	msg, _ := NewMsg("bot1", "user#1", TGTextMsgKind)
+	msg.Data["text"] = "buy milk #shop"
+	msg.Tags = []string{"home", "shop"}
+	assert.False(t, msg.EditText("buy milk #shop", nil, 100))
+	assert.True(t, msg.EditText("buy bread #food", nil, 100))
+	assert.Equal(t, "buy bread #food", msg.Data["text"])
+	assert.Equal(t, []string{"food", "home"}, msg.Tags)
+	assert.Equal(t, int64(100), msg.UpdatedAt())
+	edits := msg.Data[EditsFieldName].([]interface{})
+	require.Equal(t, 1, len(edits))
+	assert.Equal(t, "buy milk #shop", edits[0].(map[string]interface{})["text"])
+	for i := 0; i < MaxEditHistory+5; i++ {
+		msg.EditText(fmt.Sprintf("text %d", i), nil, int64(200+i))
+	}
+	edits = msg.Data[EditsFieldName].([]interface{})
+	assert.Equal(t, MaxEditHistory, len(edits))
+}
+
+const TGEditedMsgTmpl = `{"update_id": 45554195,
+  "edited_message": {
+    "message_id": %[2]d,
+    "from": {"id": %[1]d, "is_bot": false, "first_name": "D"},
+    "chat": {"id": %[1]d, "first_name": "D", "type": "private"},
+    "date": 1571403733,
+    "edit_date": 1571403800,
+    "text": "%[3]s"}
+}`
+
+func TestScenarioTGEdited(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	_, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGTextMsgTmpl, tgid, "by milk"))
+	require.Nil(t, err)
+	resp, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGEditedMsgTmpl, tgid, 181, "buy milk"))
+	require.Nil(t, err)
+	assert.Equal(t, "", resp)
+	msg := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 181, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	assert.Equal(t, "buy milk", msg.Data["text"])
+	assert.Equal(t, int64(1571403800), msg.UpdatedAt())
+	assert.Equal(t, int64(1), msg.Version)
+	edits := msg.Data[EditsFieldName].([]interface{})
+	require.Equal(t, 1, len(edits))
+	assert.Equal(t, "by milk", edits[0].(map[string]interface{})["text"])
+
+	// edit of a message that was never stored is ignored
+	_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGEditedMsgTmpl, tgid, 10, "whatever"))
+	assert.Nil(t, err)
+	// the same text again changes nothing
+	_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGEditedMsgTmpl, tgid, 181, "buy milk"))
+	require.Nil(t, err)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, int64(1), msg.Version)
+	assert.False(t, strings.Contains(fmt.Sprint(msg.Data[EditsFieldName]), "buy milk"))
+}
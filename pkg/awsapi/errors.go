@@ -0,0 +1,126 @@
+package awsapi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	CONDITION_FAILED     = "ConditionFailed"
+	THROTTLED            = "Throttled"
+	TRANSACTION_CANCELED = "TransactionCanceled"
+	VERSION_CONFLICT     = "VersionConflict"
+)
+
+// Sentinels to check storage errors with errors.Is
+var (
+	ErrNotFound            = errors.New(NO_SUCH_ITEM)
+	ErrAlreadyExists       = errors.New(ALREADY_EXISTS)
+	ErrConditionFailed     = errors.New(CONDITION_FAILED)
+	ErrThrottled           = errors.New(THROTTLED)
+	ErrTransactionCanceled = errors.New(TRANSACTION_CANCELED)
+	ErrVersionConflict     = errors.New(VERSION_CONFLICT)
+)
+
+// Error returned by storage operations, Kind is one of Err* sentinels
+// and Cause is the original AWS error if any.
+// ErrAlreadyExists and ErrVersionConflict match ErrConditionFailed too,
+// since that is how DynamoDB reports them.
+type StorageError struct {
+	Kind  error
+	Cause error
+}
+
+func (e *StorageError) Error() string {
+	return e.Kind.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *StorageError) Is(target error) bool {
+	if target == e.Kind {
+		return true
+	}
+	return target == ErrConditionFailed &&
+		(e.Kind == ErrAlreadyExists || e.Kind == ErrVersionConflict)
+}
+
+// Returned when DynamoDB cancels a transaction, Reasons has
+// cancellation code for each item of transaction in the same order,
+// "None" for items that were fine.
+type TransactionCanceledError struct {
+	Reasons []string
+	Cause   error
+}
+
+func (e *TransactionCanceledError) Error() string {
+	return fmt.Sprintf("%s [%s]", TRANSACTION_CANCELED, strings.Join(e.Reasons, ", "))
+}
+
+func (e *TransactionCanceledError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *TransactionCanceledError) Is(target error) bool {
+	return target == ErrTransactionCanceled
+}
+
+// Returns true if item with given index caused cancellation
+func (e *TransactionCanceledError) Failed(i int) bool {
+	return i < len(e.Reasons) && e.Reasons[i] != "None"
+}
+
+func newNotFoundErr() error {
+	return &StorageError{Kind: ErrNotFound}
+}
+
+// Turns failed condition of versioned write into ErrVersionConflict
+func versionConflictErr(err error) error {
+	if errors.Is(err, ErrConditionFailed) {
+		return &StorageError{Kind: ErrVersionConflict, Cause: errors.Unwrap(err)}
+	}
+	return err
+}
+
+// Converts AWS error to one of errors above, other errors are returned as is
+func wrapAWSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var tce *dynamodb.TransactionCanceledException
+	if errors.As(err, &tce) {
+		tcErr := &TransactionCanceledError{Cause: err}
+		for _, r := range tce.CancellationReasons {
+			code := "None"
+			if r != nil && r.Code != nil {
+				code = *r.Code
+			}
+			tcErr.Reasons = append(tcErr.Reasons, code)
+		}
+		return tcErr
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return err
+	}
+	switch aerr.Code() {
+	case request.CanceledErrorCode:
+		// keeps ctx error reachable for errors.Is
+		if aerr.OrigErr() != nil {
+			return fmt.Errorf("%s: %w", aerr.Message(), aerr.OrigErr())
+		}
+	case dynamodb.ErrCodeConditionalCheckFailedException:
+		return &StorageError{Kind: ErrConditionFailed, Cause: err}
+	case dynamodb.ErrCodeProvisionedThroughputExceededException,
+		dynamodb.ErrCodeRequestLimitExceeded, "ThrottlingException":
+		return &StorageError{Kind: ErrThrottled, Cause: err}
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapAWSError(t *testing.T) {
+	cond := awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "failed", nil)
+	err := wrapAWSError(cond)
+	assert.True(t, errors.Is(err, ErrConditionFailed))
+	assert.False(t, errors.Is(err, ErrAlreadyExists))
+	var aerr awserr.Error
+	if assert.True(t, errors.As(err, &aerr)) {
+		assert.Equal(t, dynamodb.ErrCodeConditionalCheckFailedException, aerr.Code())
+	}
+
+	err = wrapAWSError(awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil))
+	assert.True(t, errors.Is(err, ErrThrottled))
+
+	err = wrapAWSError(awserr.New(request.CanceledErrorCode, "canceled", context.DeadlineExceeded))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	other := errors.New("foo")
+	assert.Equal(t, other, wrapAWSError(other))
+	assert.Nil(t, wrapAWSError(nil))
+
+	exists := &StorageError{Kind: ErrAlreadyExists, Cause: cond}
+	assert.True(t, errors.Is(exists, ErrAlreadyExists))
+	assert.True(t, errors.Is(exists, ErrConditionFailed))
+	assert.Equal(t, ALREADY_EXISTS, exists.Error())
+}
+
+func TestStorageErrors(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	item, _ := NewTestItem("foo", "bar")
+	err := table.FetchItem(item.PK, item)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Nil(t, table.StoreItem(item, UniqueOp()))
+	err = table.StoreItem(item, UniqueOp())
+	assert.True(t, errors.Is(err, ErrAlreadyExists))
+	err = table.StoreInTransUniq(item)
+	var tcErr *TransactionCanceledError
+	if assert.True(t, errors.As(err, &tcErr)) {
+		assert.Equal(t, []string{"ConditionalCheckFailed"}, tcErr.Reasons)
+	}
+}
@@ -0,0 +1,364 @@
+package awsapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const MALFORMED_EXPORT_LINE = "Malformed export line"
+
+// How many items import sends with one batchWrite call
+var ImportBatchSize = 100
+
+type ExportOpts struct {
+	Segments int64    // parallel scan segments, 1 if not set
+	Prefixes []string // export only items which PK starts with one of them
+}
+
+type ImportOpts struct {
+	Prefixes []string // import only items which PK starts with one of them
+	// PK prefix replacements, the longest matching prefix is replaced,
+	// so {"user#": "user#dev"} turns user#123 into user#dev123.
+	// Keys are made of PKs of other items, like perm#user#1#fldr#0 or
+	// tok#user#1#milk, so every segment of PK and SK is changed, and so
+	// are attributes in keyRefAttrs
+	RewritePK map[string]string
+}
+
+// String attributes keeping keys of other items, by PK prefix of the
+// item. Logins, indexes and permissions lead to the old items if they
+// are not rewritten along with PK
+var keyRefAttrs = map[string][]string{
+	// Msg, MsgTokens, MsgTags
+	MsgKeyPrefix: {"UMS", "OMS", "TSK", "RUMS", "ASG", "A", "Ch", "PRNT", "THR", "U"},
+	// User bots and Subscription
+	UserKeyPrefix:         {"B", "O", "U"},
+	TGAccKeyPrefix:        {"O"},
+	EmailKeyPrefix:        {"O"},
+	TelKeyPrefix:          {"O"},
+	InviteKeyPrefix:       {"B", "U"},
+	TokenKeyPrefix:        {"U"},
+	OrgKeyPrefix:          {"ADM"},
+	SearchTokenKeyPrefix:  {"U"},
+	TagKeyPrefix:          {"U"},
+	ScheduleKeyPrefix:     {"U", "Ch"},
+	TGMsgKeyPrefix:        {"M"},
+	TGUpdateKeyPrefix:     {"M"},
+	AlbumKeyPrefix:        {"M"},
+	ThreadKeyPrefix:       {"M"},
+	SubscriptionKeyPrefix: {"O", "U"},
+}
+
+// Writes every item as one line of DynamoDB JSON, each value is
+// an object with its type as the only key, like {"PK":{"S":"user#1"}}.
+// Returns how many items were written
+func (t *DTable) Export(ctx context.Context, w io.Writer, opts ExportOpts) (int, error) {
+	segments := opts.Segments
+	if segments < 1 {
+		segments = 1
+	}
+	params := ScanParams{Values: make(map[string]interface{})}
+	var conds []string
+	for i, prefix := range opts.Prefixes {
+		name := fmt.Sprintf(":p%d", i)
+		conds = append(conds, fmt.Sprintf("begins_with(PK, %s)", name))
+		params.Values[name] = prefix
+	}
+	params.Filter = strings.Join(conds, " OR ")
+	if segments > 1 {
+		params.TotalSegments = segments
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		count    int
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	for seg := int64(0); seg < segments; seg++ {
+		p := params
+		p.Segment = seg
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := t.ScanPagesWithContext(ctx, p, func(items []map[string]*dynamodb.AttributeValue) error {
+				buf := &bytes.Buffer{}
+				for _, item := range items {
+					line, err := json.Marshal(typedItem(item))
+					if err != nil {
+						return err
+					}
+					buf.Write(line)
+					buf.WriteByte('\n')
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if _, err := w.Write(buf.Bytes()); err != nil {
+					return err
+				}
+				count += len(items)
+				return nil
+			})
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return count, firstErr
+}
+
+// Reads lines written by Export and stores items, existing items
+// with the same keys are overwritten. Returns how many items were stored
+func (t *DTable) Import(ctx context.Context, r io.Reader, opts ImportOpts) (int, error) {
+	reader := bufio.NewReader(r)
+	var reqs []*dynamodb.WriteRequest
+	count := 0
+	flush := func() error {
+		if len(reqs) == 0 {
+			return nil
+		}
+		errs := make([]error, len(reqs))
+		t.batchWrite(ctx, reqs, errs)
+		reqs = nil
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		count += len(errs)
+		return nil
+	}
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			item, perr := parseExportLine(line)
+			if perr != nil {
+				return count, fmt.Errorf("Line %d: %w", lineNo, perr)
+			}
+			if pk := *item["PK"].S; hasPrefix(pk, opts.Prefixes) {
+				rewriteItem(item, opts.RewritePK)
+				reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+			}
+		}
+		if len(reqs) >= ImportBatchSize || err == io.EOF {
+			if ferr := flush(); ferr != nil {
+				return count, ferr
+			}
+		}
+		if err == io.EOF {
+			return count, nil
+		}
+	}
+}
+
+func parseExportLine(line []byte) (map[string]*dynamodb.AttributeValue, error) {
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, err
+	}
+	item := make(map[string]*dynamodb.AttributeValue)
+	for name, v := range raw {
+		av, err := untypedValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("Attribute %s: %w", name, err)
+		}
+		item[name] = av
+	}
+	if _, err := itemKeyOf(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func hasPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrites keys of the item and attributes keeping keys of other items
+func rewriteItem(item map[string]*dynamodb.AttributeValue, rewrite map[string]string) {
+	if len(rewrite) == 0 {
+		return
+	}
+	pk := *item["PK"].S
+	var attrs []string
+	for prefix, names := range keyRefAttrs {
+		if strings.HasPrefix(pk, prefix) {
+			attrs = append(attrs, names...)
+		}
+	}
+	for _, name := range append([]string{"PK", "SK"}, attrs...) {
+		av := item[name]
+		if av == nil {
+			continue
+		}
+		if av.S != nil {
+			av.S = aws.String(rewriteKey(*av.S, rewrite))
+		}
+		for i, s := range av.SS {
+			av.SS[i] = aws.String(rewriteKey(*s, rewrite))
+		}
+		for _, v := range av.L {
+			if v.S != nil {
+				v.S = aws.String(rewriteKey(*v.S, rewrite))
+			}
+		}
+	}
+}
+
+// Replaces prefixes at the start of every segment of the key, the
+// longest matching one wins
+func rewriteKey(s string, rewrite map[string]string) string {
+	var from []string
+	for k := range rewrite {
+		from = append(from, k)
+	}
+	sort.Slice(from, func(i, j int) bool { return len(from[i]) > len(from[j]) })
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		matched := false
+		if i == 0 || s[i-1] == '#' {
+			for _, k := range from {
+				if strings.HasPrefix(s[i:], k) {
+					b.WriteString(rewrite[k])
+					i += len(k)
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			b.WriteByte(s[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+func typedItem(item map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	out := make(map[string]interface{}, len(item))
+	for name, av := range item {
+		out[name] = typedValue(av)
+	}
+	return out
+}
+
+// []byte values are base64 encoded by encoding/json
+func typedValue(av *dynamodb.AttributeValue) map[string]interface{} {
+	switch {
+	case av.S != nil:
+		return map[string]interface{}{"S": *av.S}
+	case av.N != nil:
+		return map[string]interface{}{"N": *av.N}
+	case av.B != nil:
+		return map[string]interface{}{"B": av.B}
+	case av.BOOL != nil:
+		return map[string]interface{}{"BOOL": *av.BOOL}
+	case av.SS != nil:
+		return map[string]interface{}{"SS": aws.StringValueSlice(av.SS)}
+	case av.NS != nil:
+		return map[string]interface{}{"NS": aws.StringValueSlice(av.NS)}
+	case av.BS != nil:
+		return map[string]interface{}{"BS": av.BS}
+	case av.L != nil:
+		l := make([]interface{}, len(av.L))
+		for i, v := range av.L {
+			l[i] = typedValue(v)
+		}
+		return map[string]interface{}{"L": l}
+	case av.M != nil:
+		return map[string]interface{}{"M": typedItem(av.M)}
+	}
+	return map[string]interface{}{"NULL": true}
+}
+
+func untypedValue(raw json.RawMessage) (*dynamodb.AttributeValue, error) {
+	typed := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		return nil, errors.New(MALFORMED_EXPORT_LINE)
+	}
+	av := &dynamodb.AttributeValue{}
+	var err error
+	for kind, v := range typed {
+		switch kind {
+		case "S":
+			err = json.Unmarshal(v, &av.S)
+		case "N":
+			err = json.Unmarshal(v, &av.N)
+		case "B":
+			err = json.Unmarshal(v, &av.B)
+		case "BOOL":
+			err = json.Unmarshal(v, &av.BOOL)
+		case "NULL":
+			err = json.Unmarshal(v, &av.NULL)
+		case "SS":
+			err = json.Unmarshal(v, &av.SS)
+		case "NS":
+			err = json.Unmarshal(v, &av.NS)
+		case "BS":
+			err = json.Unmarshal(v, &av.BS)
+		case "L":
+			var l []json.RawMessage
+			if err = json.Unmarshal(v, &l); err != nil {
+				break
+			}
+			av.L = make([]*dynamodb.AttributeValue, len(l))
+			for i, lv := range l {
+				if av.L[i], err = untypedValue(lv); err != nil {
+					break
+				}
+			}
+		case "M":
+			var m map[string]json.RawMessage
+			if err = json.Unmarshal(v, &m); err != nil {
+				break
+			}
+			av.M = make(map[string]*dynamodb.AttributeValue, len(m))
+			for name, mv := range m {
+				if av.M[name], err = untypedValue(mv); err != nil {
+					break
+				}
+			}
+		default:
+			err = errors.New(MALFORMED_EXPORT_LINE)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return av, nil
+}
@@ -0,0 +1,158 @@
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src, _ := NewMemDTable("MainTest")
+	src.Storage.(*MemStorage).MaxPageItems = 2
+	user, _ := NewUser("user1")
+	require.Nil(t, src.StoreNewUser(user))
+	msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind)
+	msg.Data["text"] = "foo"
+	require.Nil(t, src.StoreItem(msg))
+	for _, id := range []string{"foo1", "foo2", "foo3"} {
+		item, _ := NewTestItem(id, "")
+		require.Nil(t, src.StoreItem(item))
+	}
+
+	out := &bytes.Buffer{}
+	count, err := src.Export(ctx, out, ExportOpts{Segments: 3, Prefixes: []string{UserKeyPrefix, MsgKeyPrefix}})
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, count, len(lines))
+	assert.NotContains(t, out.String(), "foo1")
+	assert.Contains(t, out.String(), `"PK":{"S":"`+msg.PK+`"}`)
+
+	dst, _ := NewMemDTable("MainTest")
+	imported, err := dst.Import(ctx, bytes.NewReader(out.Bytes()), ImportOpts{
+		Prefixes:  []string{MsgKeyPrefix},
+		RewritePK: map[string]string{MsgKeyPrefix: MsgKeyPrefix + "dev"}})
+	require.Nil(t, err)
+	assert.Equal(t, 1, imported)
+	copied := &Msg{}
+	require.Nil(t, dst.FetchItem(MsgKeyPrefix+"dev"+strings.TrimPrefix(msg.PK, MsgKeyPrefix), copied))
+	assert.Equal(t, "foo", copied.Data["text"])
+	assert.Equal(t, msg.UMS, copied.UMS)
+	assert.NotNil(t, dst.FetchItem(user.PK, &User{}))
+
+	dst, _ = NewMemDTable("MainTest")
+	imported, err = dst.Import(ctx, bytes.NewReader(out.Bytes()), ImportOpts{})
+	require.Nil(t, err)
+	assert.Equal(t, count, imported)
+	fetched := &User{}
+	require.Nil(t, dst.FetchItem(user.PK, fetched))
+	assert.Equal(t, user.Title, fetched.Title)
+
+	// Msgs follow their User, so they are listed in its folders
+	dst, _ = NewMemDTable("MainTest")
+	_, err = dst.Import(ctx, bytes.NewReader(out.Bytes()), ImportOpts{
+		RewritePK: map[string]string{UserKeyPrefix: UserKeyPrefix + "dev"}})
+	require.Nil(t, err)
+	devPK := UserKeyPrefix + "dev" + strings.TrimPrefix(user.PK, UserKeyPrefix)
+	require.Nil(t, dst.FetchItem(msg.PK, copied))
+	assert.Equal(t, UMSField{PK: devPK, Status: msg.UMS.Status}, copied.UMS)
+	assert.Equal(t, devPK, copied.AuthorPK)
+	assert.Equal(t, "bot1", copied.ChannelPK)
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchByUMS(dst, devPK, copied.UMS.String(), 0, msg.CreatedAt+1))
+	assert.Equal(t, []string{msg.PK}, lm.GetPKs())
+}
+
+func TestExportTypes(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"PK":   {S: aws.String("foo")},
+		"SK":   {S: aws.String("bar")},
+		"N":    {N: aws.String("42")},
+		"B":    {B: []byte{0, 1, 2}},
+		"BOOL": {BOOL: aws.Bool(false)},
+		"NULL": {NULL: aws.Bool(true)},
+		"SS":   {SS: aws.StringSlice([]string{"a", "b"})},
+		"L":    {L: []*dynamodb.AttributeValue{{S: aws.String("x")}, {N: aws.String("1")}}},
+		"M":    {M: map[string]*dynamodb.AttributeValue{"k": {BOOL: aws.Bool(true)}}},
+		"E":    {L: []*dynamodb.AttributeValue{}},
+	}
+	out := &bytes.Buffer{}
+	src, _ := NewMemDTable("MainTest")
+	_, err := src.BatchWriteWithContext(context.Background(),
+		[]*dynamodb.WriteRequest{{PutRequest: &dynamodb.PutRequest{Item: item}}})
+	require.Nil(t, err)
+	_, err = src.Export(context.Background(), out, ExportOpts{})
+	require.Nil(t, err)
+	parsed, err := parseExportLine(out.Bytes())
+	require.Nil(t, err)
+	assert.Equal(t, item, parsed)
+
+	_, err = parseExportLine([]byte(`{"PK":{"S":"foo","N":"1"},"SK":{"S":"bar"}}`))
+	assert.NotNil(t, err)
+	_, err = parseExportLine([]byte(`{"PK":{"S":"foo"}}`))
+	assert.NotNil(t, err)
+}
+
+func TestImportRewriteUser(t *testing.T) {
+	ctx := context.Background()
+	src, _ := NewMemDTable("MainTest")
+	owner, _ := NewUser("owner")
+	user, _ := NewUser("user1")
+	user.Email = "user1@example.com"
+	require.Nil(t, src.StoreNewUser(owner))
+	require.Nil(t, src.StoreNewUser(user))
+	require.Nil(t, user.EnsureDefaultFolders(src))
+	tgacc, _ := NewTGAcc(42, user.PK)
+	shared, _ := NewFolder(owner.PK, "Shared", 5, FolderStreamKind)
+	perm, _ := NewUserPerm(user.PK, shared, "tr")
+	msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind, DataOp(map[string]interface{}{"text": "buy milk"}))
+	msg.Tags = []string{"shop"}
+	for _, err := range src.StoreItems(tgacc, shared, perm, msg) {
+		require.Nil(t, err)
+	}
+	require.Nil(t, src.IndexMsgWithContext(ctx, msg))
+	require.Nil(t, src.IndexMsgTagsWithContext(ctx, msg))
+	out := &bytes.Buffer{}
+	_, err := src.Export(ctx, out, ExportOpts{})
+	require.Nil(t, err)
+
+	dst, _ := NewMemDTable("MainTest")
+	_, err = dst.Import(ctx, bytes.NewReader(out.Bytes()), ImportOpts{
+		RewritePK: map[string]string{UserKeyPrefix: UserKeyPrefix + "dev"}})
+	require.Nil(t, err)
+	dev := func(pk string) string {
+		return UserKeyPrefix + "dev" + strings.TrimPrefix(pk, UserKeyPrefix)
+	}
+	require.Nil(t, dst.FetchTGAcc(42, tgacc))
+	assert.Equal(t, dev(user.PK), tgacc.OwnerPK)
+	email := &Email{}
+	require.Nil(t, dst.FetchItem(EmailKeyPrefix+"user1@example.com", email))
+	assert.Equal(t, dev(user.PK), email.OwnerPK)
+	results, err := dst.Search(dev(user.PK), "milk", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, msg.PK, results[0].Msg.PK)
+	tags, err := dst.FetchTags(dev(user.PK))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tags))
+	assert.Equal(t, "shop", tags[0].Tag())
+	ok, err := (&User{PK: dev(user.PK)}).HasPerm(dst, dev(owner.PK), shared.SK, "tr")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	// nothing is left pointing to the old users
+	assert.NotContains(t, exportString(t, dst), user.PK)
+	assert.NotContains(t, exportString(t, dst), owner.PK)
+}
+
+func exportString(t *testing.T, table *DTable) string {
+	out := &bytes.Buffer{}
+	_, err := table.Export(context.Background(), out, ExportOpts{})
+	require.Nil(t, err)
+	return out.String()
+}
@@ -14,6 +14,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	apimngmt "github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
@@ -43,7 +45,7 @@ func HandleWSAuthReq(table *DTable, params map[string]string, arn string) (
 	pk := fmt.Sprintf("%s%s", TokenKeyPrefix, tokenID)
 	err := table.FetchItem(pk, token)
 	if err != nil {
-		if err.Error() == NO_SUCH_ITEM {
+		if errors.Is(err, ErrNotFound) {
 			resp.PolicyDocument = getAuthPolicy("Deny", arn)
 			return resp, nil
 		}
@@ -73,20 +75,21 @@ func storeWSConn(table *DTable, domain, stage, connId, userPK string) error {
 //Clears WSConn and Subscriptions related to that connection
 // Don't worry too much about errors since TTL is there, but anyway
 func clearWSConn(table *DTable, connId, userPK string) error {
-	var err1, err2, err3, err4 error
-	err1 = table.DeleteSubItem(userPK, fmt.Sprintf("%s%s", WSConnKeyPrefix, connId))
+	connKey := ItemKey{PK: userPK, SK: fmt.Sprintf("%s%s", WSConnKeyPrefix, connId)}
 	sA := &Subscription{}
-	err2 = table.FetchSubItem(userPK, fmt.Sprintf("%s%s", SubscriptionKeyPrefix, connId), sA)
-	if err2 == nil {
-		err3 = table.DeleteSubItem(sA.UMS, sA.SK) //deletes part B
-		err4 = table.DeleteSubItem(sA.PK, sA.SK)
+	err := table.FetchSubItem(userPK, fmt.Sprintf("%s%s", SubscriptionKeyPrefix, connId), sA)
+	if errors.Is(err, ErrNotFound) {
+		return table.DeleteSubItem(connKey.PK, connKey.SK)
 	}
-	if err2 != nil && err2.Error() == NO_SUCH_ITEM {
-		return err1
+	errs := []error{err}
+	if err == nil {
+		//deletes part B as well
+		errs = table.BatchDelete(connKey, ItemKey{PK: sA.UMS, SK: sA.SK}, ItemKey{PK: sA.PK, SK: sA.SK})
+	} else {
+		errs = append(errs, table.DeleteSubItem(connKey.PK, connKey.SK))
 	}
 
 	var out []string
-	errs := []error{err1, err2, err3, err4}
 	for _, e := range errs {
 		if e != nil {
 			out = append(out, e.Error())
@@ -131,6 +134,7 @@ type CmdResp struct {
 	Status string `json:"status"`
 	SecNum int    `json:"number,omitempty"`
 	Error  string `json:"error,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
 }
 
 type UserCmd interface {
@@ -151,20 +155,26 @@ func (cmd *PingCmd) Perform(
 	})
 }
 
+// Limit and Cursor are optional, if Limit is set "done" response
+// has cursor to fetch the next page with
 type MsgFetchByDays struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
-	Days int64  `json:"days"`
-	UMS  string `json:"ums"`
-	Desc bool   `json:"desc"`
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Days   int64  `json:"days"`
+	UMS    string `json:"ums"`
+	Desc   bool   `json:"desc"`
+	Limit  int64  `json:"limit"`
+	Cursor string `json:"cursor"`
 }
 
 type MsgFetchByTimeStamp struct {
-	Id    string `json:"id"`
-	Name  string `json:"name"`
-	Start int64  `json:"start"`
-	End   int64  `json:"end"`
-	UMS   string `json:"ums"`
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	UMS    string `json:"ums"`
+	Limit  int64  `json:"limit"`
+	Cursor string `json:"cursor"`
 }
 
 //It shows PK, CreatedAt, Status and Kind
@@ -175,6 +185,20 @@ func MsgIndexView(msg *Msg) ([]byte, error) {
 	out["owner"] = msg.UMS.PK
 	out["status"] = msg.UMS.Status
 	out["kind"] = msg.Kind
+	if msg.OMS != "" {
+		out["org"] = msg.OMS
+	}
+	if msg.DueAt != 0 {
+		out["due"] = msg.DueAt
+	}
+	if msg.TaskState != "" {
+		out["task"] = msg.TaskState
+		out["assignee"] = msg.Assignee
+	}
+	if msg.ParentPK != "" {
+		out["parent"] = msg.ParentPK
+		out["thread"] = msg.ThreadPK
+	}
 	out["name"] = "msg_index"
 	return json.Marshal(out)
 }
@@ -202,6 +226,19 @@ type MsgView struct {
 	Kind      int64                  `json:"kind"`
 	Name      string                 `json:"name"`
 	Files     map[string]interface{} `json:"files"`
+	Tags      []string               `json:"tags"`
+	Parent    string                 `json:"parent,omitempty"`
+	Thread    string                 `json:"thread,omitempty"`
+	Due       int64                  `json:"due,omitempty"`
+	Task      string                 `json:"task,omitempty"`
+	Assignee  string                 `json:"assignee,omitempty"`
+	Completed int64                  `json:"completed,omitempty"`
+	Edits     []interface{}          `json:"edits,omitempty"`
+	FileName  string                 `json:"file_name,omitempty"`
+	Location  interface{}            `json:"location,omitempty"`
+	Contact   interface{}            `json:"contact,omitempty"`
+	// files of album items in album order
+	Album []map[string]interface{} `json:"album,omitempty"`
 }
 
 func NewMsgView(msg *Msg, files []*MsgFile) (*MsgView, error) {
@@ -214,25 +251,66 @@ func NewMsgView(msg *Msg, files []*MsgFile) (*MsgView, error) {
 	view.Author = msg.AuthorPK
 	view.Files = make(map[string]interface{})
 	view.UpdatedAt = msg.UpdatedAt()
+	view.Tags = msg.Tags
+	view.Parent = msg.ParentPK
+	view.Thread = msg.ThreadPK
+	view.Due = msg.DueAt
+	view.Task = msg.TaskState
+	view.Assignee = msg.Assignee
+	view.Completed = msg.CompletedAt
+	if view.Tags == nil {
+		view.Tags = []string{}
+	}
 	if msg.Data != nil {
 		view.Text, _ = msg.Data["text"].(string)
 		if view.Text == "" {
 			view.Text, _ = msg.Data[RecognizedTextFieldName].(string)
 		}
+		view.Edits, _ = msg.Data[EditsFieldName].([]interface{})
+		view.FileName, _ = msg.Data["file_name"].(string)
+		view.Location = msg.Data["location"]
+		view.Contact = msg.Data["contact"]
 	}
 	for _, f := range files {
-		fdata := make(map[string]interface{})
-		urlStr, err := preSignUrl(f.Bucket, f.Key)
-		if err == nil {
-			fdata["url"] = urlStr
-		} else {
+		if f.Position > 0 {
+			continue
+		}
+		fdata, err := msgFileView(f)
+		if err != nil {
 			return nil, err
 		}
 		view.Files[f.FileKind] = fdata
 	}
+	for _, item := range albumFiles(files) {
+		idata := make(map[string]interface{})
+		for _, f := range item {
+			fdata, err := msgFileView(f)
+			if err != nil {
+				return nil, err
+			}
+			idata[f.FileKind] = fdata
+		}
+		view.Album = append(view.Album, idata)
+	}
 	return view, nil
 }
 
+// Url of the file along with size, duration, dimensions
+// and file name if the file has them
+func msgFileView(f *MsgFile) (map[string]interface{}, error) {
+	fdata := make(map[string]interface{})
+	for k, v := range f.Data {
+		fdata[k] = v
+	}
+	fdata["mime"] = f.Mime
+	urlStr, err := preSignUrl(f.Bucket, f.Key)
+	if err != nil {
+		return nil, err
+	}
+	fdata["url"] = urlStr
+	return fdata, nil
+}
+
 func (cmd *MsgFetchByTimeStamp) Perform(
 	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext, out chan<- []byte, done chan<- error) {
 	userPK, err := extractUserPK(reqCtx)
@@ -244,7 +322,8 @@ func (cmd *MsgFetchByTimeStamp) Perform(
 	if !strings.HasPrefix(cmd.UMS, userPK) {
 	}
 	listMsg := NewListMsg()
-	err = listMsg.FetchByUMS(table, userPK, cmd.UMS, cmd.Start, cmd.End)
+	err = listMsg.FetchByUMSPageWithContext(ctx, table, userPK, cmd.UMS, cmd.Start, cmd.End,
+		PageOpts{Limit: cmd.Limit, Cursor: cmd.Cursor})
 	if err != nil {
 		done <- err
 		return
@@ -271,6 +350,7 @@ func (cmd *MsgFetchByTimeStamp) Perform(
 		Id:     cmd.Id,
 		Name:   cmd.Name,
 		Status: "done",
+		Cursor: listMsg.Cursor(),
 	})
 }
 
@@ -284,7 +364,8 @@ func (cmd *MsgFetchByDays) Perform(
 	start := time.Now().Unix() - cmd.Days*24*60*60
 	end := time.Now().Unix() + 1
 	listMsg := NewListMsg()
-	err = listMsg.FetchByUMS(table, userPK, cmd.UMS, start, end)
+	err = listMsg.FetchByUMSPageWithContext(ctx, table, userPK, cmd.UMS, start, end,
+		PageOpts{Limit: cmd.Limit, Cursor: cmd.Cursor, Desc: cmd.Desc})
 	var sortMeth func() []*Msg
 	if cmd.Desc {
 		sortMeth = listMsg.Desc
@@ -317,6 +398,500 @@ func (cmd *MsgFetchByDays) Perform(
 		Id:     cmd.Id,
 		Name:   cmd.Name,
 		Status: "done",
+		Cursor: listMsg.Cursor(),
+	})
+}
+
+// Lists Msgs of Org stream created in between Start and End,
+// only members of Org can do that
+type OrgMsgFetchCmd struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Org    string `json:"org"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	Desc   bool   `json:"desc"`
+	Limit  int64  `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+func (cmd *OrgMsgFetchCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext, out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	member, err := (&User{PK: userPK}).IsOrgMemberWithContext(ctx, table, cmd.Org)
+	if err != nil {
+		done <- err
+		return
+	}
+	if !member {
+		done <- sendWithContext(ctx, out, &CmdResp{
+			Id:     cmd.Id,
+			Status: "error",
+			Name:   cmd.Name,
+			Error:  "no permissions",
+		})
+		return
+	}
+	listMsg := NewListMsg()
+	err = listMsg.FetchByOMSPageWithContext(ctx, table, cmd.Org, cmd.Start, cmd.End,
+		PageOpts{Limit: cmd.Limit, Cursor: cmd.Cursor, Desc: cmd.Desc})
+	if err != nil {
+		done <- err
+		return
+	}
+	sortMeth := listMsg.Asc
+	if cmd.Desc {
+		sortMeth = listMsg.Desc
+	}
+	_ = sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "started",
+	})
+	for _, m := range sortMeth() {
+		b, err := MsgIndexView(m)
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				fmt.Println("ERROR", ctx.Err())
+				return
+			case out <- b:
+			}
+		} else {
+			fmt.Println("ERROR", err.Error())
+		}
+	}
+	done <- sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "done",
+		Cursor: listMsg.Cursor(),
+	})
+}
+
+// Full text search over Msgs the user can read, results are sent
+// as msg_index views ordered by relevance
+type SearchCmd struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+}
+
+// How many results search returns if limit is not given
+const defaultSearchLimit = 50
+
+func (cmd *SearchCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext, out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	limit := cmd.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	results, err := table.SearchWithContext(ctx, userPK, cmd.Query, limit)
+	if err != nil {
+		done <- err
+		return
+	}
+	_ = sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "started",
+	})
+	for _, r := range results {
+		b, err := MsgIndexView(r.Msg)
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				fmt.Println("ERROR", ctx.Err())
+				return
+			case out <- b:
+			}
+		} else {
+			fmt.Println("ERROR", err.Error())
+		}
+	}
+	done <- sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "done",
+	})
+}
+
+// Adds tag to Msg or removes it, depending on the name of command,
+// "tagadd" or "tagremove"
+type MsgTagCmd struct {
+	Id   string `json:"id"`
+	PK   string `json:"pk"`
+	Name string `json:"name"`
+	Tag  string `json:"tag"`
+}
+
+func (cmd *MsgTagCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	resp := struct {
+		PK      string   `json:"pk"`
+		Id      string   `json:"id"`
+		Name    string   `json:"name"`
+		Ok      bool     `json:"ok"`
+		Error   string   `json:"error"`
+		Tags    []string `json:"tags"`
+		Version int64    `json:"version"`
+	}{
+		PK:   cmd.PK,
+		Id:   cmd.Id,
+		Name: cmd.Name,
+		Ok:   true,
+	}
+	msg, err := table.UpdateMsgTagWithContext(ctx, cmd.PK, userPK, cmd.Tag, cmd.Name == "tagremove")
+	if err != nil {
+		resp.Ok = false
+		resp.Error = err.Error()
+	} else {
+		resp.Tags = msg.Tags
+		resp.Version = msg.Version
+	}
+	done <- sendWithContext(ctx, out, &resp)
+}
+
+// Lists tags of the user with number of Msgs for each
+type TagListCmd struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func (cmd *TagListCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	counts, err := table.FetchTagsWithContext(ctx, userPK)
+	if err != nil {
+		done <- err
+		return
+	}
+	type tagView struct {
+		Tag   string `json:"tag"`
+		Count int64  `json:"count"`
+	}
+	resp := struct {
+		Id   string    `json:"id"`
+		Name string    `json:"name"`
+		Tags []tagView `json:"tags"`
+	}{Id: cmd.Id, Name: cmd.Name, Tags: []tagView{}}
+	for _, c := range counts {
+		resp.Tags = append(resp.Tags, tagView{Tag: c.Tag(), Count: c.Count})
+	}
+	done <- sendWithContext(ctx, out, &resp)
+}
+
+// Lists Msgs of the user with the tag created in between Start and End
+type MsgFetchByTagCmd struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Tag    string `json:"tag"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	Desc   bool   `json:"desc"`
+	Limit  int64  `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+func (cmd *MsgFetchByTagCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	listMsg := NewListMsg()
+	err = listMsg.FetchByTagPageWithContext(ctx, table, userPK, NormalizeTag(cmd.Tag), cmd.Start, cmd.End,
+		PageOpts{Limit: cmd.Limit, Cursor: cmd.Cursor, Desc: cmd.Desc})
+	if err != nil {
+		done <- err
+		return
+	}
+	sortMeth := listMsg.Asc
+	if cmd.Desc {
+		sortMeth = listMsg.Desc
+	}
+	_ = sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "started",
+	})
+	for _, m := range sortMeth() {
+		b, err := MsgIndexView(m)
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				fmt.Println("ERROR", ctx.Err())
+				return
+			case out <- b:
+			}
+		} else {
+			fmt.Println("ERROR", err.Error())
+		}
+	}
+	done <- sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "done",
+		Cursor: listMsg.Cursor(),
+	})
+}
+
+// Lists Msgs of the thread the Msg given by PK belongs to, oldest first
+type ThreadFetchCmd struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	PK   string `json:"pk"`
+}
+
+func (cmd *ThreadFetchCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	msg := &Msg{}
+	err = table.FetchItemWithContext(ctx, cmd.PK, msg)
+	if err == nil && msg.UMS.PK != userPK {
+		err = errors.New("Permission denied")
+	}
+	var msgs []*Msg
+	if err == nil {
+		threadPK := msg.ThreadPK
+		if threadPK == "" {
+			threadPK = msg.PK
+		}
+		msgs, err = table.FetchThreadWithContext(ctx, threadPK)
+	}
+	if err != nil {
+		done <- sendWithContext(ctx, out, &CmdResp{
+			Id:     cmd.Id,
+			Name:   cmd.Name,
+			Status: "error",
+			Error:  err.Error(),
+		})
+		return
+	}
+	_ = sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "started",
+	})
+	for _, m := range msgs {
+		if m.UMS.PK != userPK {
+			continue
+		}
+		b, err := MsgIndexView(m)
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				fmt.Println("ERROR", ctx.Err())
+				return
+			case out <- b:
+			}
+		} else {
+			fmt.Println("ERROR", err.Error())
+		}
+	}
+	done <- sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "done",
+	})
+}
+
+// Sets when to remind about Msg, Due is unix time, At is text like
+// "tomorrow 9:00" used if Due is not set. If none is set reminder is cleared
+type MsgDueCmd struct {
+	Id   string `json:"id"`
+	PK   string `json:"pk"`
+	Name string `json:"name"`
+	Due  int64  `json:"due"`
+	At   string `json:"at"`
+}
+
+func (cmd *MsgDueCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	resp := struct {
+		PK      string `json:"pk"`
+		Id      string `json:"id"`
+		Name    string `json:"name"`
+		Ok      bool   `json:"ok"`
+		Error   string `json:"error"`
+		Due     int64  `json:"due"`
+		Version int64  `json:"version"`
+	}{
+		PK:   cmd.PK,
+		Id:   cmd.Id,
+		Name: cmd.Name,
+		Ok:   true,
+	}
+	due := cmd.Due
+	if due == 0 && cmd.At != "" {
+		// At is in the user's time zone
+		user := &User{}
+		if err = table.FetchItemWithContext(ctx, userPK, user); err == nil {
+			var dueTime time.Time
+			dueTime, err = ParseDueTime(cmd.At, time.Now().In(user.Location()))
+			due = dueTime.Unix()
+		}
+	}
+	var msg *Msg
+	if err == nil {
+		msg, err = table.SetMsgDueWithContext(ctx, cmd.PK, userPK, due)
+	}
+	if err != nil {
+		resp.Ok = false
+		resp.Error = err.Error()
+	} else {
+		resp.Due = msg.DueAt
+		resp.Version = msg.Version
+	}
+	done <- sendWithContext(ctx, out, &resp)
+}
+
+// Moves Msg to task State, "todo", "in_progress", "done" or empty to make
+// it a note again. Assignee is optional PK of User to assign the task to
+type TaskTransitionCmd struct {
+	Id       string `json:"id"`
+	PK       string `json:"pk"`
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Assignee string `json:"assignee"`
+}
+
+func (cmd *TaskTransitionCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	resp := struct {
+		PK        string `json:"pk"`
+		Id        string `json:"id"`
+		Name      string `json:"name"`
+		Ok        bool   `json:"ok"`
+		Error     string `json:"error"`
+		State     string `json:"state"`
+		Assignee  string `json:"assignee"`
+		Completed int64  `json:"completed"`
+		Version   int64  `json:"version"`
+	}{
+		PK:   cmd.PK,
+		Id:   cmd.Id,
+		Name: cmd.Name,
+		Ok:   true,
+	}
+	msg, err := table.TransitTaskWithContext(ctx, cmd.PK, userPK, cmd.State, cmd.Assignee)
+	if err != nil {
+		resp.Ok = false
+		resp.Error = err.Error()
+	} else {
+		resp.State = msg.TaskState
+		resp.Assignee = msg.Assignee
+		resp.Completed = msg.CompletedAt
+		resp.Version = msg.Version
+	}
+	done <- sendWithContext(ctx, out, &resp)
+}
+
+// Lists tasks assigned to the user in State, open ones if State is empty.
+// Limit and Cursor work only if State is set
+type TaskListCmd struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Desc   bool   `json:"desc"`
+	Limit  int64  `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+func (cmd *TaskListCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	listMsg := NewListMsg()
+	switch {
+	case cmd.State == "":
+		err = listMsg.FetchOpenTasksWithContext(ctx, table, userPK)
+	case IsTaskState(cmd.State):
+		err = listMsg.FetchByTaskStatePageWithContext(ctx, table, userPK, cmd.State,
+			PageOpts{Limit: cmd.Limit, Cursor: cmd.Cursor, Desc: cmd.Desc})
+	default:
+		err = errors.New(WRONG_TASK_STATE)
+	}
+	if err != nil {
+		done <- sendWithContext(ctx, out, &CmdResp{
+			Id:     cmd.Id,
+			Name:   cmd.Name,
+			Status: "error",
+			Error:  err.Error(),
+		})
+		return
+	}
+	sortMeth := listMsg.Asc
+	if cmd.Desc {
+		sortMeth = listMsg.Desc
+	}
+	_ = sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "started",
+	})
+	for _, m := range sortMeth() {
+		b, err := MsgIndexView(m)
+		if err == nil {
+			select {
+			case <-ctx.Done():
+				fmt.Println("ERROR", ctx.Err())
+				return
+			case out <- b:
+			}
+		} else {
+			fmt.Println("ERROR", err.Error())
+		}
+	}
+	done <- sendWithContext(ctx, out, &CmdResp{
+		Id:     cmd.Id,
+		Name:   cmd.Name,
+		Status: "done",
+		Cursor: listMsg.Cursor(),
 	})
 }
 
@@ -338,8 +913,7 @@ func (cmd *UnsubscribeCmd) Perform(
 	connId := reqCtx.ConnectionID
 	ums := fmt.Sprintf("%s#%d", cmd.UMSPK, cmd.MsgStatus)
 	sk := fmt.Sprintf("%s%s", SubscriptionKeyPrefix, connId)
-	_ = table.DeleteSubItem(userPK, sk)
-	_ = table.DeleteSubItem(ums, sk)
+	_ = table.BatchDeleteWithContext(ctx, ItemKey{PK: userPK, SK: sk}, ItemKey{PK: ums, SK: sk})
 
 	done <- sendWithContext(ctx, out, &CmdResp{
 		Id:     cmd.Id,
@@ -356,7 +930,7 @@ type FetchMsgCmd struct {
 func (cmd *FetchMsgCmd) Perform(ctx context.Context, table *DTable,
 	reqCtx events.APIGatewayWebsocketProxyRequestContext, out chan<- []byte, done chan<- error) {
 	msg := &Msg{}
-	err := table.FetchItem(cmd.PK, msg)
+	err := table.FetchItemWithContext(ctx, cmd.PK, msg)
 	if err != nil {
 		done <- sendWithContext(ctx, out, &CmdResp{
 			Id:     cmd.PK,
@@ -366,12 +940,13 @@ func (cmd *FetchMsgCmd) Perform(ctx context.Context, table *DTable,
 		return
 	}
 
-	// we would wait here 5 secs for TG pics and TG Voice till the files
-	// are redy
+	// we would wait here 5 secs for TG pics, TG Voice and other media
+	// till the files are redy
 	var files []*MsgFile
-	if msg.Kind == TGPhotoMsgKind || msg.Kind == TGVoiceMsgKind {
+	if msg.Kind == TGPhotoMsgKind || msg.Kind == TGVoiceMsgKind || isTGMediaKind(msg.Kind) ||
+		msg.Kind == TGAlbumMsgKind {
 		for i := 0; i < 5; i++ {
-			err = table.FetchItemsWithPrefix(cmd.PK, MsgFileKeyPrefix, &files)
+			err = table.FetchItemsWithPrefixWithContext(ctx, cmd.PK, MsgFileKeyPrefix, &files)
 			if err != nil {
 				done <- sendWithContext(ctx, out, &CmdResp{
 					Id:     cmd.PK,
@@ -388,6 +963,9 @@ func (cmd *FetchMsgCmd) Perform(ctx context.Context, table *DTable,
 			if msg.Kind == TGVoiceMsgKind && len(files) == 1 {
 				break
 			}
+			if (isTGMediaKind(msg.Kind) || msg.Kind == TGAlbumMsgKind) && len(files) > 0 {
+				break
+			}
 			time.Sleep(1 * time.Second)
 		}
 	}
@@ -412,8 +990,14 @@ type MsgUpdateCmd struct {
 	Name  string      `json:"name"`
 	Key   string      `json:"key"`
 	Value interface{} `json:"value"`
+	// Version of Msg the change is based on, if it is set and Msg
+	// was changed since then, update fails with VersionConflict error
+	Version *int64 `json:"version"`
 }
 
+// How many times msgupdate without version retries on concurrent change
+const msgUpdateAttempts = 3
+
 func (cmd *MsgUpdateCmd) Perform(
 	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
 	out chan<- []byte, done chan<- error) {
@@ -423,11 +1007,12 @@ func (cmd *MsgUpdateCmd) Perform(
 		return
 	}
 	resp := struct {
-		PK    string `json:"pk"`
-		Id    string `json:"id"`
-		Name  string `json:"name"`
-		Ok    bool   `json:"ok"`
-		Error string `json:"error"`
+		PK      string `json:"pk"`
+		Id      string `json:"id"`
+		Name    string `json:"name"`
+		Ok      bool   `json:"ok"`
+		Error   string `json:"error"`
+		Version int64  `json:"version"`
 	}{
 		PK:   cmd.PK,
 		Id:   cmd.Id,
@@ -436,7 +1021,7 @@ func (cmd *MsgUpdateCmd) Perform(
 	}
 
 	msg := &Msg{}
-	err = table.FetchItem(cmd.PK, msg)
+	err = table.FetchItemWithContext(ctx, cmd.PK, msg)
 	if err != nil {
 		resp.Ok = false
 		resp.Error = err.Error()
@@ -449,28 +1034,137 @@ func (cmd *MsgUpdateCmd) Perform(
 		done <- sendWithContext(ctx, out, &resp)
 		return
 	}
-	if cmd.Key == "ums" {
-		err = msg.UMS.Parse(cmd.Value.(string))
-		if err != nil {
+	if value, _ := cmd.Value.(string); cmd.Key == "oms" && value != "" {
+		member, err := (&User{PK: userPK}).IsOrgMemberWithContext(ctx, table, value)
+		if err != nil || !member {
 			resp.Ok = false
 			resp.Error = "Permission denied"
 			done <- sendWithContext(ctx, out, &resp)
 			return
 		}
-		err = table.StoreItem(msg)
-		if err != nil {
+	}
+	var ums UMSField
+	trash := false
+	if value, _ := cmd.Value.(string); cmd.Key == "ums" {
+		if err = ums.Parse(value); err == nil {
+			trash, err = table.IsTrashFolderWithContext(ctx, ums)
+		}
+	}
+	if cmd.Key == "ums" || cmd.Key == "oms" {
+		for attempt := 1; ; attempt++ {
+			if cmd.Key == "ums" {
+				msg.MoveTo(ums, trash)
+			} else {
+				msg.OMS, _ = cmd.Value.(string)
+			}
+			if err != nil {
+				resp.Ok = false
+				resp.Error = "Permission denied"
+				done <- sendWithContext(ctx, out, &resp)
+				return
+			}
+			version := msg.Version
+			if cmd.Version != nil {
+				version = *cmd.Version
+			}
+			err = table.StoreMsgIfVersionWithContext(ctx, msg, version)
+			if err == nil || cmd.Version != nil || attempt == msgUpdateAttempts ||
+				!errors.Is(err, ErrVersionConflict) {
+				break
+			}
+			if err = msg.ReloadWithContext(ctx, table); err != nil {
+				break
+			}
+		}
+		resp.Version = msg.Version
+		if errors.Is(err, ErrVersionConflict) {
+			resp.Ok = false
+			resp.Error = VERSION_CONFLICT
+			if msg.ReloadWithContext(ctx, table) == nil {
+				resp.Version = msg.Version
+			}
+		} else if err != nil {
 			resp.Ok = false
 			resp.Error = "Permission denied"
-			done <- sendWithContext(ctx, out, &resp)
-			return
 		}
 		done <- sendWithContext(ctx, out, &resp)
 		return
 	}
-	_, err = table.UpdateItemData(cmd.PK, cmd.Key, cmd.Value)
+	var updated *dynamodb.UpdateItemOutput
+	if cmd.Version != nil {
+		updated, err = table.UpdateItemDataIfVersionWithContext(
+			ctx, cmd.PK, cmd.Key, cmd.Value, *cmd.Version)
+	} else {
+		updated, err = table.UpdateMsgDataWithContext(ctx, cmd.PK, cmd.Key, cmd.Value)
+	}
 	if err != nil {
 		resp.Ok = false
 		resp.Error = err.Error()
+		if errors.Is(err, ErrVersionConflict) && msg.ReloadWithContext(ctx, table) == nil {
+			resp.Version = msg.Version
+		}
+	} else {
+		updatedMsg := &Msg{}
+		if dattr.UnmarshalMap(updated.Attributes, updatedMsg) == nil {
+			resp.Version = updatedMsg.Version
+		}
+	}
+	done <- sendWithContext(ctx, out, &resp)
+}
+
+// Moves trashed Msg back to the folder it was in before
+type MsgRestoreCmd struct {
+	Id   string `json:"id"`
+	PK   string `json:"pk"`
+	Name string `json:"name"`
+}
+
+func (cmd *MsgRestoreCmd) Perform(
+	ctx context.Context, table *DTable, reqCtx events.APIGatewayWebsocketProxyRequestContext,
+	out chan<- []byte, done chan<- error) {
+	userPK, err := extractUserPK(reqCtx)
+	if err != nil {
+		done <- err
+		return
+	}
+	resp := struct {
+		PK      string `json:"pk"`
+		Id      string `json:"id"`
+		Name    string `json:"name"`
+		Ok      bool   `json:"ok"`
+		Error   string `json:"error"`
+		UMS     string `json:"ums"`
+		Version int64  `json:"version"`
+	}{
+		PK:   cmd.PK,
+		Id:   cmd.Id,
+		Name: cmd.Name,
+		Ok:   true,
+	}
+	var msg *Msg
+	for attempt := 1; ; attempt++ {
+		msg = &Msg{}
+		if err = table.FetchItemWithContext(ctx, cmd.PK, msg); err != nil {
+			break
+		}
+		if msg.UMS.PK != userPK {
+			err = errors.New("Permission denied")
+			break
+		}
+		if err = msg.Restore(); err != nil {
+			break
+		}
+		err = table.StoreMsgIfVersionWithContext(ctx, msg, msg.Version)
+		if err == nil || attempt == msgUpdateAttempts || !errors.Is(err, ErrVersionConflict) {
+			break
+		}
+	}
+	if err != nil {
+		resp.Ok = false
+		resp.Error = err.Error()
+	} else {
+		resp.UMS = msg.UMS.String()
+		resp.Version = msg.Version
 	}
 	done <- sendWithContext(ctx, out, &resp)
 }
@@ -503,15 +1197,11 @@ func (cmd *SubscribeCmd) Perform(
 		return
 	}
 	sa, sb, _ := NewSubscription(userPK, cmd.UMSPK, cmd.MsgStatus, reqCtx.DomainName, reqCtx.Stage, reqCtx.ConnectionID)
-	err = table.StoreItem(sa)
-	if err != nil {
-		done <- err
-		return
-	}
-	err = table.StoreItem(sb)
-	if err != nil {
-		done <- err
-		return
+	for _, err := range table.BatchStoreWithContext(ctx, sa, sb) {
+		if err != nil {
+			done <- err
+			return
+		}
 	}
 	done <- sendWithContext(ctx, out, &CmdResp{
 		Id:     cmd.Id,
@@ -529,6 +1219,17 @@ func UnmarshalCmd(data []byte) (UserCmd, error) {
 		"unsubscr":         &UnsubscribeCmd{},
 		"fetchmsg":         &FetchMsgCmd{},
 		"msgupdate":        &MsgUpdateCmd{},
+		"orgmsgfetch":      &OrgMsgFetchCmd{},
+		"msgrestore":       &MsgRestoreCmd{},
+		"search":           &SearchCmd{},
+		"tagadd":           &MsgTagCmd{},
+		"tagremove":        &MsgTagCmd{},
+		"taglist":          &TagListCmd{},
+		"msgfetchbytag":    &MsgFetchByTagCmd{},
+		"threadfetch":      &ThreadFetchCmd{},
+		"msgdue":           &MsgDueCmd{},
+		"tasktransition":   &TaskTransitionCmd{},
+		"tasklist":         &TaskListCmd{},
 	}
 	var s struct {
 		Name string `json:"name"`
@@ -573,7 +1274,8 @@ func handleUserCmd(ctx context.Context, table *DTable,
 	if err != nil {
 		return err
 	}
-	doneCh := make(chan error)
+	// buffered, so Perform does not leak when ctx is done first
+	doneCh := make(chan error, 1)
 	go userCmd.Perform(ctx, table, reqCtx, outCh, doneCh)
 	select {
 	case <-ctx.Done():
@@ -606,7 +1308,7 @@ func (s *WSSender) Start(ctx context.Context, doneCh <-chan bool) {
 		case <-doneCh:
 			return
 		case data := <-s.ToUserCh:
-			err := s.Send(data)
+			err := s.SendWithContext(ctx, data)
 			if err != nil {
 				fmt.Println("ERROR", err.Error())
 				return
@@ -616,6 +1318,10 @@ func (s *WSSender) Start(ctx context.Context, doneCh <-chan bool) {
 }
 
 func (s *WSSender) Send(data []byte) error {
+	return s.SendWithContext(context.Background(), data)
+}
+
+func (s *WSSender) SendWithContext(ctx context.Context, data []byte) error {
 	conf := &aws.Config{Endpoint: aws.String(s.Endpoint)}
 	if s.Sess.Config.Region != nil {
 		conf.Region = s.Sess.Config.Region
@@ -623,7 +1329,7 @@ func (s *WSSender) Send(data []byte) error {
 		conf.Region = aws.String(os.Getenv("AWS_REGION"))
 	}
 	api := apimngmt.New(s.Sess, conf)
-	_, err := api.PostToConnection(&apimngmt.PostToConnectionInput{
+	_, err := api.PostToConnectionWithContext(ctx, &apimngmt.PostToConnectionInput{
 		ConnectionId: aws.String(s.ConnId),
 		Data:         data,
 	})
@@ -632,8 +1338,14 @@ func (s *WSSender) Send(data []byte) error {
 
 func HandleWSDefaultReq(req events.APIGatewayWebsocketProxyRequest, table *DTable) (
 	events.APIGatewayProxyResponse, error) {
+	return HandleWSDefaultReqWithContext(context.Background(), req, table)
+}
+
+// Handles user command, work is aborted when ctx is done or in 28 seconds
+func HandleWSDefaultReqWithContext(ctx context.Context, req events.APIGatewayWebsocketProxyRequest,
+	table *DTable) (events.APIGatewayProxyResponse, error) {
 	resp := events.APIGatewayProxyResponse{StatusCode: 400}
-	ctx, cancel := context.WithTimeout(context.Background(), 28*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 28*time.Second)
 	defer cancel()
 	toUserCh := make(chan []byte)
 	stopSendingCh := make(chan bool)
@@ -643,9 +1355,15 @@ func HandleWSDefaultReq(req events.APIGatewayWebsocketProxyRequest, table *DTabl
 	if err != nil {
 		return resp, err
 	}
-	go sender.Start(ctx, stopSendingCh)
+	senderDone := make(chan struct{})
+	go func() {
+		sender.Start(ctx, stopSendingCh)
+		close(senderDone)
+	}()
 	err = handleUserCmd(ctx, table, req.RequestContext, req.Body, toUserCh)
-	stopSendingCh <- true
+	// waits for the last message to be sent, sender may be gone already
+	close(stopSendingCh)
+	<-senderDone
 	if err != nil {
 		fmt.Println("ERROR", err.Error())
 		return resp, err
@@ -668,6 +1386,8 @@ type OTPReqBody struct {
 
 const NO_SUCH_USER = "No such user"
 
+var ErrNoSuchUser = errors.New(NO_SUCH_USER)
+
 func userByKey(table *DTable, key string, user *User) error {
 	var userPK string
 	if strings.Contains(key, "@") {
@@ -675,8 +1395,8 @@ func userByKey(table *DTable, key string, user *User) error {
 		emailPK := fmt.Sprintf("%s%s", EmailKeyPrefix, key)
 		err := table.FetchItem(emailPK, email)
 		if err != nil {
-			if err.Error() == NO_SUCH_ITEM {
-				return errors.New(NO_SUCH_USER)
+			if errors.Is(err, ErrNotFound) {
+				return ErrNoSuchUser
 			}
 			return err
 		}
@@ -686,8 +1406,8 @@ func userByKey(table *DTable, key string, user *User) error {
 		telPK := fmt.Sprintf("%s%s", TelKeyPrefix, key)
 		err := table.FetchItem(telPK, tel)
 		if err != nil {
-			if err.Error() == NO_SUCH_ITEM {
-				return errors.New(NO_SUCH_USER)
+			if errors.Is(err, ErrNotFound) {
+				return ErrNoSuchUser
 			}
 			return err
 		}
@@ -695,8 +1415,8 @@ func userByKey(table *DTable, key string, user *User) error {
 	}
 	err := table.FetchItem(userPK, user)
 	if err != nil {
-		if err.Error() == NO_SUCH_ITEM {
-			return errors.New(NO_SUCH_USER)
+		if errors.Is(err, ErrNotFound) {
+			return ErrNoSuchUser
 		}
 		return err
 	}
@@ -713,7 +1433,7 @@ func HandleLoginRequestOTP(table *DTable, reqBody *OTPReqBody) (events.APIGatewa
 	user := &User{}
 	err = userByKey(table, reqBody.Key, user)
 	if err != nil {
-		if err.Error() == NO_SUCH_USER {
+		if errors.Is(err, ErrNoSuchUser) {
 			resp.StatusCode = 200
 			respBody := &OTPReqRespBody{}
 			respBody.OK = false
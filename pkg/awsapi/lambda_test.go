@@ -234,6 +234,53 @@ func TestCmdFetchByDays(t *testing.T) {
 	assert.Equal(t, msg2.PK, resp3["pk"].(string))
 }
 
+func TestCmdFetchByDaysCursor(t *testing.T) {
+	defer stopLocalDynamo()
+	testTable := startLocalDynamo(t)
+	user1, _ := NewUser("user1")
+	var msgs []*Msg
+	for i := 1; i <= 3; i++ {
+		msg, _ := NewMsg("bot1", user1.PK, TGTextMsgKind, CreatedAtOp(fmt.Sprintf("-%dd", i)))
+		require.Nil(t, testTable.StoreItem(msg))
+		msgs = append(msgs, msg)
+	}
+	reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user1.PK)
+	outCh := make(chan []byte)
+	doneCh := make(chan bool)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	output := make([]string, 0)
+	go collectOutput(ctx, &output, outCh, doneCh)
+	input := fmt.Sprintf(`{"name":"msgfetchbydays", "id":"foo", "days":20, "ums":"%s#0", "desc":true, "limit":2}`,
+		user1.PK)
+	err := handleUserCmd(ctx, testTable, reqCtx, input, outCh)
+	if assert.Nil(t, err) {
+		doneCh <- true
+	}
+	require.Equal(t, 4, len(output))
+	msgResp := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal([]byte(output[1]), &msgResp))
+	assert.Equal(t, msgs[0].PK, msgResp["pk"].(string))
+	doneResp := &CmdResp{}
+	require.Nil(t, json.Unmarshal([]byte(output[3]), doneResp))
+	assert.Equal(t, "done", doneResp.Status)
+	require.NotEqual(t, "", doneResp.Cursor)
+
+	output = make([]string, 0)
+	go collectOutput(ctx, &output, outCh, doneCh)
+	input = fmt.Sprintf(
+		`{"name":"msgfetchbydays", "id":"foo", "days":20, "ums":"%s#0", "desc":true, "limit":2, "cursor":"%s"}`,
+		user1.PK, doneResp.Cursor)
+	err = handleUserCmd(ctx, testTable, reqCtx, input, outCh)
+	if assert.Nil(t, err) {
+		doneCh <- true
+	}
+	require.Equal(t, 3, len(output))
+	require.Nil(t, json.Unmarshal([]byte(output[1]), &msgResp))
+	assert.Equal(t, msgs[2].PK, msgResp["pk"].(string))
+}
+
 func TestCmdStartStopSubscr(t *testing.T) {
 	defer stopLocalDynamo()
 	table := startLocalDynamo(t)
@@ -446,6 +493,55 @@ func TestCmdMsgUpdateUMS(t *testing.T) {
 	assert.Equal(t, m.UMS.String(), "user1#foo#2")
 }
 
+func TestCmdMsgUpdateConflict(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	user1, _ := NewUser("user1")
+	msg1, _ := NewMsg("bot1", user1.PK, TGVoiceMsgKind)
+	msg1.Data["text"] = "foobar"
+	require.Nil(t, table.StoreItem(msg1))
+	// speech recognition is done meanwhile
+	_, err := table.UpdateMsgData(msg1.PK, RecognizedTextFieldName, "spam")
+	require.Nil(t, err)
+
+	reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user1.PK)
+	outCh := make(chan []byte)
+	doneCh := make(chan bool)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	output := make([]string, 0)
+	go collectOutput(ctx, &output, outCh, doneCh)
+	input := fmt.Sprintf(`{"name":"msgupdate", "id":"fooid", "key":"ums", "value":"%s#2", "pk":"%s", "version":0}`,
+		user1.PK, msg1.PK)
+	err = handleUserCmd(ctx, table, reqCtx, input, outCh)
+	if assert.Nil(t, err) {
+		doneCh <- true
+	}
+	require.Equal(t, 1, len(output))
+	resp := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal([]byte(output[0]), &resp))
+	assert.False(t, resp["ok"].(bool))
+	assert.Equal(t, VERSION_CONFLICT, resp["error"].(string))
+	assert.Equal(t, float64(1), resp["version"].(float64))
+
+	output = make([]string, 0)
+	go collectOutput(ctx, &output, outCh, doneCh)
+	input = fmt.Sprintf(`{"name":"msgupdate", "id":"fooid", "key":"ums", "value":"%s#2", "pk":"%s", "version":1}`,
+		user1.PK, msg1.PK)
+	err = handleUserCmd(ctx, table, reqCtx, input, outCh)
+	if assert.Nil(t, err) {
+		doneCh <- true
+	}
+	require.Equal(t, 1, len(output))
+	require.Nil(t, json.Unmarshal([]byte(output[0]), &resp))
+	assert.True(t, resp["ok"].(bool))
+	assert.Equal(t, float64(2), resp["version"].(float64))
+	m := &Msg{}
+	require.Nil(t, table.FetchItem(msg1.PK, m))
+	assert.Equal(t, int64(2), m.UMS.Status)
+	assert.Equal(t, "spam", m.Data[RecognizedTextFieldName])
+}
+
 func TestCmdFetchTimeStamps(t *testing.T) {
 	defer stopLocalDynamo()
 	testTable := startLocalDynamo(t)
@@ -502,3 +598,126 @@ func TestCmdFetchTimeStamps(t *testing.T) {
 
 	assert.Equal(t, msg2.PK, resp2["pk"].(string))
 }
+
+func TestCmdOrgMsgFetch(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	admin, _ := NewUser("admin")
+	user, _ := NewUser("user")
+	org, _ := NewOrg("team", "", []*User{admin})
+	require.Nil(t, table.StoreNewOrg(org))
+	msg1, _ := NewMsg("bot1", admin.PK, TGTextMsgKind, CreatedAtOp("-1d"), OrgOp(org.PK))
+	msg2, _ := NewMsg("bot1", user.PK, TGTextMsgKind, CreatedAtOp("-1d"))
+	require.Nil(t, table.StoreItem(msg1))
+	require.Nil(t, table.StoreItem(msg2))
+
+	run := func(userPK, input string) []string {
+		reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", userPK)
+		outCh := make(chan []byte)
+		doneCh := make(chan bool)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		output := make([]string, 0)
+		go collectOutput(ctx, &output, outCh, doneCh)
+		err := handleUserCmd(ctx, table, reqCtx, input, outCh)
+		if assert.Nil(t, err) {
+			doneCh <- true
+		}
+		return output
+	}
+	fetch := fmt.Sprintf(`{"name":"orgmsgfetch", "id":"fooid", "org":"%s", "start":0, "end":%d}`,
+		org.PK, time.Now().Unix())
+	output := run(user.PK, fetch)
+	require.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], "no permissions")
+
+	output = run(admin.PK, fetch)
+	require.Equal(t, 3, len(output))
+	assert.Contains(t, output[1], msg1.PK)
+	assert.Contains(t, output[1], org.PK)
+
+	// user is not a member and can't share msg with org
+	update := `{"name":"msgupdate", "id":"fooid", "key":"oms", "value":"%s", "pk":"%s"}`
+	output = run(user.PK, fmt.Sprintf(update, org.PK, msg2.PK))
+	require.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], "Permission denied")
+
+	member, _ := NewOrgMember(org, user, OrgMemberRole)
+	require.Nil(t, table.StoreItem(member))
+	output = run(user.PK, fmt.Sprintf(update, org.PK, msg2.PK))
+	require.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"ok":true`)
+	output = run(user.PK, fetch)
+	assert.Equal(t, 4, len(output))
+}
+
+func TestCmdMsgTrashRestore(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	user, _ := NewUser("user")
+	require.Nil(t, user.EnsureDefaultFolders(table))
+	msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind, UserStatusOp(1))
+	require.Nil(t, table.StoreItem(msg))
+
+	run := func(input string) map[string]interface{} {
+		reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user.PK)
+		outCh := make(chan []byte)
+		doneCh := make(chan bool)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		output := make([]string, 0)
+		go collectOutput(ctx, &output, outCh, doneCh)
+		err := handleUserCmd(ctx, table, reqCtx, input, outCh)
+		if assert.Nil(t, err) {
+			doneCh <- true
+		}
+		require.Equal(t, 1, len(output))
+		resp := make(map[string]interface{})
+		require.Nil(t, json.Unmarshal([]byte(output[0]), &resp))
+		return resp
+	}
+	restore := fmt.Sprintf(`{"name":"msgrestore", "id":"fooid", "pk":"%s"}`, msg.PK)
+	resp := run(restore)
+	assert.False(t, resp["ok"].(bool))
+	assert.Equal(t, NOT_IN_TRASH, resp["error"])
+
+	resp = run(fmt.Sprintf(`{"name":"msgupdate", "id":"fooid", "key":"ums", "value":"%s#3", "pk":"%s"}`,
+		user.PK, msg.PK))
+	assert.True(t, resp["ok"].(bool))
+	require.Nil(t, msg.Reload(table))
+	assert.NotEqual(t, int64(0), msg.TTL)
+	assert.Equal(t, int64(3), msg.UMS.Status)
+
+	resp = run(restore)
+	assert.True(t, resp["ok"].(bool))
+	assert.Equal(t, fmt.Sprintf("%s#1", user.PK), resp["ums"])
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, int64(0), msg.TTL)
+	assert.Equal(t, int64(0), msg.TrashedAt)
+}
+
+func TestCmdSearch(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	user, _ := NewUser("user")
+	msg := indexTestMsg(t, table, user.PK, 0, "remember the milk")
+	indexTestMsg(t, table, user.PK, 0, "something else")
+
+	reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user.PK)
+	outCh := make(chan []byte)
+	doneCh := make(chan bool)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	output := make([]string, 0)
+	go collectOutput(ctx, &output, outCh, doneCh)
+	err := handleUserCmd(ctx, table, reqCtx, `{"name":"search", "id":"fooid", "query":"Milk"}`, outCh)
+	if assert.Nil(t, err) {
+		doneCh <- true
+	}
+	require.Equal(t, 3, len(output))
+	view := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal([]byte(output[1]), &view))
+	assert.Equal(t, "msg_index", view["name"])
+	assert.Equal(t, msg.PK, view["pk"])
+	assert.Equal(t, user.PK, view["owner"])
+}
@@ -0,0 +1,261 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/session"
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+// Sets Kind of Msg for Telegram media other than photo and voice, things
+// that have no file, like location and contact, are kept in Data
+func classifyTGMedia(msg *Msg, tgmsg *tb.Message) {
+	switch {
+	case tgmsg.Document != nil:
+		msg.Kind = TGDocMsgKind
+		msg.Data["file_name"] = tgmsg.Document.FileName
+	case tgmsg.Audio != nil:
+		msg.Kind = TGAudioMsgKind
+		if tgmsg.Audio.Title != "" {
+			msg.Data["title"] = strings.TrimSpace(tgmsg.Audio.Performer + " " + tgmsg.Audio.Title)
+		}
+	case tgmsg.Video != nil, tgmsg.Animation != nil:
+		msg.Kind = TGVideoMsgKind
+	case tgmsg.VideoNote != nil:
+		msg.Kind = TGVideoNoteMsgKind
+	case tgmsg.Sticker != nil:
+		msg.Kind = TGStickerMsgKind
+		msg.Data["emoji"] = tgmsg.Sticker.Emoji
+	case tgmsg.Location != nil:
+		msg.Kind = TGLocationMsgKind
+		msg.Data["location"] = map[string]interface{}{
+			"lat": tgmsg.Location.Lat,
+			"lng": tgmsg.Location.Lng,
+		}
+		if tgmsg.Venue != nil {
+			msg.Data["text"] = strings.TrimSpace(tgmsg.Venue.Title + " " + tgmsg.Venue.Address)
+		}
+	case tgmsg.Contact != nil:
+		c := tgmsg.Contact
+		msg.Kind = TGContactMsgKind
+		msg.Data["contact"] = map[string]interface{}{
+			"phone":      c.PhoneNumber,
+			"first_name": c.FirstName,
+			"last_name":  c.LastName,
+		}
+		// so contact could be found by search
+		msg.Data["text"] = strings.TrimSpace(strings.Join([]string{c.FirstName, c.LastName, c.PhoneNumber}, " "))
+	}
+}
+
+// Kinds of Msg which have files to download besides photo and voice
+func isTGMediaKind(kind int64) bool {
+	switch kind {
+	case TGDocMsgKind, TGAudioMsgKind, TGVideoMsgKind, TGVideoNoteMsgKind, TGStickerMsgKind:
+		return true
+	}
+	return false
+}
+
+// File of Telegram message to store in the bucket
+type tgMediaFile struct {
+	Kind string
+	File tb.File
+	Mime string
+	Ext  string
+	Data map[string]interface{}
+}
+
+func tgThumbFile(thumb *tb.Photo) *tgMediaFile {
+	if thumb == nil || thumb.FileID == "" {
+		return nil
+	}
+	return &tgMediaFile{Kind: FileKindTgThumb, File: thumb.File, Mime: "image/jpeg", Ext: ".jpg",
+		Data: map[string]interface{}{"width": thumb.Width, "height": thumb.Height}}
+}
+
+// Extension of the file, it is taken from the name or guessed by mime
+func fileExt(name, mimeType, def string) string {
+	if ext := path.Ext(name); ext != "" {
+		return strings.ToLower(ext)
+	}
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return def
+}
+
+// Returns files of Telegram message that are downloaded to the bucket,
+// main one goes first, thumbnail after it
+func tgMediaFiles(tgmsg *tb.Message) []*tgMediaFile {
+	var main, thumb *tgMediaFile
+	switch {
+	case tgmsg.Photo != nil:
+		var files []*tgMediaFile
+		kinds := []string{FileKindTgThumb, FileKindTgMediumPic, FileKindTgBigPic}
+		for i, pic := range tgmsg.Photo.Sizes {
+			if i == len(kinds) {
+				break
+			}
+			files = append(files, &tgMediaFile{Kind: kinds[i], File: pic.File, Mime: "image/jpeg", Ext: ".jpg",
+				Data: map[string]interface{}{"width": pic.Width, "height": pic.Height}})
+		}
+		return files
+	case tgmsg.Document != nil:
+		d := tgmsg.Document
+		main = &tgMediaFile{Kind: FileKindTgDoc, File: d.File, Mime: d.MIME,
+			Ext: fileExt(d.FileName, d.MIME, ""), Data: map[string]interface{}{"file_name": d.FileName}}
+		thumb = tgThumbFile(d.Thumbnail)
+	case tgmsg.Audio != nil:
+		a := tgmsg.Audio
+		main = &tgMediaFile{Kind: FileKindTgAudio, File: a.File, Mime: a.MIME,
+			Ext: fileExt(a.FileName, a.MIME, ".mp3"), Data: map[string]interface{}{
+				"file_name": a.FileName, "duration": a.Duration, "title": a.Title, "performer": a.Performer}}
+		thumb = tgThumbFile(a.Thumbnail)
+	case tgmsg.Video != nil:
+		v := tgmsg.Video
+		main = &tgMediaFile{Kind: FileKindTgVideo, File: v.File, Mime: v.MIME,
+			Ext: fileExt(v.FileName, v.MIME, ".mp4"), Data: map[string]interface{}{
+				"file_name": v.FileName, "duration": v.Duration, "width": v.Width, "height": v.Height}}
+		thumb = tgThumbFile(v.Thumbnail)
+	case tgmsg.Animation != nil:
+		v := tgmsg.Animation
+		main = &tgMediaFile{Kind: FileKindTgVideo, File: v.File, Mime: v.MIME,
+			Ext: fileExt(v.FileName, v.MIME, ".mp4"), Data: map[string]interface{}{
+				"file_name": v.FileName, "duration": v.Duration, "width": v.Width, "height": v.Height}}
+		thumb = tgThumbFile(v.Thumbnail)
+	case tgmsg.VideoNote != nil:
+		v := tgmsg.VideoNote
+		main = &tgMediaFile{Kind: FileKindTgVideoNote, File: v.File, Mime: "video/mp4", Ext: ".mp4",
+			Data: map[string]interface{}{"duration": v.Duration, "width": v.Length, "height": v.Length}}
+		thumb = tgThumbFile(v.Thumbnail)
+	case tgmsg.Sticker != nil:
+		s := tgmsg.Sticker
+		mimeType, ext := "image/webp", ".webp"
+		if s.Animated {
+			mimeType, ext = "application/x-tgsticker", ".tgs"
+		}
+		main = &tgMediaFile{Kind: FileKindTgSticker, File: s.File, Mime: mimeType, Ext: ext,
+			Data: map[string]interface{}{"width": s.Width, "height": s.Height, "emoji": s.Emoji}}
+		thumb = tgThumbFile(s.Thumbnail)
+	}
+	var files []*tgMediaFile
+	if main != nil {
+		if main.Mime == "" {
+			main.Mime = "application/octet-stream"
+		}
+		files = append(files, main)
+	}
+	if thumb != nil {
+		files = append(files, thumb)
+	}
+	return files
+}
+
+// Uploads file to S3, it is a var so tests could replace it
+var uploadS3 = func(ctx context.Context, bucket, key, contentType string, file io.ReadCloser) error {
+	sess, err := session.NewSession()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return storeS3(ctx, sess, bucket, key, contentType, file)
+}
+
+// Downloads media files of Telegram message to the bucket and stores
+// MsgFile for each of them, position is set for items of album.
+// Files that could not be downloaded are skipped, Telegram does not
+// give files bigger than 20MB to bots
+func downloadTGMedia(ctx context.Context, table *DTable, pk string, position int64, tgmsg *tb.Message,
+	getFile func(*tb.File) (io.ReadCloser, error), bucket string) {
+	for _, mf := range tgMediaFiles(tgmsg) {
+		file, err := getFile(&mf.File)
+		if err != nil {
+			fmt.Println("ERROR getting file", mf.File.FileID, err.Error())
+			continue
+		}
+		key := mf.File.UniqueID + mf.Ext
+		if err = uploadS3(ctx, bucket, key, mf.Mime, file); err != nil {
+			fmt.Println("ERROR uploading", key, err.Error())
+			continue
+		}
+		f, _ := NewMsgFile(pk, mf.Kind, mf.Mime, bucket, key)
+		if position > 0 {
+			f.SK = albumFileSK(position, mf.Kind)
+			f.Position = position
+		}
+		for k, v := range mf.Data {
+			if v != "" && v != 0 {
+				f.Data[k] = v
+			}
+		}
+		f.Data["size"] = mf.File.FileSize
+		if err = table.StoreItemWithContext(ctx, f); err != nil {
+			fmt.Println("ERROR storing MsgFile", err.Error())
+		}
+	}
+}
+
+func handleTGMediaMsg(ctx context.Context, pk string, table *DTable, item map[string]events.DynamoDBAttributeValue) {
+	if item["D"].DataType() != events.DataTypeMap {
+		return
+	}
+	orig := item["D"].Map()["orig"]
+	if orig.DataType() != events.DataTypeString {
+		return
+	}
+	downloadTGOrig(ctx, table, pk, itemChannelPK(item), orig.String(), 0)
+}
+
+// Downloads files of Telegram update orig to the bucket, position is
+// set for album items. Files are got by the bot Msg came through
+func downloadTGOrig(ctx context.Context, table *DTable, pk, botPK, orig string, position int64) {
+	bucket := os.Getenv("IMG_BUCKET")
+	if bucket == "" {
+		fmt.Println("IMG_BUCKET env var is not set")
+		return
+	}
+	var upd tb.Update
+	if err := json.Unmarshal([]byte(orig), &upd); err != nil {
+		fmt.Printf("ERROR: %s", err.Error())
+		return
+	}
+	if upd.Message == nil {
+		return
+	}
+	bot, err := msgTGBotWithContext(ctx, table, botPK)
+	if err != nil {
+		fmt.Printf("ERROR creating bot %s", err.Error())
+		return
+	}
+	downloadTGMedia(ctx, table, pk, position, upd.Message, bot.GetFile, bucket)
+}
+
+// Telegram file ids are valid only for the bot which got them,
+// so files of Msg are got by the bot of its channel
+func msgTGBotWithContext(ctx context.Context, table *DTable, botPK string) (*tb.Bot, error) {
+	bot := &Bot{}
+	if err := table.FetchItemWithContext(ctx, botPK, bot); err != nil {
+		return nil, err
+	}
+	return tb.NewBot(tb.Settings{
+		Token:       bot.Secret,
+		Synchronous: true,
+	})
+}
+
+// PK of Bot Msg in stream image came through
+func itemChannelPK(item map[string]events.DynamoDBAttributeValue) string {
+	if item["Ch"].DataType() != events.DataTypeString {
+		return ""
+	}
+	return item["Ch"].String()
+}
@@ -0,0 +1,128 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const TGMediaMsgTmpl = `{"update_id": %[2]d,
+  "message": {
+    "message_id": %[2]d,
+    "from": {"id": %[1]d, "is_bot": false, "first_name": "D"},
+    "chat": {"id": %[1]d, "first_name": "D", "type": "private"},
+    "date": 1597084525,
+    %[3]s}
+}`
+
+func TestScenarioTGMediaKinds(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	_, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGDocMsgTmpl, tgid))
+	require.Nil(t, err)
+	cases := []struct {
+		body string
+		kind int64
+	}{
+		{`"audio": {"file_id": "a1", "file_unique_id": "ua1", "duration": 180, "title": "Song", "performer": "Band"}`, TGAudioMsgKind},
+		{`"video": {"file_id": "v1", "file_unique_id": "uv1", "width": 640, "height": 480, "duration": 10}`, TGVideoMsgKind},
+		{`"animation": {"file_id": "g1", "file_unique_id": "ug1", "width": 320, "height": 240, "duration": 3}`, TGVideoMsgKind},
+		{`"video_note": {"file_id": "n1", "file_unique_id": "un1", "length": 240, "duration": 5}`, TGVideoNoteMsgKind},
+		{`"sticker": {"file_id": "s1", "file_unique_id": "us1", "width": 512, "height": 512, "emoji": "👍"}`, TGStickerMsgKind},
+		{`"location": {"latitude": 50.45, "longitude": 30.52}`, TGLocationMsgKind},
+		{`"contact": {"phone_number": "+380501234567", "first_name": "Ann", "last_name": "Lee"}`, TGContactMsgKind},
+	}
+	for i, c := range cases {
+		_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGMediaMsgTmpl, tgid, 20+i, c.body))
+		require.Nil(t, err)
+	}
+	msg := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 9, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	assert.Equal(t, int64(TGDocMsgKind), msg.Kind)
+	assert.Equal(t, "IMG_20200802_195818.jpg", msg.Data["file_name"])
+	for i, c := range cases {
+		msg := &Msg{}
+		require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 20 + i, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+		assert.Equal(t, c.kind, msg.Kind, c.body)
+		if c.kind == TGContactMsgKind {
+			assert.Equal(t, "Ann Lee +380501234567", msg.Data["text"])
+			v, _ := NewMsgView(msg, nil)
+			assert.Equal(t, "+380501234567", v.Contact.(map[string]interface{})["phone"])
+		}
+		if c.kind == TGLocationMsgKind {
+			v, _ := NewMsgView(msg, nil)
+			assert.NotNil(t, v.Location)
+		}
+	}
+}
+
+func TestDownloadTGMedia(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	uploaded := make(map[string]string)
+	origUpload := uploadS3
+	uploadS3 = func(ctx context.Context, bucket, key, contentType string, file io.ReadCloser) error {
+		defer file.Close()
+		b, err := ioutil.ReadAll(file)
+		uploaded[key] = contentType + ":" + string(b)
+		return err
+	}
+	defer func() { uploadS3 = origUpload }()
+	// files are got by the bot Msg came through, it has to be registered
+	_, err := msgTGBotWithContext(ctx, table, GetBotPK(TGBotKind, "nosuchbot"))
+	assert.True(t, errors.Is(err, ErrNotFound))
+	getFile := func(f *tb.File) (io.ReadCloser, error) {
+		if f.FileID == "toobig" {
+			return nil, errors.New("file is too big")
+		}
+		return ioutil.NopCloser(strings.NewReader(f.FileID)), nil
+	}
+	upd := &tb.Update{}
+	require.Nil(t, json.Unmarshal([]byte(fmt.Sprintf(TGDocMsgTmpl, 1)), upd))
+	msg, _ := NewMsg("bot1", "user#1", TGDocMsgKind)
+	downloadTGMedia(ctx, table, msg.PK, 0, upd.Message, getFile, "bucket")
+	assert.Equal(t, "image/jpeg:"+upd.Message.Document.FileID, uploaded["AgADgAgAAlrBiEk.jpg"])
+	assert.Equal(t, 2, len(uploaded))
+
+	var files []*MsgFile
+	require.Nil(t, table.FetchItemsWithPrefix(msg.PK, MsgFileKeyPrefix, &files))
+	require.Equal(t, 2, len(files))
+	byKind := make(map[string]*MsgFile)
+	for _, f := range files {
+		byKind[f.FileKind] = f
+	}
+	doc := byKind[FileKindTgDoc]
+	require.NotNil(t, doc)
+	assert.Equal(t, "IMG_20200802_195818.jpg", doc.Data["file_name"])
+	assert.Equal(t, float64(4398585), doc.Data["size"])
+	assert.Equal(t, "image/jpeg", doc.Mime)
+	thumb := byKind[FileKindTgThumb]
+	require.NotNil(t, thumb)
+	assert.Equal(t, float64(320), thumb.Data["width"])
+
+	video := &tb.Message{Video: &tb.Video{
+		File: tb.File{FileID: "toobig", UniqueID: "big"}, MIME: "video/mp4", Duration: 600}}
+	msg, _ = NewMsg("bot1", "user#1", TGVideoMsgKind)
+	downloadTGMedia(ctx, table, msg.PK, 0, video, getFile, "bucket")
+	files = nil
+	require.Nil(t, table.FetchItemsWithPrefix(msg.PK, MsgFileKeyPrefix, &files))
+	assert.Equal(t, 0, len(files))
+}
@@ -0,0 +1,383 @@
+package awsapi
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type memItem map[string]*dynamodb.AttributeValue
+
+// Condition compiled from DynamoDB expression, used by MemStorage
+type memCond func(item memItem) bool
+
+type memOperand func(item memItem) *dynamodb.AttributeValue
+
+// Parses condition and key condition expressions the way DynamoDB does.
+// Supports comparators, BETWEEN, IN, AND, OR, NOT, parentheses and
+// attribute_exists, attribute_not_exists, begins_with, contains functions
+type memExprParser struct {
+	toks   []string
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+func compileMemCond(expr string, names map[string]*string,
+	values map[string]*dynamodb.AttributeValue) (memCond, error) {
+	toks, err := tokenizeMemExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &memExprParser{toks: toks, names: names, values: values}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("Unexpected token %s in %s", p.toks[p.pos], expr)
+	}
+	return cond, nil
+}
+
+func tokenizeMemExpr(expr string) ([]string, error) {
+	var toks []string
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '=':
+			toks = append(toks, string(c))
+			i++
+		case c == '<' || c == '>':
+			if i+1 < len(expr) && (expr[i+1] == '=' || (c == '<' && expr[i+1] == '>')) {
+				toks = append(toks, expr[i:i+2])
+				i += 2
+			} else {
+				toks = append(toks, string(c))
+				i++
+			}
+		default:
+			j := i
+			for j < len(expr) && strings.IndexByte(" \t\n(),=<>", expr[j]) == -1 {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+func (p *memExprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *memExprParser) isKeyword(kw string) bool {
+	return strings.EqualFold(p.peek(), kw)
+}
+
+func (p *memExprParser) expect(tok string) error {
+	if !strings.EqualFold(p.peek(), tok) {
+		return fmt.Errorf("Expected %s got %q", tok, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+func (p *memExprParser) parseOr() (memCond, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(item memItem) bool { return l(item) || right(item) }
+	}
+	return left, nil
+}
+
+func (p *memExprParser) parseAnd() (memCond, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(item memItem) bool { return l(item) && right(item) }
+	}
+	return left, nil
+}
+
+func (p *memExprParser) parseNot() (memCond, error) {
+	if p.isKeyword("NOT") {
+		p.pos++
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(item memItem) bool { return !c(item) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *memExprParser) parsePrimary() (memCond, error) {
+	if p.peek() == "(" {
+		p.pos++
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return c, p.expect(")")
+	}
+	fname := strings.ToLower(p.peek())
+	switch fname {
+	case "attribute_exists", "attribute_not_exists", "begins_with", "contains":
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		args := []memOperand{}
+		for {
+			op, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, op)
+			if p.peek() != "," {
+				break
+			}
+			p.pos++
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return memFunc(fname, args)
+	}
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.peek()
+	switch {
+	case op == "=" || op == "<>" || op == "<" || op == "<=" || op == ">" || op == ">=":
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return func(item memItem) bool {
+			return memCompare(op, left(item), right(item))
+		}, nil
+	case strings.EqualFold(op, "BETWEEN"):
+		p.pos++
+		low, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return func(item memItem) bool {
+			v := left(item)
+			return memCompare(">=", v, low(item)) && memCompare("<=", v, high(item))
+		}, nil
+	case strings.EqualFold(op, "IN"):
+		p.pos++
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var opts []memOperand
+		for {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, o)
+			if p.peek() != "," {
+				break
+			}
+			p.pos++
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(item memItem) bool {
+			v := left(item)
+			for _, o := range opts {
+				if memCompare("=", v, o(item)) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, fmt.Errorf("Unexpected token %q", op)
+}
+
+func (p *memExprParser) parseOperand() (memOperand, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, fmt.Errorf("Unexpected end of expression")
+	}
+	p.pos++
+	if strings.HasPrefix(tok, ":") {
+		v, ok := p.values[tok]
+		if !ok {
+			return nil, fmt.Errorf("Value %s is not provided", tok)
+		}
+		return func(memItem) *dynamodb.AttributeValue { return v }, nil
+	}
+	var path []string
+	for _, part := range strings.Split(tok, ".") {
+		if strings.HasPrefix(part, "#") {
+			name, ok := p.names[part]
+			if !ok || name == nil {
+				return nil, fmt.Errorf("Name %s is not provided", part)
+			}
+			part = *name
+		}
+		path = append(path, part)
+	}
+	return func(item memItem) *dynamodb.AttributeValue {
+		return memPath(item, path)
+	}, nil
+}
+
+func memPath(item memItem, path []string) *dynamodb.AttributeValue {
+	av, ok := item[path[0]]
+	if !ok {
+		return nil
+	}
+	for _, part := range path[1:] {
+		if av == nil || av.M == nil {
+			return nil
+		}
+		av = av.M[part]
+	}
+	return av
+}
+
+func memFunc(name string, args []memOperand) (memCond, error) {
+	switch name {
+	case "attribute_exists":
+		return func(item memItem) bool { return args[0](item) != nil }, nil
+	case "attribute_not_exists":
+		return func(item memItem) bool { return args[0](item) == nil }, nil
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s expects 2 arguments", name)
+	}
+	if name == "begins_with" {
+		return func(item memItem) bool {
+			v, prefix := args[0](item), args[1](item)
+			if v == nil || prefix == nil {
+				return false
+			}
+			if v.S != nil && prefix.S != nil {
+				return strings.HasPrefix(*v.S, *prefix.S)
+			}
+			if v.B != nil && prefix.B != nil {
+				return bytes.HasPrefix(v.B, prefix.B)
+			}
+			return false
+		}, nil
+	}
+	return func(item memItem) bool {
+		v, what := args[0](item), args[1](item)
+		if v == nil || what == nil {
+			return false
+		}
+		switch {
+		case v.S != nil && what.S != nil:
+			return strings.Contains(*v.S, *what.S)
+		case v.SS != nil && what.S != nil:
+			for _, s := range v.SS {
+				if *s == *what.S {
+					return true
+				}
+			}
+		case v.NS != nil && what.N != nil:
+			for _, n := range v.NS {
+				if memCompare("=", &dynamodb.AttributeValue{N: n}, what) {
+					return true
+				}
+			}
+		case v.L != nil:
+			for _, el := range v.L {
+				if memCompare("=", el, what) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// Compares two attribute values, values of different types never match
+func memCompare(op string, a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return op == "<>" && (a != nil || b != nil)
+	}
+	var cmp int
+	switch {
+	case a.S != nil && b.S != nil:
+		cmp = strings.Compare(*a.S, *b.S)
+	case a.N != nil && b.N != nil:
+		x, okx := new(big.Float).SetString(*a.N)
+		y, oky := new(big.Float).SetString(*b.N)
+		if !okx || !oky {
+			return false
+		}
+		cmp = x.Cmp(y)
+	case a.B != nil && b.B != nil:
+		cmp = bytes.Compare(a.B, b.B)
+	default:
+		eq := reflect.DeepEqual(a, b)
+		switch op {
+		case "=":
+			return eq
+		case "<>":
+			return !eq
+		}
+		return false
+	}
+	switch op {
+	case "=":
+		return cmp == 0
+	case "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
@@ -0,0 +1,667 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+type memKey struct {
+	PK string
+	SK string
+}
+
+type memIndex struct {
+	Name       string
+	HashKey    string
+	RangeKey   string
+	Projection *dynamodb.Projection
+}
+
+// Storage that keeps items in memory and behaves like the DynamoDB table
+// described in createTableInput: conditional puts, transactions, GSIs with
+// their projections and TTL. It is meant for tests and local runs.
+type MemStorage struct {
+	mu      sync.Mutex
+	items   map[memKey]memItem
+	indexes map[string]*memIndex
+	TTLAttr string
+	Now     func() time.Time
+	// Stands for 1MB limit of one DynamoDB Query response, 0 is no limit
+	MaxPageItems int64
+	// How many items of one batch request are processed, the rest is
+	// returned as unprocessed like throttled DynamoDB does. 0 is no limit
+	MaxBatchItems int
+}
+
+func NewMemStorage() *MemStorage {
+	s := &MemStorage{
+		items:   make(map[memKey]memItem),
+		indexes: make(map[string]*memIndex),
+		TTLAttr: *timeToLiveInput.TimeToLiveSpecification.AttributeName,
+		Now:     time.Now,
+	}
+	for _, gsi := range createTableInput.GlobalSecondaryIndexes {
+		s.AddIndex(gsi)
+	}
+	return s
+}
+
+// Registers global secondary index
+func (s *MemStorage) AddIndex(gsi *dynamodb.GlobalSecondaryIndex) {
+	idx := &memIndex{Name: *gsi.IndexName, Projection: gsi.Projection}
+	for _, ks := range gsi.KeySchema {
+		if *ks.KeyType == "HASH" {
+			idx.HashKey = *ks.AttributeName
+		} else {
+			idx.RangeKey = *ks.AttributeName
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.indexes[idx.Name] = idx
+}
+
+func (s *MemStorage) AddIndexWithContext(ctx context.Context, gsi *dynamodb.GlobalSecondaryIndex,
+	attrs []*dynamodb.AttributeDefinition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	_, exists := s.indexes[aws.StringValue(gsi.IndexName)]
+	s.mu.Unlock()
+	if !exists {
+		s.AddIndex(gsi)
+	}
+	return nil
+}
+
+func memValidationErr(format string, args ...interface{}) error {
+	return awserr.New("ValidationException", fmt.Sprintf(format, args...), nil)
+}
+
+func memKeyOf(item memItem) (memKey, error) {
+	pk, sk := item["PK"], item["SK"]
+	if pk == nil || pk.S == nil || sk == nil || sk.S == nil {
+		return memKey{}, memValidationErr("One of the required keys was not given a value")
+	}
+	return memKey{PK: *pk.S, SK: *sk.S}, nil
+}
+
+func memKeyAttrs(pk, sk string) memItem {
+	return memItem{"PK": {S: aws.String(pk)}, "SK": {S: aws.String(sk)}}
+}
+
+func copyAttr(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+	c := &dynamodb.AttributeValue{BOOL: av.BOOL, NULL: av.NULL}
+	if av.S != nil {
+		c.S = aws.String(*av.S)
+	}
+	if av.N != nil {
+		c.N = aws.String(*av.N)
+	}
+	if av.B != nil {
+		c.B = append([]byte{}, av.B...)
+	}
+	if av.M != nil {
+		c.M = copyMemItem(av.M)
+	}
+	if av.L != nil {
+		c.L = make([]*dynamodb.AttributeValue, len(av.L))
+		for i, el := range av.L {
+			c.L[i] = copyAttr(el)
+		}
+	}
+	if av.SS != nil {
+		c.SS = aws.StringSlice(aws.StringValueSlice(av.SS))
+	}
+	if av.NS != nil {
+		c.NS = aws.StringSlice(aws.StringValueSlice(av.NS))
+	}
+	if av.BS != nil {
+		c.BS = make([][]byte, len(av.BS))
+		for i, b := range av.BS {
+			c.BS[i] = append([]byte{}, b...)
+		}
+	}
+	return c
+}
+
+func copyMemItem(item memItem) memItem {
+	if item == nil {
+		return nil
+	}
+	c := make(memItem, len(item))
+	for k, v := range item {
+		c[k] = copyAttr(v)
+	}
+	return c
+}
+
+// Evaluates condition expression against stored item, missing item
+// is treated as item without attributes
+func (s *MemStorage) checkCond(key memKey, expr *string, names map[string]*string,
+	values map[string]*dynamodb.AttributeValue) (bool, error) {
+	if expr == nil || *expr == "" {
+		return true, nil
+	}
+	cond, err := compileMemCond(*expr, names, values)
+	if err != nil {
+		return false, memValidationErr("Invalid ConditionExpression: %s", err.Error())
+	}
+	return cond(s.items[key]), nil
+}
+
+func (s *MemStorage) StoreItemWithContext(ctx context.Context, item interface{},
+	options ...func(*dynamodb.PutItemInput) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	av, err := dattr.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{Item: av}
+	for _, ops := range options {
+		if err := ops(input); err != nil {
+			return err
+		}
+	}
+	key, err := memKeyOf(input.Item)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok, err := s.checkCond(key, input.ConditionExpression,
+		input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &StorageError{Kind: ErrAlreadyExists, Cause: awserr.New(
+			dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)}
+	}
+	s.items[key] = copyMemItem(input.Item)
+	return nil
+}
+
+func (s *MemStorage) StoreInTransUniqWithContext(ctx context.Context, items ...interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var avs []memItem
+	var keys []memKey
+	seen := make(map[memKey]bool)
+	for _, i := range items {
+		av, err := dattr.MarshalMap(i)
+		if err != nil {
+			return err
+		}
+		key, err := memKeyOf(av)
+		if err != nil {
+			return err
+		}
+		if seen[key] {
+			return memValidationErr(
+				"Transaction request cannot include multiple operations on one item")
+		}
+		seen[key] = true
+		avs = append(avs, av)
+		keys = append(keys, key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reasons := make([]*dynamodb.CancellationReason, len(keys))
+	var failed []string
+	for i, key := range keys {
+		if _, exists := s.items[key]; exists {
+			reasons[i] = &dynamodb.CancellationReason{
+				Code:    aws.String("ConditionalCheckFailed"),
+				Message: aws.String("The conditional request failed")}
+			failed = append(failed, "ConditionalCheckFailed")
+		} else {
+			reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+			failed = append(failed, "None")
+		}
+	}
+	for _, r := range reasons {
+		if *r.Code != "None" {
+			return wrapAWSError(&dynamodb.TransactionCanceledException{
+				Message_: aws.String(fmt.Sprintf(
+					"Transaction cancelled, please refer cancellation reasons for specific reasons [%s]",
+					strings.Join(failed, ", "))),
+				CancellationReasons: reasons,
+			})
+		}
+	}
+	for i, key := range keys {
+		s.items[key] = copyMemItem(avs[i])
+	}
+	return nil
+}
+
+func (s *MemStorage) FetchItemWithContext(ctx context.Context, pk string, item interface{}) error {
+	return s.FetchSubItemWithContext(ctx, pk, pk, item)
+}
+
+func (s *MemStorage) FetchSubItemWithContext(ctx context.Context, pk, sk string, item interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	stored, ok := s.items[memKey{PK: pk, SK: sk}]
+	stored = copyMemItem(stored)
+	s.mu.Unlock()
+	if !ok {
+		return newNotFoundErr()
+	}
+	return dattr.UnmarshalMap(stored, item)
+}
+
+func (s *MemStorage) FetchItemsWithPrefixWithContext(ctx context.Context,
+	pk, prefix string, out interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	var keys []memKey
+	for key := range s.items {
+		if key.PK == pk && strings.HasPrefix(key.SK, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].SK < keys[j].SK })
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, copyMemItem(s.items[key]))
+	}
+	s.mu.Unlock()
+	if len(items) > 0 {
+		return dattr.UnmarshalListOfMaps(items, out)
+	}
+	return nil
+}
+
+func (s *MemStorage) UpdateItemMapWithContext(ctx context.Context, pk, sk, fName, key string,
+	value interface{}) (*dynamodb.UpdateItemOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	val, err := dattr.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[memKey{PK: pk, SK: sk}]
+	if !ok || item[fName] == nil || item[fName].M == nil {
+		return nil, memValidationErr("The document path provided in the update expression is invalid for update")
+	}
+	item[fName].M[key] = val
+	item[fName].M[UpdatedAtField] = &dynamodb.AttributeValue{
+		N: aws.String(fmt.Sprintf("%d", s.Now().Unix()))}
+	return &dynamodb.UpdateItemOutput{Attributes: copyMemItem(item)}, nil
+}
+
+func (s *MemStorage) UpdateItemMapVersionWithContext(ctx context.Context, pk, sk, fName, key string,
+	value interface{}, version int64) (*dynamodb.UpdateItemOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	val, err := dattr.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mkey := memKey{PK: pk, SK: sk}
+	ok, err := s.checkCond(mkey, aws.String(versionCond(version, true)),
+		map[string]*string{"#V": aws.String(VersionField)},
+		map[string]*dynamodb.AttributeValue{":ver": {N: aws.String(strconv.FormatInt(version, 10))}})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, wrapAWSError(awserr.New(
+			dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil))
+	}
+	item := s.items[mkey]
+	if item[fName] == nil || item[fName].M == nil {
+		return nil, memValidationErr("The document path provided in the update expression is invalid for update")
+	}
+	item[fName].M[key] = val
+	item[fName].M[UpdatedAtField] = &dynamodb.AttributeValue{
+		N: aws.String(fmt.Sprintf("%d", s.Now().Unix()))}
+	current := int64(0)
+	if v := item[VersionField]; v != nil && v.N != nil {
+		current, _ = strconv.ParseInt(*v.N, 10, 64)
+	}
+	item[VersionField] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(current+1, 10))}
+	return &dynamodb.UpdateItemOutput{Attributes: copyMemItem(item)}, nil
+}
+
+func (s *MemStorage) IncrPropWithContext(ctx context.Context, pk, sk, propName string, amount int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memKey{PK: pk, SK: sk}
+	item, ok := s.items[key]
+	if !ok {
+		item = memKeyAttrs(pk, sk)
+		s.items[key] = item
+	}
+	current := item[propName]
+	if current == nil {
+		item[propName] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(amount, 10))}
+		return nil
+	}
+	if current.N == nil {
+		return memValidationErr("An operand in the update expression has an incorrect data type")
+	}
+	if n, err := strconv.ParseInt(*current.N, 10, 64); err == nil {
+		current.N = aws.String(strconv.FormatInt(n+amount, 10))
+		return nil
+	}
+	f, err := strconv.ParseFloat(*current.N, 64)
+	if err != nil {
+		return err
+	}
+	current.N = aws.String(strconv.FormatFloat(f+float64(amount), 'f', -1, 64))
+	return nil
+}
+
+// Returns index item with attributes projected into given index
+func (idx *memIndex) project(item memItem) memItem {
+	if idx.Projection == nil || aws.StringValue(idx.Projection.ProjectionType) == "ALL" {
+		return copyMemItem(item)
+	}
+	attrs := []string{"PK", "SK", idx.HashKey, idx.RangeKey}
+	if aws.StringValue(idx.Projection.ProjectionType) == "INCLUDE" {
+		attrs = append(attrs, aws.StringValueSlice(idx.Projection.NonKeyAttributes)...)
+	}
+	out := make(memItem)
+	for _, name := range attrs {
+		if v, ok := item[name]; ok {
+			out[name] = copyAttr(v)
+		}
+	}
+	return out
+}
+
+// Table itself is queried as an index with PK and SK keys
+var memTableIndex = &memIndex{HashKey: "PK", RangeKey: "SK"}
+
+// Orders items by range key, then by table keys
+func (idx *memIndex) compare(a, b memItem) int {
+	for _, name := range []string{idx.RangeKey, "PK", "SK"} {
+		if name == "" {
+			continue
+		}
+		if memCompare("<", a[name], b[name]) {
+			return -1
+		}
+		if memCompare(">", a[name], b[name]) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Key attributes DynamoDB returns as LastEvaluatedKey for the index
+func (idx *memIndex) keyOf(item memItem) map[string]*dynamodb.AttributeValue {
+	key := make(map[string]*dynamodb.AttributeValue)
+	for _, name := range []string{"PK", "SK", idx.HashKey, idx.RangeKey} {
+		if v, ok := item[name]; ok {
+			key[name] = copyAttr(v)
+		}
+	}
+	return key
+}
+
+// Items stored in index sorted by range key, index is sparse so
+// only items having both index keys are there
+func (s *MemStorage) indexItems(idx *memIndex) []memItem {
+	var items []memItem
+	for _, item := range s.items {
+		if item[idx.HashKey] != nil && (idx.RangeKey == "" || item[idx.RangeKey] != nil) {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return idx.compare(items[i], items[j]) < 0
+	})
+	return items
+}
+
+func (s *MemStorage) QueryIndexWithContext(ctx context.Context,
+	name string, cond string, exprValues map[string]interface{}) (*dynamodb.QueryOutput, error) {
+	return s.QueryWithContext(ctx, &QueryParams{Index: name, Cond: cond, Values: exprValues})
+}
+
+// Runs one query request. Result is cut at MaxPageItems like DynamoDB
+// cuts it at 1MB, LastEvaluatedKey is set then
+func (s *MemStorage) QueryWithContext(ctx context.Context, params *QueryParams) (*dynamodb.QueryOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	av, err := dattr.MarshalMap(params.Values)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := memTableIndex
+	if params.Index != "" {
+		var ok bool
+		if idx, ok = s.indexes[params.Index]; !ok {
+			return nil, memValidationErr("The table does not have the specified index: %s", params.Index)
+		}
+	}
+	match, err := compileMemCond(params.Cond, nil, av)
+	if err != nil {
+		return nil, memValidationErr("Invalid KeyConditionExpression: %s", err.Error())
+	}
+	all := s.indexItems(idx)
+	if params.Desc {
+		for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+			all[i], all[j] = all[j], all[i]
+		}
+	}
+	out := &dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{}}
+	for _, item := range all {
+		if len(params.StartKey) > 0 {
+			cmp := idx.compare(item, params.StartKey)
+			if (!params.Desc && cmp <= 0) || (params.Desc && cmp >= 0) {
+				continue
+			}
+		}
+		if !match(item) {
+			continue
+		}
+		out.Items = append(out.Items, idx.project(item))
+		n := int64(len(out.Items))
+		if (params.Limit > 0 && n == params.Limit) || (s.MaxPageItems > 0 && n == s.MaxPageItems) {
+			out.LastEvaluatedKey = idx.keyOf(item)
+			break
+		}
+	}
+	out.Count = aws.Int64(int64(len(out.Items)))
+	out.ScannedCount = out.Count
+	return out, nil
+}
+
+// Scans items in PK, SK order, segment of item depends on its PK
+func (s *MemStorage) ScanWithContext(ctx context.Context, params *ScanParams) (*dynamodb.ScanOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	av, err := dattr.MarshalMap(params.Values)
+	if err != nil {
+		return nil, err
+	}
+	if params.TotalSegments > 0 && (params.Segment < 0 || params.Segment >= params.TotalSegments) {
+		return nil, memValidationErr("Segment must be less than TotalSegments")
+	}
+	match := func(memItem) bool { return true }
+	if params.Filter != "" {
+		if match, err = compileMemCond(params.Filter, params.Names, av); err != nil {
+			return nil, memValidationErr("Invalid FilterExpression: %s", err.Error())
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx := memTableIndex
+	all := s.indexItems(idx)
+	out := &dynamodb.ScanOutput{Items: []map[string]*dynamodb.AttributeValue{}}
+	var scanned int64
+	for _, item := range all {
+		if len(params.StartKey) > 0 && idx.compare(item, params.StartKey) <= 0 {
+			continue
+		}
+		if params.TotalSegments > 0 {
+			h := fnv.New32a()
+			h.Write([]byte(aws.StringValue(item["PK"].S)))
+			if int64(h.Sum32())%params.TotalSegments != params.Segment {
+				continue
+			}
+		}
+		scanned++
+		if match(item) {
+			out.Items = append(out.Items, copyMemItem(item))
+		}
+		if (params.Limit > 0 && scanned == params.Limit) || (s.MaxPageItems > 0 && scanned == s.MaxPageItems) {
+			out.LastEvaluatedKey = idx.keyOf(item)
+			break
+		}
+	}
+	out.Count = aws.Int64(int64(len(out.Items)))
+	out.ScannedCount = aws.Int64(scanned)
+	return out, nil
+}
+
+func (s *MemStorage) DeleteSubItemWithContext(ctx context.Context, pk, sk string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, memKey{PK: pk, SK: sk})
+	return nil
+}
+
+func (s *MemStorage) BatchWriteWithContext(ctx context.Context,
+	reqs []*dynamodb.WriteRequest) ([]*dynamodb.WriteRequest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 || len(reqs) > BatchWriteSize {
+		return nil, memValidationErr("Too many items requested for the BatchWriteItem call")
+	}
+	seen := make(map[memKey]bool)
+	keys := make([]memKey, len(reqs))
+	for i, r := range reqs {
+		var item memItem
+		switch {
+		case r.PutRequest != nil:
+			item = r.PutRequest.Item
+		case r.DeleteRequest != nil:
+			item = r.DeleteRequest.Key
+		default:
+			return nil, memValidationErr("WriteRequest has neither put nor delete")
+		}
+		key, err := memKeyOf(item)
+		if err != nil {
+			return nil, err
+		}
+		if seen[key] {
+			return nil, memValidationErr("Provided list of item keys contains duplicates")
+		}
+		seen[key] = true
+		keys[i] = key
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range reqs {
+		if s.MaxBatchItems > 0 && i == s.MaxBatchItems {
+			return reqs[i:], nil
+		}
+		if r.PutRequest != nil {
+			s.items[keys[i]] = copyMemItem(r.PutRequest.Item)
+		} else {
+			delete(s.items, keys[i])
+		}
+	}
+	return nil, nil
+}
+
+func (s *MemStorage) BatchGetWithContext(ctx context.Context, keys []map[string]*dynamodb.AttributeValue) (
+	items, unprocessed []map[string]*dynamodb.AttributeValue, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(keys) == 0 || len(keys) > BatchGetSize {
+		return nil, nil, memValidationErr("Too many items requested for the BatchGetItem call")
+	}
+	seen := make(map[memKey]bool)
+	mkeys := make([]memKey, len(keys))
+	for i, k := range keys {
+		key, err := memKeyOf(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[key] {
+			return nil, nil, memValidationErr("Provided list of item keys contains duplicates")
+		}
+		seen[key] = true
+		mkeys[i] = key
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, key := range mkeys {
+		if s.MaxBatchItems > 0 && i == s.MaxBatchItems {
+			return items, keys[i:], nil
+		}
+		if item, ok := s.items[key]; ok {
+			items = append(items, copyMemItem(item))
+		}
+	}
+	return items, nil, nil
+}
+
+// Removes items which TTL is in the past, like DynamoDB does in background.
+// Till then expired items are still returned by reads. Returns removed items
+func (s *MemStorage) PurgeExpired() []map[string]*dynamodb.AttributeValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := float64(s.Now().Unix())
+	var removed []map[string]*dynamodb.AttributeValue
+	for key, item := range s.items {
+		ttl := item[s.TTLAttr]
+		if ttl == nil || ttl.N == nil {
+			continue
+		}
+		expires, err := strconv.ParseFloat(*ttl.N, 64)
+		if err != nil || expires >= now {
+			continue
+		}
+		removed = append(removed, item)
+		delete(s.items, key)
+	}
+	return removed
+}
@@ -0,0 +1,188 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStorageUniq(t *testing.T) {
+	store, _ := NewMemDTable("MainTest")
+	item, _ := NewTestItem("foo", "bar")
+	require.Nil(t, store.StoreItem(item, UniqueOp()))
+	err := store.StoreItem(item, UniqueOp())
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ALREADY_EXISTS, err.Error())
+	}
+	item.Amount = 5
+	assert.Nil(t, store.StoreItem(item))
+	f := &TItem{}
+	require.Nil(t, store.FetchItem(item.PK, f))
+	assert.Equal(t, int64(5), f.Amount)
+	err = store.FetchItem("nosuch", f)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, NO_SUCH_ITEM, err.Error())
+	}
+}
+
+func TestMemStorageTrans(t *testing.T) {
+	store, _ := NewMemDTable("MainTest")
+	item1, _ := NewTestItem("foo1", "bar1")
+	item2, _ := NewTestItem("foo2", "bar2")
+	require.Nil(t, store.StoreInTransUniq(item1, item2))
+	item3, _ := NewTestItem("foo3", "bar3")
+	err := store.StoreInTransUniq(item3, item1)
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrTransactionCanceled))
+	var tcErr *TransactionCanceledError
+	if assert.True(t, errors.As(err, &tcErr)) {
+		assert.Equal(t, []string{"None", "ConditionalCheckFailed"}, tcErr.Reasons)
+		assert.True(t, tcErr.Failed(1))
+	}
+	var tce *dynamodb.TransactionCanceledException
+	assert.True(t, errors.As(err, &tce), "original error is wrapped")
+	assert.NotNil(t, store.FetchItem(item3.PK, &TItem{}), "nothing is stored on cancel")
+	assert.NotNil(t, store.StoreInTransUniq(item3, item3))
+}
+
+func TestMemStorageQueryIndex(t *testing.T) {
+	store, _ := NewMemDTable("MainTest")
+	i1, _ := NewTestItem("foo1", "bar")
+	i1.CreatedAt = 30
+	i1.Amount = 1
+	i2, _ := NewTestItem("foo2", "bar")
+	i2.CreatedAt = 10
+	i3, _ := NewTestItem("foo3", "baz")
+	i3.CreatedAt = 20
+	i4, _ := NewTestItem("foo4", "")
+	for _, i := range []*TItem{i1, i2, i3, i4} {
+		require.Nil(t, store.StoreItem(i))
+	}
+	resp, err := store.QueryIndex("UMSIndex", "UMS = :ums", map[string]interface{}{":ums": "bar"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(resp.Items))
+	assert.Equal(t, "foo2", *resp.Items[0]["PK"].S)
+	assert.Equal(t, "foo1", *resp.Items[1]["PK"].S)
+	_, projected := resp.Items[1]["AMNT"]
+	assert.False(t, projected, "only projected attributes are returned")
+
+	resp, err = store.QueryIndex("UMSIndex", "UMS = :ums and CRTD BETWEEN :start AND :end",
+		map[string]interface{}{":ums": "bar", ":start": 20, ":end": 40})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(resp.Items))
+	assert.Equal(t, "foo1", *resp.Items[0]["PK"].S)
+
+	_, err = store.QueryIndex("NoIndex", "UMS = :ums", map[string]interface{}{":ums": "bar"})
+	assert.NotNil(t, err)
+}
+
+func TestMemStorageUpdate(t *testing.T) {
+	store, _ := NewMemDTable("MainTest")
+	item, _ := NewTestItem("foo", "bar")
+	item.Data["spam"] = "egg"
+	require.Nil(t, store.StoreItem(item))
+	out, err := store.UpdateItemMap(item.PK, item.SK, "D", "url", "example.com")
+	require.Nil(t, err)
+	f := &TItem{}
+	require.Nil(t, dattr.UnmarshalMap(out.Attributes, f))
+	assert.Equal(t, "example.com", f.Data["url"])
+	_, err = store.UpdateItemMap("nosuch", "nosuch", "D", "url", "example.com")
+	assert.NotNil(t, err)
+
+	require.Nil(t, store.IncrProp("counter", "counter", "AMNT", 2))
+	require.Nil(t, store.IncrProp("counter", "counter", "AMNT", 3))
+	require.Nil(t, store.FetchItem("counter", f))
+	assert.Equal(t, int64(5), f.Amount)
+}
+
+func TestMemStorageTTL(t *testing.T) {
+	store, _ := NewMemDTable("MainTest")
+	now := time.Now()
+	mem := store.Storage.(*MemStorage)
+	mem.Now = func() time.Time { return now }
+	user, _ := NewUser("foo")
+	token, _ := NewToken(user, 1)
+	require.Nil(t, store.StoreItem(token))
+	assert.Equal(t, 0, len(mem.PurgeExpired()))
+	mem.Now = func() time.Time { return now.Add(2 * time.Hour) }
+	removed := mem.PurgeExpired()
+	require.Equal(t, 1, len(removed))
+	assert.Equal(t, token.PK, *removed[0]["PK"].S)
+	assert.NotNil(t, store.FetchItem(token.PK, &Token{}))
+}
+
+func TestMemCondExpr(t *testing.T) {
+	item := memItem{
+		"PK": {S: aws.String("foo#1")},
+		"N":  {N: aws.String("10")},
+		"D":  {M: memItem{"k": {S: aws.String("v")}}},
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":p": {S: aws.String("foo#")},
+		":n": {N: aws.String("9.5")},
+		":v": {S: aws.String("v")},
+	}
+	names := map[string]*string{"#D": aws.String("D")}
+	cases := map[string]bool{
+		"begins_with(PK, :p)":                         true,
+		"N > :n AND #D.k = :v":                        true,
+		"N < :n OR attribute_not_exists(X)":           true,
+		"NOT (attribute_exists(PK))":                  false,
+		"N IN (:n, :v)":                               false,
+		"N between :n and :n":                         false,
+		"attribute_exists(#D.k) and contains(PK, :v)": false,
+	}
+	for expr, expected := range cases {
+		cond, err := compileMemCond(expr, names, values)
+		if assert.Nil(t, err, expr) {
+			assert.Equal(t, expected, cond(item), expr)
+		}
+	}
+	_, err := compileMemCond("N = :nosuch", names, values)
+	assert.NotNil(t, err)
+}
+
+func TestMemStorageContext(t *testing.T) {
+	store, _ := NewMemDTable("MainTest")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	item, _ := NewTestItem("foo", "bar")
+	err := store.StoreItemWithContext(ctx, item)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, errors.Is(store.FetchItem(item.PK, item), ErrNotFound))
+}
+
+func TestMemStorageScan(t *testing.T) {
+	store, _ := NewMemDTable("MainTest")
+	store.Storage.(*MemStorage).MaxPageItems = 3
+	for _, id := range []string{"foo1", "foo2", "bar1", "foo3", "bar2"} {
+		item, _ := NewTestItem(id, "")
+		require.Nil(t, store.StoreItem(item))
+	}
+	var pks []string
+	params := ScanParams{Filter: "begins_with(PK, :p)", Values: map[string]interface{}{":p": "foo"}}
+	err := store.ScanPagesWithContext(context.Background(), params,
+		func(items []map[string]*dynamodb.AttributeValue) error {
+			for _, item := range items {
+				pks = append(pks, *item["PK"].S)
+			}
+			return nil
+		})
+	require.Nil(t, err)
+	assert.ElementsMatch(t, []string{"foo1", "foo2", "foo3"}, pks)
+
+	total := 0
+	for seg := int64(0); seg < 3; seg++ {
+		resp, err := store.Scan(&ScanParams{Segment: seg, TotalSegments: 3})
+		require.Nil(t, err)
+		total += int(*resp.ScannedCount)
+	}
+	assert.Equal(t, 5, total, "segments do not overlap")
+}
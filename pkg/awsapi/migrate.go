@@ -0,0 +1,269 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const MigrationKeyPrefix = "migration#"
+
+// One step of schema evolution. Up must be idempotent, it is run
+// again if the migration failed to be recorded as applied.
+// Check, if set, tells what is still left for the migration to do,
+// like items written by old code after it was applied
+type Migration struct {
+	ID    string // migrations are applied in the order of IDs
+	Title string
+	Up    func(ctx context.Context, m *Migrator) error
+	Check func(ctx context.Context, m *Migrator) error
+}
+
+// Keeps IDs of applied migrations with the time they were applied
+type MigrationLog struct {
+	PK      string
+	SK      string
+	Applied map[string]int64 `dynamodbav:"D"`
+	Version int64            `dynamodbav:"V,omitempty"`
+}
+
+type MigrationStatus struct {
+	ID        string
+	Title     string
+	AppliedAt int64 // 0 if migration is pending
+}
+
+// Applies migrations to the table, with DryRun it only reports
+// what would be done
+type Migrator struct {
+	Table      *DTable
+	DryRun     bool
+	Out        io.Writer
+	Migrations []*Migration
+}
+
+func NewMigrator(table *DTable, out io.Writer) *Migrator {
+	return &Migrator{Table: table, Out: out, Migrations: Migrations}
+}
+
+func (m *Migrator) sorted() []*Migration {
+	out := make([]*Migration, len(m.Migrations))
+	copy(out, m.Migrations)
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (m *Migrator) fetchLog(ctx context.Context) (*MigrationLog, error) {
+	log := &MigrationLog{}
+	err := m.Table.FetchItemWithContext(ctx, MigrationKeyPrefix, log)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	log.PK = MigrationKeyPrefix
+	log.SK = MigrationKeyPrefix
+	if log.Applied == nil {
+		log.Applied = make(map[string]int64)
+	}
+	return log, nil
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationStatus, error) {
+	log, err := m.fetchLog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []*MigrationStatus
+	for _, mig := range m.sorted() {
+		out = append(out, &MigrationStatus{ID: mig.ID, Title: mig.Title, AppliedAt: log.Applied[mig.ID]})
+	}
+	return out, nil
+}
+
+// Applies pending migrations in order, stops at the first failed one.
+// Returns migrations that were applied
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	log, err := m.fetchLog(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var applied []*Migration
+	for _, mig := range m.sorted() {
+		if _, ok := log.Applied[mig.ID]; ok {
+			continue
+		}
+		if m.DryRun {
+			m.printf("Would apply %s %s\n", mig.ID, mig.Title)
+		} else {
+			m.printf("Applying %s %s\n", mig.ID, mig.Title)
+		}
+		if err := mig.Up(ctx, m); err != nil {
+			return applied, fmt.Errorf("Migration %s failed: %w", mig.ID, err)
+		}
+		if !m.DryRun {
+			if err := m.record(ctx, log, mig.ID); err != nil {
+				return applied, err
+			}
+		}
+		applied = append(applied, mig)
+	}
+	return applied, nil
+}
+
+// Returns error if any migration is pending or its Check fails,
+// so deploy stops before code that needs them runs
+func (m *Migrator) Check(ctx context.Context) error {
+	log, err := m.fetchLog(ctx)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	for _, mig := range m.sorted() {
+		if _, ok := log.Applied[mig.ID]; !ok {
+			pending = append(pending, mig.ID)
+			continue
+		}
+		if mig.Check == nil {
+			continue
+		}
+		if err := mig.Check(ctx, m); err != nil {
+			return fmt.Errorf("Migration %s: %w", mig.ID, err)
+		}
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("Migrations %s are pending", strings.Join(pending, ", "))
+	}
+	return nil
+}
+
+func (m *Migrator) record(ctx context.Context, log *MigrationLog, id string) error {
+	version := log.Version
+	log.Applied[id] = time.Now().Unix()
+	log.Version = version + 1
+	err := m.Table.StoreItemWithContext(ctx, log, VersionOp(version))
+	if err != nil {
+		delete(log.Applied, id)
+		log.Version = version
+	}
+	return versionConflictErr(err)
+}
+
+func (m *Migrator) printf(format string, args ...interface{}) {
+	if m.Out != nil {
+		fmt.Fprintf(m.Out, format, args...)
+	}
+}
+
+func prefixScanParams(pkPrefix, skPrefix string) ScanParams {
+	var conds []string
+	values := make(map[string]interface{})
+	if pkPrefix != "" {
+		conds = append(conds, "begins_with(PK, :pk)")
+		values[":pk"] = pkPrefix
+	}
+	if skPrefix != "" {
+		conds = append(conds, "begins_with(SK, :sk)")
+		values[":sk"] = skPrefix
+	}
+	return ScanParams{Filter: strings.Join(conds, " AND "), Values: values}
+}
+
+// Calls fn for every item which PK and SK start with given prefixes,
+// items fn returns true for are stored back. fn must not change keys.
+// Returns how many items were changed
+func (m *Migrator) RewriteItems(ctx context.Context, pkPrefix, skPrefix string,
+	fn func(item map[string]*dynamodb.AttributeValue) bool) (int, error) {
+	changed := 0
+	params := prefixScanParams(pkPrefix, skPrefix)
+	err := m.Table.ScanPagesWithContext(ctx, params, func(items []map[string]*dynamodb.AttributeValue) error {
+		var reqs []*dynamodb.WriteRequest
+		for _, item := range items {
+			key, err := itemKeyOf(item)
+			if err != nil {
+				return err
+			}
+			if !fn(item) {
+				continue
+			}
+			if newKey, err := itemKeyOf(item); err != nil || newKey != key {
+				return fmt.Errorf("Rewrite changed key of %s %s", key.PK, key.SK)
+			}
+			reqs = append(reqs, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: item}})
+		}
+		changed += len(reqs)
+		if m.DryRun || len(reqs) == 0 {
+			return nil
+		}
+		errs := make([]error, len(reqs))
+		m.Table.batchWrite(ctx, reqs, errs)
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if m.DryRun {
+		m.printf("  %d items with prefix %q %q would be changed\n", changed, pkPrefix, skPrefix)
+	}
+	return changed, err
+}
+
+// Calls fn for every item which PK and SK start with given prefixes,
+// with DryRun fn is not called and items are only counted
+func (m *Migrator) EachItem(ctx context.Context, pkPrefix, skPrefix string,
+	fn func(item map[string]*dynamodb.AttributeValue) error) (int, error) {
+	count := 0
+	params := prefixScanParams(pkPrefix, skPrefix)
+	err := m.Table.ScanPagesWithContext(ctx, params, func(items []map[string]*dynamodb.AttributeValue) error {
+		count += len(items)
+		if m.DryRun {
+			return nil
+		}
+		for _, item := range items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if m.DryRun {
+		m.printf("  %d items with prefix %q %q would be processed\n", count, pkPrefix, skPrefix)
+	}
+	return count, err
+}
+
+// Adds GSI unless the table has it, attrs define its key attributes
+func (m *Migrator) AddIndex(ctx context.Context, gsi *dynamodb.GlobalSecondaryIndex,
+	attrs ...*dynamodb.AttributeDefinition) error {
+	if m.DryRun {
+		m.printf("  index %s would be added\n", *gsi.IndexName)
+		return nil
+	}
+	return m.Table.AddIndexWithContext(ctx, gsi, attrs)
+}
+
+// Rewrite function for RewriteItems, moves values of attributes to new
+// names. Items that have new name already are left as they are
+func RenameAttrs(names map[string]string) func(item map[string]*dynamodb.AttributeValue) bool {
+	return func(item map[string]*dynamodb.AttributeValue) bool {
+		changed := false
+		for from, to := range names {
+			v, ok := item[from]
+			if !ok {
+				continue
+			}
+			if _, exists := item[to]; !exists {
+				item[to] = v
+			}
+			delete(item, from)
+			changed = true
+		}
+		return changed
+	}
+}
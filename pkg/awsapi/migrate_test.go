@@ -0,0 +1,136 @@
+package awsapi
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// WSConn as it was stored before migration 0001
+type legacyWSConn struct {
+	PK         string
+	SK         string
+	TTL        int64
+	DomainName string
+	Stage      string
+	CreatedAt  int64
+}
+
+func TestMigrateWSConn(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	ctx := context.Background()
+	user, _ := NewUser("user1")
+	legacy := &legacyWSConn{PK: user.PK, SK: WSConnKeyPrefix + "someid=",
+		DomainName: "foobar.com", Stage: "prod", CreatedAt: 1598515792}
+	require.Nil(t, table.StoreItem(legacy))
+	fresh, _ := NewWSConn(user.PK, "otherid=", "example.com", "dev")
+	require.Nil(t, table.StoreItem(fresh))
+
+	out := &bytes.Buffer{}
+	m := NewMigrator(table, out)
+	m.DryRun = true
+	applied, err := m.Up(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, len(Migrations), len(applied))
+	assert.Contains(t, out.String(), "1 items")
+	conn := &WSConn{}
+	require.Nil(t, table.FetchSubItem(legacy.PK, legacy.SK, conn))
+	assert.Equal(t, "", conn.DomainName, "dry run changes nothing")
+
+	m.DryRun = false
+	applied, err = m.Up(ctx)
+	require.Nil(t, err)
+	require.Equal(t, len(Migrations), len(applied))
+	require.Nil(t, table.FetchSubItem(legacy.PK, legacy.SK, conn))
+	assert.Equal(t, "https://foobar.com/prod", conn.Endpoint())
+	assert.Equal(t, int64(1598515792), conn.CreatedAt)
+	require.Nil(t, table.FetchSubItem(fresh.PK, fresh.SK, conn))
+	assert.Equal(t, "https://example.com/dev", conn.Endpoint())
+
+	status, err := m.Status(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, "0001", status[0].ID)
+	assert.NotEqual(t, int64(0), status[0].AppliedAt)
+	applied, err = m.Up(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(applied))
+}
+
+func TestMigrateAddIndex(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	ctx := context.Background()
+	gsi := &dynamodb.GlobalSecondaryIndex{
+		IndexName: aws.String("FooIndex"),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("FOO"), KeyType: aws.String("HASH")},
+		},
+		Projection: &dynamodb.Projection{ProjectionType: aws.String("KEYS_ONLY")},
+	}
+	m := NewMigrator(table, nil)
+	m.Migrations = []*Migration{
+		{ID: "0002", Title: "second", Up: func(ctx context.Context, m *Migrator) error {
+			return m.AddIndex(ctx, gsi, &dynamodb.AttributeDefinition{
+				AttributeName: aws.String("FOO"), AttributeType: aws.String("S")})
+		}},
+		{ID: "0001", Title: "first", Up: func(ctx context.Context, m *Migrator) error { return nil }},
+	}
+	applied, err := m.Up(ctx)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(applied))
+	assert.Equal(t, "0001", applied[0].ID)
+	_, err = table.QueryIndex("FooIndex", "FOO = :foo", map[string]interface{}{":foo": "bar"})
+	assert.Nil(t, err)
+}
+
+func TestMigrateSearchIndex(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	msg, _ := NewMsg("bot1", "user#foo", TGTextMsgKind, DataOp(map[string]interface{}{"text": "old note"}))
+	require.Nil(t, table.StoreItem(msg))
+	m := NewMigrator(table, nil)
+	_, err := m.Up(context.Background())
+	require.Nil(t, err)
+	results, err := table.Search("user#foo", "notes", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, msg.PK, results[0].Msg.PK)
+}
+
+func TestMigrateBotWebhookToken(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	ctx := context.Background()
+	legacy, _ := NewBot(TGBotKind, "oldbot")
+	fresh, _ := NewBot(TGBotKind, "newbot")
+	fresh.WebhookToken = "sometoken"
+	dummy, _ := NewBot(DummyBotKind, "dummybot")
+	for _, err := range table.StoreItems(legacy, fresh, dummy) {
+		require.Nil(t, err)
+	}
+	m := NewMigrator(table, nil)
+	err := m.Check(ctx)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "pending")
+
+	_, err = m.Up(ctx)
+	require.Nil(t, err)
+	require.Nil(t, m.Check(ctx))
+	bot := &Bot{}
+	require.Nil(t, table.FetchTGBotWithContext(ctx, "oldbot", bot))
+	assert.Equal(t, 64, len(bot.WebhookToken))
+	require.Nil(t, table.FetchTGBotWithContext(ctx, "newbot", bot))
+	assert.Equal(t, "sometoken", bot.WebhookToken)
+	other := &Bot{}
+	require.Nil(t, table.FetchItem(dummy.PK, other))
+	assert.Equal(t, "", other.WebhookToken)
+
+	// bot stored without token by old code after migration
+	require.Nil(t, table.StoreItem(legacy))
+	err = m.Check(ctx)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "oldbot")
+}
@@ -0,0 +1,114 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// All migrations of the table, new ones are added to the end
+var Migrations = []*Migration{
+	{
+		ID:    "0001",
+		Title: "Store WSConn fields under short attribute names",
+		Up: func(ctx context.Context, m *Migrator) error {
+			_, err := m.RewriteItems(ctx, UserKeyPrefix, WSConnKeyPrefix, RenameAttrs(map[string]string{
+				"DomainName": "D",
+				"Stage":      "S",
+				"CreatedAt":  "CRTD",
+			}))
+			return err
+		},
+	},
+	{
+		ID:    "0002",
+		Title: "Build search index for existing Msgs",
+		Up: func(ctx context.Context, m *Migrator) error {
+			_, err := m.EachItem(ctx, MsgKeyPrefix, MsgKeyPrefix, func(item map[string]*dynamodb.AttributeValue) error {
+				msg := &Msg{}
+				if err := dattr.UnmarshalMap(item, msg); err != nil {
+					return err
+				}
+				return m.Table.IndexMsgWithContext(ctx, msg)
+			})
+			return err
+		},
+	},
+	{
+		ID:    "0003",
+		Title: "Add TaskIndex",
+		Up: func(ctx context.Context, m *Migrator) error {
+			gsi, attrs := tableIndex(TaskIndexName)
+			return m.AddIndex(ctx, gsi, attrs...)
+		},
+	},
+	{
+		// webhook rejects updates for bots without token
+		ID:    "0004",
+		Title: "Generate webhook token for Telegram bots",
+		Up: func(ctx context.Context, m *Migrator) error {
+			_, err := m.EachItem(ctx, BotKeyPrefix, BotKeyPrefix, func(item map[string]*dynamodb.AttributeValue) error {
+				bot := &Bot{}
+				if err := dattr.UnmarshalMap(item, bot); err != nil {
+					return err
+				}
+				if bot.Kind != TGBotKind || bot.WebhookToken != "" {
+					return nil
+				}
+				token, err := NewWebhookToken()
+				if err != nil {
+					return err
+				}
+				bot.WebhookToken = token
+				m.printf("  %s got webhook token, run tgbot rotate-token --url to set webhook with it\n", bot.Name)
+				return m.Table.StoreItemWithContext(ctx, bot)
+			})
+			return err
+		},
+		Check: func(ctx context.Context, m *Migrator) error {
+			var names []string
+			params := prefixScanParams(BotKeyPrefix, BotKeyPrefix)
+			err := m.Table.ScanPagesWithContext(ctx, params, func(items []map[string]*dynamodb.AttributeValue) error {
+				for _, item := range items {
+					bot := &Bot{}
+					if err := dattr.UnmarshalMap(item, bot); err != nil {
+						return err
+					}
+					if bot.Kind == TGBotKind && bot.WebhookToken == "" {
+						names = append(names, bot.Name)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(names) > 0 {
+				return fmt.Errorf("Telegram bots %s have no webhook token", strings.Join(names, ", "))
+			}
+			return nil
+		},
+	},
+}
+
+// Returns GSI of table definition with attributes its keys need
+func tableIndex(name string) (*dynamodb.GlobalSecondaryIndex, []*dynamodb.AttributeDefinition) {
+	for _, gsi := range createTableInput.GlobalSecondaryIndexes {
+		if *gsi.IndexName != name {
+			continue
+		}
+		var attrs []*dynamodb.AttributeDefinition
+		for _, ks := range gsi.KeySchema {
+			for _, attr := range createTableInput.AttributeDefinitions {
+				if *attr.AttributeName == *ks.AttributeName {
+					attrs = append(attrs, attr)
+				}
+			}
+		}
+		return gsi, attrs
+	}
+	return nil, nil
+}
@@ -0,0 +1,179 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const MALFORMED_CURSOR = "Malformed cursor"
+
+// Options for fetching one page of items
+type PageOpts struct {
+	Limit  int64  // max amount of items, 0 fetches everything
+	Cursor string // where previous page stopped, empty for the first page
+	Desc   bool
+}
+
+// Makes opaque cursor from LastEvaluatedKey, empty key gives empty cursor
+func EncodeCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	plain := make(map[string]map[string]string)
+	for name, av := range key {
+		switch {
+		case av.S != nil:
+			plain[name] = map[string]string{"S": *av.S}
+		case av.N != nil:
+			plain[name] = map[string]string{"N": *av.N}
+		case av.B != nil:
+			plain[name] = map[string]string{"B": base64.StdEncoding.EncodeToString(av.B)}
+		default:
+			return "", fmt.Errorf("Key attribute %s has unsupported type", name)
+		}
+	}
+	b, err := json.Marshal(plain)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Restores LastEvaluatedKey from cursor made by EncodeCursor
+func DecodeCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New(MALFORMED_CURSOR)
+	}
+	plain := make(map[string]map[string]string)
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return nil, errors.New(MALFORMED_CURSOR)
+	}
+	key := make(map[string]*dynamodb.AttributeValue)
+	for name, typed := range plain {
+		if len(typed) != 1 {
+			return nil, errors.New(MALFORMED_CURSOR)
+		}
+		av := &dynamodb.AttributeValue{}
+		for kind, v := range typed {
+			switch kind {
+			case "S":
+				av.S = aws.String(v)
+			case "N":
+				av.N = aws.String(v)
+			case "B":
+				if av.B, err = base64.StdEncoding.DecodeString(v); err != nil {
+					return nil, errors.New(MALFORMED_CURSOR)
+				}
+			default:
+				return nil, errors.New(MALFORMED_CURSOR)
+			}
+		}
+		key[name] = av
+	}
+	return key, nil
+}
+
+// Fetches up to params.Limit items starting from cursor, follows
+// LastEvaluatedKey when DynamoDB returns less than asked.
+// With no Limit all items are fetched.
+// Returns cursor for the next page, it is empty if nothing is left
+func (t *DTable) QueryPage(params QueryParams, cursor string) (
+	[]map[string]*dynamodb.AttributeValue, string, error) {
+	return t.QueryPageWithContext(context.Background(), params, cursor)
+}
+
+func (t *DTable) QueryPageWithContext(ctx context.Context, params QueryParams, cursor string) (
+	[]map[string]*dynamodb.AttributeValue, string, error) {
+	startKey, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	items, lastKey, err := t.queryPages(ctx, params, startKey)
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := EncodeCursor(lastKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return items, next, nil
+}
+
+func (t *DTable) queryPages(ctx context.Context, params QueryParams, startKey map[string]*dynamodb.AttributeValue) (
+	[]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	limit := params.Limit
+	for {
+		params.StartKey = startKey
+		if limit > 0 {
+			params.Limit = limit - int64(len(items))
+		}
+		resp, err := t.QueryWithContext(ctx, &params)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, resp.Items...)
+		startKey = resp.LastEvaluatedKey
+		if len(startKey) == 0 || (limit > 0 && int64(len(items)) >= limit) {
+			break
+		}
+	}
+	return items, startKey, nil
+}
+
+// Paginated version of FetchItemsWithPrefix, returns cursor for the next page
+func (t *DTable) FetchItemsWithPrefixPage(pk, prefix string, page PageOpts, out interface{}) (string, error) {
+	return t.FetchItemsWithPrefixPageWithContext(context.Background(), pk, prefix, page, out)
+}
+
+func (t *DTable) FetchItemsWithPrefixPageWithContext(ctx context.Context,
+	pk, prefix string, page PageOpts, out interface{}) (string, error) {
+	params := QueryParams{
+		Cond:   "PK = :pk AND begins_with(SK, :prefix)",
+		Values: map[string]interface{}{":pk": pk, ":prefix": prefix},
+		Limit:  page.Limit,
+		Desc:   page.Desc,
+	}
+	items, next, err := t.QueryPageWithContext(ctx, params, page.Cursor)
+	if err != nil {
+		return "", err
+	}
+	if len(items) > 0 {
+		if err := dattr.UnmarshalListOfMaps(items, out); err != nil {
+			return "", err
+		}
+	}
+	return next, nil
+}
+
+// Scans table page by page calling fn for every page till nothing
+// is left or fn returns error
+func (t *DTable) ScanPagesWithContext(ctx context.Context, params ScanParams,
+	fn func(items []map[string]*dynamodb.AttributeValue) error) error {
+	for {
+		resp, err := t.ScanWithContext(ctx, &params)
+		if err != nil {
+			return err
+		}
+		if len(resp.Items) > 0 {
+			if err := fn(resp.Items); err != nil {
+				return err
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		params.StartKey = resp.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,86 @@
+package awsapi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	key := map[string]*dynamodb.AttributeValue{
+		"PK":   {S: aws.String("msg#foo")},
+		"CRTD": {N: aws.String("1598515792")},
+	}
+	cursor, err := EncodeCursor(key)
+	require.Nil(t, err)
+	decoded, err := DecodeCursor(cursor)
+	require.Nil(t, err)
+	assert.Equal(t, key, decoded)
+	empty, err := EncodeCursor(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", empty)
+	_, err = DecodeCursor("foo")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, MALFORMED_CURSOR, err.Error())
+	}
+}
+
+func TestFetchItemsWithPrefixPage(t *testing.T) {
+	defer stopLocalDynamo()
+	table := startLocalDynamo(t)
+	for i := 0; i < 5; i++ {
+		item, _ := NewSubItem("someid", fmt.Sprintf("foo#%d", i))
+		require.Nil(t, table.StoreItem(item))
+	}
+	var page1, page2, page3 []TItem
+	cursor, err := table.FetchItemsWithPrefixPage("someid", "foo#", PageOpts{Limit: 2}, &page1)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(page1))
+	assert.Equal(t, "foo#1", page1[1].SK)
+	cursor, err = table.FetchItemsWithPrefixPage("someid", "foo#", PageOpts{Limit: 2, Cursor: cursor}, &page2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(page2))
+	assert.Equal(t, "foo#2", page2[0].SK)
+	cursor, err = table.FetchItemsWithPrefixPage("someid", "foo#", PageOpts{Limit: 2, Cursor: cursor}, &page3)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(page3))
+	assert.Equal(t, "", cursor)
+}
+
+func TestMsgListPages(t *testing.T) {
+	mem := NewMemStorage()
+	mem.MaxPageItems = 2
+	table, _ := NewDTable("MainTest")
+	table.Storage = mem
+	user, _ := NewUser("user1")
+	var msgs []*Msg
+	for i := 1; i <= 5; i++ {
+		msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind, CreatedAtOp(fmt.Sprintf("-%dd", i)))
+		require.Nil(t, table.StoreItem(msg))
+		msgs = append(msgs, msg)
+	}
+	ums := fmt.Sprintf("%s#0", user.PK)
+
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchByUserStatus(table, user.PK, 0, "-10d", "now"))
+	assert.Equal(t, 5, lm.Len(), "should follow LastEvaluatedKey")
+	assert.Equal(t, "", lm.Cursor())
+
+	lm = NewListMsg()
+	page := PageOpts{Limit: 3, Desc: true}
+	require.Nil(t, lm.FetchByUMSPage(table, user.PK, ums, 0, msgs[0].CreatedAt+1, page))
+	require.Equal(t, 3, lm.Len())
+	assert.Equal(t, msgs[0].PK, lm.Desc()[0].PK)
+	assert.Equal(t, msgs[2].PK, lm.Desc()[2].PK)
+	require.NotEqual(t, "", lm.Cursor())
+
+	page.Cursor = lm.Cursor()
+	lm = NewListMsg()
+	require.Nil(t, lm.FetchByUMSPage(table, user.PK, ums, 0, msgs[0].CreatedAt+1, page))
+	require.Equal(t, 2, lm.Len())
+	assert.Equal(t, msgs[3].PK, lm.Desc()[0].PK)
+}
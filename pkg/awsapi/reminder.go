@@ -0,0 +1,401 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const (
+	ScheduleKeyPrefix = "sched#"
+	MsgDueKey         = "due#"
+	WRONG_DUE_TIME    = "Could not parse due time"
+
+	SnoozeBtnUnique = "snooze"
+	DoneBtnUnique   = "done"
+)
+
+var (
+	// Schedule index keeps Msgs due within the same bucket under one PK
+	ScheduleBucket = time.Hour
+	// How far back scheduler looks for reminders it has not sent yet
+	ScheduleLookback = 24 * time.Hour
+	// How long Snooze button postpones reminder for
+	ReminderSnooze = time.Hour
+	// Location of users who have not set time zone, see User.Location
+	ReminderLocation = time.UTC
+)
+
+var (
+	REMIND_REGEXP  = regexp.MustCompile(`(?im)(?:^|\s)remind(?:\s+me)?\s+(.+)$`)
+	dueInRegexp    = regexp.MustCompile(`(?i)^in\s+(\d+)\s*(m|mins?|minutes?|h|hours?|d|days?)\b`)
+	dueDayRegexp   = regexp.MustCompile(`(?i)^(today|tomorrow)(?:\s+(?:at\s+)?(\d{1,2}):(\d{2}))?\b`)
+	dueClockRegexp = regexp.MustCompile(`(?i)^(?:at\s+)?(\d{1,2}):(\d{2})\b`)
+	defaultDueHour = 9
+)
+
+// Parses when to remind, it understands "in 2 hours", "in 30 min",
+// "tomorrow 9:00", "today 18:30", "18:30" and what StrToTime does.
+// Times of day are in location of now, so pass now in the user's one.
+// Returns error if time can not be parsed or it is not after now
+func ParseDueTime(expr string, now time.Time) (time.Time, error) {
+	expr = strings.TrimSpace(expr)
+	var due time.Time
+	if m := dueInRegexp.FindStringSubmatch(expr); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		unit := time.Minute
+		switch strings.ToLower(m[2])[0] {
+		case 'h':
+			unit = time.Hour
+		case 'd':
+			unit = 24 * time.Hour
+		}
+		due = now.Add(time.Duration(n) * unit)
+	} else if m := dueDayRegexp.FindStringSubmatch(expr); m != nil {
+		hour, min := defaultDueHour, 0
+		if m[2] != "" {
+			hour, _ = strconv.Atoi(m[2])
+			min, _ = strconv.Atoi(m[3])
+		}
+		day := now
+		if strings.ToLower(m[1]) == "tomorrow" {
+			day = now.AddDate(0, 0, 1)
+		}
+		due = time.Date(day.Year(), day.Month(), day.Day(), hour, min, 0, 0, now.Location())
+	} else if m := dueClockRegexp.FindStringSubmatch(expr); m != nil {
+		hour, _ := strconv.Atoi(m[1])
+		min, _ := strconv.Atoi(m[2])
+		due = time.Date(now.Year(), now.Month(), now.Day(), hour, min, 0, 0, now.Location())
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 1)
+		}
+	} else if fields := strings.Fields(expr); len(fields) > 0 {
+		var err error
+		if due, err = StrToTime(fields[0]); err != nil {
+			return time.Time{}, errors.New(WRONG_DUE_TIME)
+		}
+	}
+	if !due.After(now) {
+		return time.Time{}, errors.New(WRONG_DUE_TIME)
+	}
+	return due, nil
+}
+
+// Looks for "remind <when>" in text, returns zero time if there is none
+func ExtractDueTime(text string, now time.Time) time.Time {
+	for _, m := range REMIND_REGEXP.FindAllStringSubmatch(text, -1) {
+		if due, err := ParseDueTime(m[1], now); err == nil {
+			return due
+		}
+	}
+	return time.Time{}
+}
+
+// Entry of schedule index, PK is sched#<start of the bucket>, SK is PK of Msg
+type ScheduleItem struct {
+	PK        string
+	SK        string
+	UMS       string `dynamodbav:"U"`
+	ChannelPK string `dynamodbav:"Ch"`
+	DueAt     int64  `dynamodbav:"DUE"`
+}
+
+// Sub item of Msg with schedule index entry it has
+type MsgDue struct {
+	PK         string
+	SK         string
+	SchedulePK string `dynamodbav:"S"`
+	DueAt      int64  `dynamodbav:"DUE"`
+}
+
+func schedulePK(ts int64) string {
+	bucket := int64(ScheduleBucket.Seconds())
+	return fmt.Sprintf("%s%d", ScheduleKeyPrefix, ts-ts%bucket)
+}
+
+// Updates schedule index entry of Msg, it is called from HandleDBEvent
+func (t *DTable) IndexMsgDueWithContext(ctx context.Context, msg *Msg) error {
+	old := &MsgDue{}
+	err := t.FetchSubItemWithContext(ctx, msg.PK, MsgDueKey, old)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if old.DueAt == msg.DueAt {
+		return nil
+	}
+	if old.SchedulePK != "" {
+		if err := t.DeleteSubItemWithContext(ctx, old.SchedulePK, msg.PK); err != nil {
+			return err
+		}
+	}
+	if msg.DueAt == 0 {
+		return t.DeleteSubItemWithContext(ctx, msg.PK, MsgDueKey)
+	}
+	pk := schedulePK(msg.DueAt)
+	errs := t.BatchStoreWithContext(ctx,
+		&ScheduleItem{PK: pk, SK: msg.PK, UMS: msg.UMS.String(), ChannelPK: msg.ChannelPK, DueAt: msg.DueAt},
+		&MsgDue{PK: msg.PK, SK: MsgDueKey, SchedulePK: pk, DueAt: msg.DueAt})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes schedule index entry of removed Msg
+func (t *DTable) UnindexMsgDueWithContext(ctx context.Context, pk string) error {
+	old := &MsgDue{}
+	err := t.FetchSubItemWithContext(ctx, pk, MsgDueKey, old)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, err := range t.BatchDeleteWithContext(ctx,
+		ItemKey{PK: old.SchedulePK, SK: pk}, ItemKey{PK: pk, SK: MsgDueKey}) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns schedule entries due at or before now, one query per bucket
+// within ScheduleLookback
+func (t *DTable) FetchDue(now time.Time) ([]*ScheduleItem, error) {
+	return t.FetchDueWithContext(context.Background(), now)
+}
+
+func (t *DTable) FetchDueWithContext(ctx context.Context, now time.Time) ([]*ScheduleItem, error) {
+	var out []*ScheduleItem
+	bucket := int64(ScheduleBucket.Seconds())
+	end := now.Unix()
+	for ts := end - int64(ScheduleLookback.Seconds()); ts-ts%bucket <= end; ts += bucket {
+		var items []*ScheduleItem
+		err := t.FetchItemsWithPrefixWithContext(ctx, schedulePK(ts), MsgKeyPrefix, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			if item.DueAt <= end {
+				out = append(out, item)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Inline keyboard sent along with reminder
+func ReminderMarkup(msg *Msg) *tb.ReplyMarkup {
+	id := strings.TrimPrefix(msg.PK, MsgKeyPrefix)
+	return &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{{
+		{Unique: SnoozeBtnUnique, Text: fmt.Sprintf("Snooze %s", shortDuration(ReminderSnooze)), Data: id},
+		{Unique: DoneBtnUnique, Text: "Done", Data: id},
+	}}}
+}
+
+func shortDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
+
+// Text of Msg or recognized text of it, cut to max letters
+func msgSummary(msg *Msg, max int) string {
+	text := ""
+	if msg.Data != nil {
+		text, _ = msg.Data["text"].(string)
+		if text == "" {
+			text, _ = msg.Data[RecognizedTextFieldName].(string)
+		}
+	}
+	if utf8.RuneCountInString(text) > max {
+		text = string([]rune(text)[:max]) + "..."
+	}
+	return text
+}
+
+// Text of reminder, it starts with text of Msg
+func reminderText(msg *Msg) string {
+	text := msgSummary(msg, 200)
+	if text == "" {
+		return "Reminder"
+	}
+	return "Reminder: " + text
+}
+
+// Sets due time of Msg retrying on concurrent change, due 0 clears it.
+// Returns updated Msg
+func (t *DTable) SetMsgDueWithContext(ctx context.Context, pk, userPK string, due int64) (*Msg, error) {
+	var msg *Msg
+	var err error
+	for attempt := 1; ; attempt++ {
+		msg = &Msg{}
+		if err = t.FetchItemWithContext(ctx, pk, msg); err != nil {
+			return nil, err
+		}
+		if userPK != "" && msg.UMS.PK != userPK {
+			return nil, errors.New("Permission denied")
+		}
+		if msg.DueAt == due {
+			return msg, nil
+		}
+		msg.DueAt = due
+		err = t.StoreMsgIfVersionWithContext(ctx, msg, msg.Version)
+		if err == nil || attempt == msgUpdateAttempts || !errors.Is(err, ErrVersionConflict) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (t *DTable) reminderBotWithContext(ctx context.Context, msg *Msg, user *User) (*Bot, error) {
+	bot := &Bot{}
+	err := t.FetchItemWithContext(ctx, msg.ChannelPK, bot)
+	if err == nil || !errors.Is(err, ErrNotFound) || len(user.Bots) == 0 {
+		return bot, err
+	}
+	return bot, t.FetchItemWithContext(ctx, user.Bots[0], bot)
+}
+
+// Sends reminders for Msgs due at or before now and clears due time of them.
+// Returns how many reminders were sent
+func (t *DTable) SendDueReminders(now time.Time) (int, error) {
+	return t.SendDueRemindersWithContext(context.Background(), now)
+}
+
+func (t *DTable) SendDueRemindersWithContext(ctx context.Context, now time.Time) (int, error) {
+	items, err := t.FetchDueWithContext(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, item := range items {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+		msg := &Msg{}
+		err := t.FetchItemWithContext(ctx, item.SK, msg)
+		if errors.Is(err, ErrNotFound) {
+			_ = t.DeleteSubItemWithContext(ctx, item.PK, item.SK)
+			continue
+		}
+		if err != nil {
+			return sent, err
+		}
+		// stale entry, due time was changed or cleared since
+		if msg.DueAt != item.DueAt || msg.TrashedAt != 0 {
+			if msg.TrashedAt != 0 {
+				msg, err = t.SetMsgDueWithContext(ctx, msg.PK, "", 0)
+				if err != nil {
+					return sent, err
+				}
+			}
+			if err := t.IndexMsgDueWithContext(ctx, msg); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		user := &User{}
+		if err := t.FetchItemWithContext(ctx, msg.UMS.PK, user); err != nil {
+			return sent, err
+		}
+		bot, err := t.reminderBotWithContext(ctx, msg, user)
+		if err != nil {
+			return sent, err
+		}
+		if err := BotSendText(t, bot, user, reminderText(msg), ReminderMarkup(msg)); err != nil {
+			fmt.Println("ERROR sending reminder", msg.PK, err.Error())
+			continue
+		}
+		sent++
+		msg, err = t.SetMsgDueWithContext(ctx, msg.PK, "", 0)
+		if err != nil {
+			return sent, err
+		}
+		if err := t.IndexMsgDueWithContext(ctx, msg); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Splits data of callback button made by telebot, "\f<unique>|<data>"
+func parseCallbackData(data string) (string, string) {
+	data = strings.TrimPrefix(data, "\f")
+	parts := strings.SplitN(data, "|", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// Handles Snooze and Done buttons of reminder, returns text to show
+// to the user
+func handleTGReminderCallback(ctx context.Context, table *DTable, user *User, unique, id string) (string, error) {
+	pk := MsgKeyPrefix + id
+	due := int64(0)
+	resp := "Done"
+	if unique == SnoozeBtnUnique {
+		due = time.Now().Add(ReminderSnooze).Unix()
+		resp = fmt.Sprintf("Snoozed for %s", shortDuration(ReminderSnooze))
+	}
+	_, err := table.SetMsgDueWithContext(ctx, pk, user.PK, due)
+	if errors.Is(err, ErrNotFound) {
+		return "Message is not found", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp, nil
+}
+
+// Handles button pressed under message bot sent
+func handleTGCallback(ctx context.Context, bot *Bot, table *DTable, cb *tb.Callback) (*TGReply, error) {
+	if cb.Sender == nil {
+		return nil, nil
+	}
+	tgacc := &TGAcc{}
+	err := table.FetchTGAccWithContext(ctx, cb.Sender.ID, tgacc)
+	if errors.Is(err, ErrNotFound) {
+		return textReply(NEED_CODE, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	user := &User{}
+	if err = table.FetchItemWithContext(ctx, tgacc.OwnerPK, user); err != nil {
+		return nil, err
+	}
+	unique, data := parseCallbackData(cb.Data)
+	switch unique {
+	case SnoozeBtnUnique, DoneBtnUnique:
+		return textReply(handleTGReminderCallback(ctx, table, user, unique, data))
+	case ListBtnUnique:
+		return handleTGListCallback(ctx, table, user, data)
+	case SearchBtnUnique:
+		return handleTGSearchCallback(ctx, table, user, data)
+	case MoveBtnUnique:
+		return handleTGMoveCallback(ctx, table, user, data)
+	case TaskDoneBtnUnique:
+		return handleTGTaskDoneCallback(ctx, table, user, data)
+	case ActionBtnUnique:
+		return handleTGActionCallback(ctx, table, user, data)
+	case TagBtnUnique:
+		return handleTGTagCallback(ctx, table, user, data)
+	}
+	return nil, nil
+}
@@ -0,0 +1,176 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDueTime(t *testing.T) {
+	now := time.Date(2020, 8, 1, 10, 0, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"in 2 hours":          time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC),
+		"in 30 min":           time.Date(2020, 8, 1, 10, 30, 0, 0, time.UTC),
+		"in 3 days":           time.Date(2020, 8, 4, 10, 0, 0, 0, time.UTC),
+		"tomorrow 9:00":       time.Date(2020, 8, 2, 9, 0, 0, 0, time.UTC),
+		"tomorrow":            time.Date(2020, 8, 2, 9, 0, 0, 0, time.UTC),
+		"today at 18:30":      time.Date(2020, 8, 1, 18, 30, 0, 0, time.UTC),
+		"9:30":                time.Date(2020, 8, 2, 9, 30, 0, 0, time.UTC),
+		"2020-08-03T10:00:00": time.Date(2020, 8, 3, 10, 0, 0, 0, time.UTC),
+	}
+	for expr, expected := range cases {
+		due, err := ParseDueTime(expr, now)
+		if assert.Nil(t, err, expr) {
+			assert.Equal(t, expected.Unix(), due.Unix(), expr)
+		}
+	}
+	for _, expr := range []string{"today 9:00", "2020-07-01", "someday", ""} {
+		_, err := ParseDueTime(expr, now)
+		assert.NotNil(t, err, expr)
+	}
+	due := ExtractDueTime("Call the bank\nremind me tomorrow 9:00", now)
+	assert.Equal(t, time.Date(2020, 8, 2, 9, 0, 0, 0, time.UTC).Unix(), due.Unix())
+	assert.True(t, ExtractDueTime("reminder about nothing", now).IsZero())
+
+	// times of day are in the user's time zone
+	user, _ := NewUser("user1")
+	assert.Equal(t, ReminderLocation, user.Location())
+	user.Data[UserTZKey] = "Asia/Tokyo"
+	tokyo := user.Location()
+	assert.Equal(t, "Asia/Tokyo", tokyo.String())
+	due, err := ParseDueTime("tomorrow 9:00", now.In(tokyo))
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2020, 8, 2, 0, 0, 0, 0, time.UTC).Unix(), due.Unix())
+	user.Data[UserTZKey] = "Nowhere/Nocity"
+	assert.Equal(t, ReminderLocation, user.Location())
+}
+
+func TestReminders(t *testing.T) {
+	ctx := context.Background()
+	table, _ := NewMemDTable("MainTest")
+	bot, _ := NewBot(DummyBotKind, "foobot")
+	user, _ := NewUser("user1")
+	user.TGID = "123"
+	due, _ := NewMsg(bot.PK, user.PK, TGTextMsgKind, DataOp(map[string]interface{}{"text": "call the bank"}))
+	due.DueAt = time.Now().Add(-time.Minute).Unix()
+	later, _ := NewMsg(bot.PK, user.PK, TGTextMsgKind)
+	later.DueAt = time.Now().Add(time.Hour).Unix()
+	for _, err := range table.StoreItems(bot, user, due, later) {
+		require.Nil(t, err)
+	}
+	require.Nil(t, table.IndexMsgDueWithContext(ctx, due))
+	require.Nil(t, table.IndexMsgDueWithContext(ctx, later))
+
+	items, err := table.FetchDue(time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(items))
+	assert.Equal(t, due.PK, items[0].SK)
+
+	sent, err := table.SendDueReminders(time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, "123", dummyTGBot.ChatID)
+	assert.Equal(t, "Reminder: call the bank", dummyTGBot.Sent)
+	require.Equal(t, 1, len(dummyTGBot.Options))
+	markup := dummyTGBot.Options[0].(*tb.ReplyMarkup)
+	assert.Equal(t, SnoozeBtnUnique, markup.InlineKeyboard[0][0].Unique)
+	assert.Equal(t, DoneBtnUnique, markup.InlineKeyboard[0][1].Unique)
+	require.Nil(t, due.Reload(table))
+	assert.Equal(t, int64(0), due.DueAt)
+
+	// the later one moves to an earlier bucket when its due time changes
+	later.DueAt = time.Now().Add(-time.Minute).Unix()
+	require.Nil(t, table.StoreItem(later))
+	require.Nil(t, table.IndexMsgDueWithContext(ctx, later))
+	items, _ = table.FetchDue(time.Now().Add(2 * time.Hour))
+	require.Equal(t, 1, len(items))
+	assert.Equal(t, later.PK, items[0].SK)
+	require.Nil(t, table.UnindexMsgDueWithContext(ctx, later.PK))
+	items, _ = table.FetchDue(time.Now().Add(2 * time.Hour))
+	assert.Equal(t, 0, len(items))
+}
+
+const TGCallbackTmpl = `{"update_id": 45554190,
+  "callback_query": {
+    "id": "4382bfdwdsb323b2d9",
+    "from": {"id": %[1]d, "is_bot": false, "first_name": "D"},
+    "data": "%[2]s"}
+}`
+
+func TestScenarioTGRemind(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	_, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGTextMsgTmpl, tgid, "call mom remind in 2 hours"))
+	require.Nil(t, err)
+	msg := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 181, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	assert.InDelta(t, time.Now().Add(2*time.Hour).Unix(), msg.DueAt, 2)
+
+	id := msg.PK[len(MsgKeyPrefix):]
+	resp, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGCallbackTmpl, tgid, `\fsnooze|`+id))
+	require.Nil(t, err)
+	assert.Equal(t, "Snoozed for 1h", resp)
+	require.Nil(t, msg.Reload(table))
+	assert.InDelta(t, time.Now().Add(ReminderSnooze).Unix(), msg.DueAt, 2)
+
+	resp, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGCallbackTmpl, tgid, `\fdone|`+id))
+	require.Nil(t, err)
+	assert.Equal(t, "Done", resp)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, int64(0), msg.DueAt)
+
+	// buttons of other users do nothing
+	other, _ := NewTGAcc(42, "user#other")
+	require.Nil(t, table.StoreItem(other))
+	_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGCallbackTmpl, 42, `\fsnooze|`+id))
+	assert.NotNil(t, err)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, int64(0), msg.DueAt)
+}
+
+func TestCmdMsgDue(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	user, _ := NewUser("user")
+	msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind)
+	for _, err := range table.StoreItems(user, msg) {
+		require.Nil(t, err)
+	}
+	reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user.PK)
+	for _, c := range []struct {
+		input string
+		due   int64
+	}{
+		{fmt.Sprintf(`{"name":"msgdue", "id":"1", "pk":"%s", "due":1900000000}`, msg.PK), 1900000000},
+		{fmt.Sprintf(`{"name":"msgdue", "id":"2", "pk":"%s", "at":"in 1 hour"}`, msg.PK), time.Now().Add(time.Hour).Unix()},
+		{fmt.Sprintf(`{"name":"msgdue", "id":"3", "pk":"%s"}`, msg.PK), 0},
+	} {
+		outCh := make(chan []byte)
+		doneCh := make(chan bool)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		output := make([]string, 0)
+		go collectOutput(ctx, &output, outCh, doneCh)
+		err := handleUserCmd(ctx, table, reqCtx, c.input, outCh)
+		if assert.Nil(t, err) {
+			doneCh <- true
+		}
+		cancel()
+		require.Equal(t, 1, len(output))
+		assert.Contains(t, output[0], `"ok":true`)
+		require.Nil(t, msg.Reload(table))
+		assert.InDelta(t, c.due, msg.DueAt, 2)
+	}
+}
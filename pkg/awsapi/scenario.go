@@ -1,6 +1,7 @@
 package awsapi
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,29 +21,32 @@ const (
 
 var CODE_REGEXP = regexp.MustCompile(`\d{6}`)
 
-func handleTGStartMsg(bot *Bot, table *DTable, tgmsg *tb.Message) (string, error) {
+func handleTGStartMsg(ctx context.Context, bot *Bot, table *DTable, tgmsg *tb.Message) (string, error) {
 	var err error
 	code := CODE_REGEXP.FindString(tgmsg.Text)
 	if code == "" {
 		return NEED_CODE, nil
 	}
 	inv := &Invite{}
-	err = table.FetchInvite(bot, code, inv)
-	if err != nil && err.Error() == NO_SUCH_ITEM {
+	err = table.FetchInviteWithContext(ctx, bot, code, inv)
+	if errors.Is(err, ErrNotFound) {
 		return WRONG_CODE, nil
 	}
+	if err != nil {
+		return "", err
+	}
 	user := &User{}
-	err = table.FetchItem(inv.UserPK, user)
+	err = table.FetchItemWithContext(ctx, inv.UserPK, user)
 	if err != nil {
 		log.Printf("ERROR: Could not find user for invite %+v", inv)
 		return "", err
 	}
-	err = table.StoreUserTG(user, tgmsg.Sender.ID, bot)
+	err = table.StoreUserTGWithContext(ctx, user, tgmsg.Sender.ID, bot)
 	if err != nil {
 		return "", err
 	}
 	inv.Data["accepted"] = fmt.Sprintf("%d", time.Now().Unix())
-	err = table.StoreItem(inv)
+	err = table.StoreItemWithContext(ctx, inv)
 	if err != nil {
 		//ignoring it
 		log.Printf("could not store Invite %+v, reason: %s", inv, err.Error())
@@ -50,44 +54,79 @@ func handleTGStartMsg(bot *Bot, table *DTable, tgmsg *tb.Message) (string, error
 	return WELCOME, nil
 }
 
-// Handles message got via webhook from Telegram
-func HandleTGMsg(bot *Bot, table *DTable, orig string) (string, error) {
+// Handles message got via webhook from Telegram, returns text of the reply
+func HandleTGMsg(ctx context.Context, bot *Bot, table *DTable, orig string) (string, error) {
+	reply, err := HandleTGUpdate(ctx, bot, table, orig)
+	if reply == nil {
+		return "", err
+	}
+	return reply.Text, err
+}
+
+// Update Telegram sent is of the kind the bot does not handle,
+// delivering it again does not help
+var ErrTGUpdateNotSupported = errors.New("Message is not supported")
+
+// Handles update got via webhook from Telegram, returns what the bot
+// should reply with, nil if nothing
+func HandleTGUpdate(ctx context.Context, bot *Bot, table *DTable, orig string) (*TGReply, error) {
 	var upd tb.Update
 	err := json.Unmarshal([]byte(orig), &upd)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if upd.Callback != nil {
+		return handleTGCallback(ctx, bot, table, upd.Callback)
+	}
+
+	if upd.Query != nil {
+		return handleTGInlineQuery(ctx, bot, table, upd.Query)
+	}
+
+	if upd.EditedMessage != nil {
+		return textReply(handleTGEditedMsg(ctx, bot, table, upd.EditedMessage))
 	}
 
 	tgmsg := upd.Message
 	if tgmsg == nil {
-		return "", errors.New("Message is not supported")
+		return nil, ErrTGUpdateNotSupported
 	}
 
 	// Handle message form non auth user with /start <code>, just <code> or just /start
 	if strings.HasPrefix(tgmsg.Text, "/start") {
-		return handleTGStartMsg(bot, table, tgmsg)
+		return textReply(handleTGStartMsg(ctx, bot, table, tgmsg))
 	}
 	tgacc := &TGAcc{}
-	err = table.FetchTGAcc(tgmsg.Sender.ID, tgacc)
+	err = table.FetchTGAccWithContext(ctx, tgmsg.Sender.ID, tgacc)
 	if err != nil {
-		if err.Error() == NO_SUCH_ITEM {
+		if errors.Is(err, ErrNotFound) {
 			if len(tgmsg.Text) == 6 && CODE_REGEXP.MatchString(tgmsg.Text) {
-				return handleTGStartMsg(bot, table, tgmsg)
+				return textReply(handleTGStartMsg(ctx, bot, table, tgmsg))
 			}
-			return NEED_CODE, nil
+			return textReply(NEED_CODE, nil)
 		}
-		return "", err
+		return nil, err
 	}
 
 	user := &User{}
-	err = table.FetchItem(tgacc.OwnerPK, user)
+	err = table.FetchItemWithContext(ctx, tgacc.OwnerPK, user)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// Telegram delivers update again if the previous delivery failed
+	if reply, done, err := replayTGUpdate(ctx, bot, table, &upd); done {
+		return reply, err
+	}
+
+	if cmd, args := tgCommand(tgmsg.Text); tgCommandHandlers[cmd] != nil {
+		return tgCommandHandlers[cmd](ctx, bot, table, user, tgmsg, args)
 	}
 
 	msg, err := NewMsg(bot.PK, user.PK, TGUnknownMsgKind)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	msg.Data["orig"] = orig
@@ -108,24 +147,65 @@ func HandleTGMsg(bot *Bot, table *DTable, orig string) (string, error) {
 		msg.Kind = TGVoiceMsgKind
 	}
 
-	err = table.StoreItem(msg)
-	return "", err
+	classifyTGMedia(msg, tgmsg)
+
+	if tgmsg.Text != "" {
+		msg.Tags = ExtractTags(tgmsg.Text, tgmsg.Entities)
+	} else if tgmsg.Caption != "" {
+		if _, ok := msg.Data["text"]; !ok {
+			msg.Data["text"] = tgmsg.Caption
+		}
+		msg.Tags = ExtractTags(tgmsg.Caption, tgmsg.CaptionEntities)
+	}
+
+	if text, ok := msg.Data["text"].(string); ok {
+		if due := ExtractDueTime(text, time.Now().In(user.Location())); !due.IsZero() {
+			msg.DueAt = due.Unix()
+		}
+	}
+
+	if tgmsg.ReplyTo != nil {
+		parent := &Msg{}
+		err = table.FetchMsgByTGWithContext(ctx, bot.PK, tgmsg.ReplyTo, parent)
+		if err == nil && parent.UMS.PK == user.PK {
+			msg.ReplyTo(parent)
+		} else if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+
+	if tgmsg.AlbumID != "" {
+		return handleTGAlbumMsg(ctx, bot, table, &upd, msg)
+	}
+
+	err = table.StoreTGUpdateMsgWithContext(ctx, bot.PK, upd.ID, msg)
+	if isTGUpdateStored(err) {
+		reply, _, err := replayTGUpdate(ctx, bot, table, &upd)
+		return reply, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return finishTGMsg(ctx, bot, table, tgmsg, msg)
 }
 
 type DummyTGBot struct {
-	ChatID string
-	Sent   string
+	ChatID  string
+	Sent    string
+	Options []interface{}
 }
 
 func (b *DummyTGBot) Send(to tb.Recipient, what interface{}, options ...interface{}) (*tb.Message, error) {
 	b.ChatID = to.Recipient()
 	b.Sent = what.(string)
+	b.Options = options
 	return &tb.Message{}, nil
 }
 
 var dummyTGBot *DummyTGBot
 
-func BotSendText(table *DTable, bot *Bot, user *User, text string) error {
+// Sends text to the user, options are passed to telebot, like *tb.ReplyMarkup
+func BotSendText(table *DTable, bot *Bot, user *User, text string, options ...interface{}) error {
 	var sendFunc func(to tb.Recipient, what interface{}, options ...interface{}) (*tb.Message, error)
 	if bot.Kind == TGBotKind {
 		tgbot, err := tb.NewBot(tb.Settings{
@@ -140,7 +220,7 @@ func BotSendText(table *DTable, bot *Bot, user *User, text string) error {
 		dummyTGBot = &DummyTGBot{}
 		sendFunc = dummyTGBot.Send
 	}
-	_, err := sendFunc(user, text)
+	_, err := sendFunc(user, text, options...)
 	if err != nil {
 		return err
 	}
@@ -163,7 +243,7 @@ func SendOtp(table *DTable, userPK, otp string) error {
 			return err
 		}
 	} else {
-		errors.New("User does not use any bots")
+		return errors.New("User does not use any bots")
 	}
 	return BotSendText(table, bot, user, otp)
 }
@@ -1,6 +1,7 @@
 package awsapi
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -125,6 +126,7 @@ const TGDocMsgTmpl = `
         "file_unique_id": "AgADgAgAAlrBiEk",
         "file_size": 4398585
     }
+ }
 }`
 
 func TestScenarioTGStartValidCode(t *testing.T) {
@@ -142,7 +144,7 @@ func TestScenarioTGStartValidCode(t *testing.T) {
 	}
 	orig := fmt.Sprintf(TGTextMsgTmpl, tgid, "/start "+inv.OTP)
 
-	_, err := HandleTGMsg(bot, testTable, orig)
+	_, err := HandleTGMsg(context.Background(), bot, testTable, orig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -168,7 +170,7 @@ func TestScenarioTGStartNotValidCode(t *testing.T) {
 	}
 	orig := fmt.Sprintf(TGTextMsgTmpl, tgid, "/start "+"000000")
 
-	resp, err := HandleTGMsg(bot, testTable, orig)
+	resp, err := HandleTGMsg(context.Background(), bot, testTable, orig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -193,7 +195,7 @@ func TestScenarioTGAuthText(t *testing.T) {
 	}
 	text := "65 euro gas station"
 	orig := fmt.Sprintf(TGTextMsgTmpl, tgid, text)
-	_, err := HandleTGMsg(bot, testTable, orig)
+	_, err := HandleTGMsg(context.Background(), bot, testTable, orig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -231,7 +233,7 @@ func TestScenarioTGValidCode(t *testing.T) {
 	}
 	orig := fmt.Sprintf(TGTextMsgTmpl, tgid, inv.OTP)
 
-	resp, err := HandleTGMsg(bot, testTable, orig)
+	resp, err := HandleTGMsg(context.Background(), bot, testTable, orig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -259,7 +261,7 @@ func TestScenarioTGNonAuth(t *testing.T) {
 	}
 	text := "65 euro gas station"
 	orig := fmt.Sprintf(TGTextMsgTmpl, tgid, text)
-	resp, err := HandleTGMsg(bot, testTable, orig)
+	resp, err := HandleTGMsg(context.Background(), bot, testTable, orig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -283,7 +285,7 @@ func TestScenarioTGVoice(t *testing.T) {
 		}
 	}
 	orig := fmt.Sprintf(TGVoiceMsgTmpl, tgid, 1, "sometgfileid")
-	_, err := HandleTGMsg(bot, testTable, orig)
+	_, err := HandleTGMsg(context.Background(), bot, testTable, orig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -321,7 +323,7 @@ func TestScenarioTGPhoto(t *testing.T) {
 		}
 	}
 	orig := fmt.Sprintf(TGPhotoMsgTmpl, tgid)
-	_, err := HandleTGMsg(bot, testTable, orig)
+	_, err := HandleTGMsg(context.Background(), bot, testTable, orig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -0,0 +1,324 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	SearchTokenKeyPrefix = "tok#"
+	MsgTokensKey         = "tokens#"
+)
+
+// Posting of one stem, PK is tok#<owner PK>#<stem> and SK is PK of Msg.
+// It keeps what MsgIndexView needs, so results are shown without
+// fetching Msgs
+type SearchToken struct {
+	PK        string
+	SK        string
+	UMS       string `dynamodbav:"U"`
+	Kind      int64  `dynamodbav:"K"`
+	CreatedAt int64  `dynamodbav:"CRTD"`
+	Count     int64  `dynamodbav:"N"`
+}
+
+// Sub item of Msg with stems it is indexed by, it is used to delete
+// postings which are not valid anymore
+type MsgTokens struct {
+	PK    string
+	SK    string
+	UMS   string           `dynamodbav:"U"`
+	Stems map[string]int64 `dynamodbav:"T"`
+}
+
+func searchTokenPK(ownerPK, stem string) string {
+	return fmt.Sprintf("%s%s#%s", SearchTokenKeyPrefix, ownerPK, stem)
+}
+
+var enSuffixes = []string{
+	"ational", "fulness", "iveness", "ization", "ousness", "tional",
+	"ement", "ments", "ings", "ment", "ness", "edly", "ing", "ed", "es",
+	"ly", "e", "s",
+}
+
+var ruSuffixes = []string{
+	"ами", "ями", "ого", "его", "ому", "ему", "ыми", "ими", "ишь", "ешь",
+	"ая", "яя", "ое", "ее", "ую", "юю", "ой", "ей", "ий", "ый", "ом", "ем",
+	"ам", "ям", "ах", "ях", "ов", "ев", "ых", "их", "ью", "ия", "ие", "ии",
+	"ию", "ть", "ла", "ло", "ли", "ет", "ют", "ут", "ит", "ат", "ят",
+	"а", "я", "о", "е", "ы", "и", "у", "ю", "ь", "й",
+}
+
+// Minimal length of a stem in letters, shorter words are kept as they are
+const minStemLen = 3
+
+func stripSuffix(word string, suffixes []string) string {
+	for _, suf := range suffixes {
+		if strings.HasSuffix(word, suf) &&
+			utf8.RuneCountInString(word)-utf8.RuneCountInString(suf) >= minStemLen {
+			return strings.TrimSuffix(word, suf)
+		}
+	}
+	return word
+}
+
+// Light stemmer for Russian and English, it strips the longest known
+// ending so different forms of a word give the same stem
+func Stem(word string) string {
+	word = strings.ToLower(word)
+	isCyrillic := false
+	for _, r := range word {
+		if unicode.Is(unicode.Cyrillic, r) {
+			isCyrillic = true
+			break
+		}
+	}
+	if isCyrillic {
+		return stripSuffix(strings.ReplaceAll(word, "ё", "е"), ruSuffixes)
+	}
+	// cities and city both give citi
+	if strings.HasSuffix(word, "ies") || strings.HasSuffix(word, "ied") {
+		return word[:len(word)-2]
+	}
+	stem := stripSuffix(word, enSuffixes)
+	if strings.HasSuffix(stem, "y") && len(stem) >= minStemLen {
+		stem = strings.TrimSuffix(stem, "y") + "i"
+	}
+	return stem
+}
+
+// Splits text to words and returns stems with the number of times
+// they occur, words shorter than 2 letters are skipped
+func Stems(text string) map[string]int64 {
+	out := make(map[string]int64)
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		if utf8.RuneCountInString(w) < 2 {
+			continue
+		}
+		out[Stem(w)]++
+	}
+	return out
+}
+
+func msgStems(msg *Msg) map[string]int64 {
+	var texts []string
+	if msg.Data != nil {
+		for _, field := range []string{"text", RecognizedTextFieldName} {
+			if s, ok := msg.Data[field].(string); ok {
+				texts = append(texts, s)
+			}
+		}
+	}
+	return Stems(strings.Join(texts, " "))
+}
+
+// Updates postings of Msg, postings for stems Msg does not have
+// anymore are deleted. Nothing is written if stems and UMS are the same
+func (t *DTable) IndexMsgWithContext(ctx context.Context, msg *Msg) error {
+	stems := msgStems(msg)
+	ums := msg.UMS.String()
+	old := &MsgTokens{}
+	err := t.FetchSubItemWithContext(ctx, msg.PK, MsgTokensKey, old)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if old.UMS == "" && len(stems) == 0 {
+		return nil
+	}
+	if old.UMS == ums && equalCounts(old.Stems, stems) {
+		return nil
+	}
+	var stale []ItemKey
+	oldOwner := umsOwner(old.UMS)
+	for stem := range old.Stems {
+		if _, ok := stems[stem]; !ok || oldOwner != msg.UMS.PK {
+			stale = append(stale, ItemKey{PK: searchTokenPK(oldOwner, stem), SK: msg.PK})
+		}
+	}
+	items := []interface{}{}
+	for stem, n := range stems {
+		items = append(items, &SearchToken{
+			PK: searchTokenPK(msg.UMS.PK, stem), SK: msg.PK,
+			UMS: ums, Kind: msg.Kind, CreatedAt: msg.CreatedAt, Count: n})
+	}
+	for _, err := range t.BatchDeleteWithContext(ctx, stale...) {
+		if err != nil {
+			return err
+		}
+	}
+	for _, err := range t.BatchStoreWithContext(ctx, items...) {
+		if err != nil {
+			return err
+		}
+	}
+	return t.StoreItemWithContext(ctx, &MsgTokens{PK: msg.PK, SK: MsgTokensKey, UMS: ums, Stems: stems})
+}
+
+// Deletes postings of removed Msg
+func (t *DTable) UnindexMsgWithContext(ctx context.Context, pk string) error {
+	old := &MsgTokens{}
+	err := t.FetchSubItemWithContext(ctx, pk, MsgTokensKey, old)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner := umsOwner(old.UMS)
+	keys := []ItemKey{{PK: pk, SK: MsgTokensKey}}
+	for stem := range old.Stems {
+		keys = append(keys, ItemKey{PK: searchTokenPK(owner, stem), SK: pk})
+	}
+	for _, err := range t.BatchDeleteWithContext(ctx, keys...) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func umsOwner(s string) string {
+	ums := &UMSField{}
+	if err := ums.Parse(s); err != nil {
+		return ""
+	}
+	return ums.PK
+}
+
+func equalCounts(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type SearchResult struct {
+	Msg   *Msg
+	Score float64
+}
+
+// Returns UMS of folders of other users the user can read, by owner PK
+func (t *DTable) readableFoldersWithContext(ctx context.Context, userPK string) (map[string]map[string]bool, error) {
+	var perms []*UserPerm
+	if err := t.FetchItemsWithPrefixWithContext(ctx, userPK, PermKeyPrefix, &perms); err != nil {
+		return nil, err
+	}
+	out := make(map[string]map[string]bool)
+	for _, p := range perms {
+		// perm#user#<id>#fldr#<n>#<value>
+		parts := strings.Split(strings.TrimPrefix(p.SK, PermKeyPrefix), "#")
+		if len(parts) != 5 || !strings.HasPrefix(parts[4], "tr") {
+			continue
+		}
+		owner := parts[0] + "#" + parts[1]
+		if out[owner] == nil {
+			out[owner] = make(map[string]bool)
+		}
+		out[owner][fmt.Sprintf("%s#%s", owner, parts[3])] = true
+	}
+	return out, nil
+}
+
+func (t *DTable) Search(userPK, query string, limit int) ([]*SearchResult, error) {
+	return t.SearchWithContext(context.Background(), userPK, query, limit)
+}
+
+// Finds Msgs of the user and of folders shared with the user which have
+// all words of the query, Msgs in Trash are skipped. Results are ordered
+// by relevance, the more times rare words occur in Msg the higher it is,
+// newer Msgs go first if relevance is the same
+func (t *DTable) SearchWithContext(ctx context.Context, userPK, query string, limit int) ([]*SearchResult, error) {
+	stems := Stems(query)
+	if len(stems) == 0 {
+		return nil, nil
+	}
+	folders, err := t.readableFoldersWithContext(ctx, userPK)
+	if err != nil {
+		return nil, err
+	}
+	owners := []string{userPK}
+	for owner := range folders {
+		if owner != userPK {
+			owners = append(owners, owner)
+		}
+	}
+	type hit struct {
+		token   *SearchToken
+		matched int
+		score   float64
+	}
+	hits := make(map[string]*hit)
+	for stem := range stems {
+		var postings []*SearchToken
+		for _, owner := range owners {
+			var tokens []*SearchToken
+			err := t.FetchItemsWithPrefixWithContext(ctx, searchTokenPK(owner, stem), MsgKeyPrefix, &tokens)
+			if err != nil {
+				return nil, err
+			}
+			for _, tok := range tokens {
+				if owner == userPK || folders[owner][tok.UMS] {
+					postings = append(postings, tok)
+				}
+			}
+		}
+		// rare words weigh more
+		idf := 1 / math.Log(2+float64(len(postings)))
+		for _, tok := range postings {
+			h, ok := hits[tok.SK]
+			if !ok {
+				h = &hit{token: tok}
+				hits[tok.SK] = h
+			}
+			h.matched++
+			h.score += (1 + math.Log(float64(tok.Count))) * idf
+		}
+	}
+	var results []*SearchResult
+	// by UMS, there are few folders
+	trash := make(map[string]bool)
+	for pk, h := range hits {
+		if h.matched != len(stems) {
+			continue
+		}
+		msg := &Msg{PK: pk, SK: pk, Kind: h.token.Kind, CreatedAt: h.token.CreatedAt}
+		if err := msg.UMS.Parse(h.token.UMS); err != nil {
+			continue
+		}
+		isTrash, ok := trash[h.token.UMS]
+		if !ok {
+			if isTrash, err = t.IsTrashFolderWithContext(ctx, msg.UMS); err != nil {
+				return nil, err
+			}
+			trash[h.token.UMS] = isTrash
+		}
+		if isTrash {
+			continue
+		}
+		results = append(results, &SearchResult{Msg: msg, Score: h.score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Msg.PK > results[j].Msg.PK
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
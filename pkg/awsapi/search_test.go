@@ -0,0 +1,119 @@
+package awsapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStem(t *testing.T) {
+	for _, forms := range [][]string{
+		{"note", "notes", "noted"},
+		{"city", "cities"},
+		{"meeting", "meetings"},
+		{"заметка", "заметки", "заметку", "заметкой"},
+		{"купить", "купила", "купили"},
+		{"buy", "buying"},
+		{"ёлка", "елки"},
+	} {
+		for _, f := range forms[1:] {
+			assert.Equal(t, Stem(forms[0]), Stem(f), f)
+		}
+	}
+	assert.Equal(t, "go", Stem("Go"))
+	assert.Equal(t, map[string]int64{"bui": 2, "milk": 1}, Stems("Buy milk, buy! a"))
+}
+
+func indexTestMsg(t *testing.T, table *DTable, ownerPK string, status int, text string) *Msg {
+	msg, _ := NewMsg("bot1", ownerPK, TGTextMsgKind, UserStatusOp(status),
+		DataOp(map[string]interface{}{"text": text}))
+	require.Nil(t, table.StoreItem(msg))
+	require.Nil(t, table.IndexMsgWithContext(context.Background(), msg))
+	return msg
+}
+
+func searchPKs(t *testing.T, table *DTable, userPK, query string) []string {
+	results, err := table.Search(userPK, query, 0)
+	require.Nil(t, err)
+	var pks []string
+	for _, r := range results {
+		pks = append(pks, r.Msg.PK)
+	}
+	return pks
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	table, _ := NewMemDTable("MainTest")
+	user1, _ := NewUser("user1")
+	user2, _ := NewUser("user2")
+	msg1 := indexTestMsg(t, table, user1.PK, 0, "Buy milk and bread")
+	msg2 := indexTestMsg(t, table, user1.PK, 1, "milk, milk, more milk")
+	msg3 := indexTestMsg(t, table, user2.PK, 2, "Milk for the shared folder")
+	indexTestMsg(t, table, user2.PK, 0, "private milk")
+
+	assert.Equal(t, []string{msg2.PK, msg1.PK}, searchPKs(t, table, user1.PK, "MILK"))
+	assert.Equal(t, []string{msg1.PK}, searchPKs(t, table, user1.PK, "buying milk"))
+	assert.Nil(t, searchPKs(t, table, user1.PK, "cheese"))
+	assert.Nil(t, searchPKs(t, table, user1.PK, "a"))
+
+	folder, _ := NewFolder(user2.PK, "Shared", 2, FolderStreamKind)
+	perm, _ := NewUserPerm(user1.PK, folder, "tr")
+	require.Nil(t, table.StoreItem(perm))
+	assert.ElementsMatch(t, []string{msg1.PK, msg2.PK, msg3.PK}, searchPKs(t, table, user1.PK, "milk"))
+
+	// reindexing drops stems the text does not have anymore
+	msg1.Data["text"] = "Buy bread"
+	msg1.Data[RecognizedTextFieldName] = "and butter"
+	require.Nil(t, table.IndexMsgWithContext(ctx, msg1))
+	assert.Nil(t, searchPKs(t, table, user1.PK, "buy milk"))
+	assert.Equal(t, []string{msg1.PK}, searchPKs(t, table, user1.PK, "butter"))
+
+	// moving to folder of other user moves postings
+	msg1.UMS = UMSField{PK: user2.PK, Status: 0}
+	require.Nil(t, table.IndexMsgWithContext(ctx, msg1))
+	assert.Nil(t, searchPKs(t, table, user1.PK, "butter"))
+	assert.Equal(t, []string{msg1.PK}, searchPKs(t, table, user2.PK, "butter"))
+
+	require.Nil(t, table.UnindexMsgWithContext(ctx, msg1.PK))
+	assert.Nil(t, searchPKs(t, table, user2.PK, "butter"))
+
+	// Msgs in Trash are not found
+	require.Nil(t, user1.EnsureDefaultFolders(table))
+	msg2.MoveTo(UMSField{PK: user1.PK, Status: 3}, true)
+	require.Nil(t, table.IndexMsgWithContext(ctx, msg2))
+	assert.Equal(t, []string{msg3.PK}, searchPKs(t, table, user1.PK, "milk"))
+}
+
+func TestDBEventIndexesMsg(t *testing.T) {
+	table, _ := NewMemDTable("MainTest")
+	msg, _ := NewMsg("bot1", "user#foo", TGTextMsgKind, DataOp(map[string]interface{}{"text": "hello world"}))
+	image := map[string]events.DynamoDBAttributeValue{
+		"PK":   events.NewStringAttribute(msg.PK),
+		"SK":   events.NewStringAttribute(msg.PK),
+		"K":    events.NewNumberAttribute("1"),
+		"CRTD": events.NewNumberAttribute("1598515792"),
+		"UMS":  events.NewStringAttribute(msg.UMS.String()),
+		"D": events.NewMapAttribute(map[string]events.DynamoDBAttributeValue{
+			"text": events.NewStringAttribute("hello world"),
+		}),
+	}
+	e := events.DynamoDBEvent{Records: []events.DynamoDBEventRecord{
+		{EventName: "INSERT", Change: events.DynamoDBStreamRecord{Keys: image, NewImage: image}},
+	}}
+	HandleDBEvent(context.Background(), table, e)
+	results, err := table.Search("user#foo", "worlds", 10)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, msg.PK, results[0].Msg.PK)
+	assert.Equal(t, int64(1598515792), results[0].Msg.CreatedAt)
+
+	e.Records[0].EventName = "REMOVE"
+	HandleDBEvent(context.Background(), table, e)
+	results, err = table.Search("user#foo", "world", 10)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(results))
+}
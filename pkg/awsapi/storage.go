@@ -0,0 +1,459 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Low level item operations DTable is built on.
+// DynamoDB and in-memory backends implement it
+type Storage interface {
+	StoreItemWithContext(ctx context.Context, item interface{},
+		options ...func(*dynamodb.PutItemInput) error) error
+	StoreInTransUniqWithContext(ctx context.Context, items ...interface{}) error
+	FetchItemWithContext(ctx context.Context, pk string, item interface{}) error
+	FetchSubItemWithContext(ctx context.Context, pk, sk string, item interface{}) error
+	FetchItemsWithPrefixWithContext(ctx context.Context, pk, prefix string, out interface{}) error
+	UpdateItemMapWithContext(ctx context.Context, pk, sk, fName, key string,
+		value interface{}) (*dynamodb.UpdateItemOutput, error)
+	UpdateItemMapVersionWithContext(ctx context.Context, pk, sk, fName, key string,
+		value interface{}, version int64) (*dynamodb.UpdateItemOutput, error)
+	IncrPropWithContext(ctx context.Context, pk, sk, propName string, amount int64) error
+	QueryIndexWithContext(ctx context.Context, name string, cond string,
+		exprValues map[string]interface{}) (*dynamodb.QueryOutput, error)
+	QueryWithContext(ctx context.Context, params *QueryParams) (*dynamodb.QueryOutput, error)
+	DeleteSubItemWithContext(ctx context.Context, pk, sk string) error
+	BatchWriteWithContext(ctx context.Context,
+		reqs []*dynamodb.WriteRequest) ([]*dynamodb.WriteRequest, error)
+	BatchGetWithContext(ctx context.Context, keys []map[string]*dynamodb.AttributeValue) (
+		items, unprocessed []map[string]*dynamodb.AttributeValue, err error)
+	ScanWithContext(ctx context.Context, params *ScanParams) (*dynamodb.ScanOutput, error)
+	AddIndexWithContext(ctx context.Context, gsi *dynamodb.GlobalSecondaryIndex,
+		attrs []*dynamodb.AttributeDefinition) error
+}
+
+// Shortcuts for Storage calls without deadline
+
+func (t *DTable) StoreItem(item interface{}, options ...func(*dynamodb.PutItemInput) error) error {
+	return t.StoreItemWithContext(context.Background(), item, options...)
+}
+
+func (t *DTable) StoreInTransUniq(items ...interface{}) error {
+	return t.StoreInTransUniqWithContext(context.Background(), items...)
+}
+
+func (t *DTable) FetchItem(pk string, item interface{}) error {
+	return t.FetchItemWithContext(context.Background(), pk, item)
+}
+
+func (t *DTable) FetchSubItem(pk, sk string, item interface{}) error {
+	return t.FetchSubItemWithContext(context.Background(), pk, sk, item)
+}
+
+func (t *DTable) FetchItemsWithPrefix(pk, prefix string, out interface{}) error {
+	return t.FetchItemsWithPrefixWithContext(context.Background(), pk, prefix, out)
+}
+
+func (t *DTable) UpdateItemMap(pk, sk, fName, key string, value interface{}) (*dynamodb.UpdateItemOutput, error) {
+	return t.UpdateItemMapWithContext(context.Background(), pk, sk, fName, key, value)
+}
+
+func (t *DTable) UpdateItemMapVersion(pk, sk, fName, key string, value interface{},
+	version int64) (*dynamodb.UpdateItemOutput, error) {
+	return t.UpdateItemMapVersionWithContext(context.Background(), pk, sk, fName, key, value, version)
+}
+
+func (t *DTable) IncrProp(pk, sk, propName string, amount int64) error {
+	return t.IncrPropWithContext(context.Background(), pk, sk, propName, amount)
+}
+
+func (t *DTable) QueryIndex(name string, cond string,
+	exprValues map[string]interface{}) (*dynamodb.QueryOutput, error) {
+	return t.QueryIndexWithContext(context.Background(), name, cond, exprValues)
+}
+
+func (t *DTable) Query(params *QueryParams) (*dynamodb.QueryOutput, error) {
+	return t.QueryWithContext(context.Background(), params)
+}
+
+func (t *DTable) DeleteSubItem(pk, sk string) error {
+	return t.DeleteSubItemWithContext(context.Background(), pk, sk)
+}
+
+func (t *DTable) Scan(params *ScanParams) (*dynamodb.ScanOutput, error) {
+	return t.ScanWithContext(context.Background(), params)
+}
+
+// Parameters of one Query request
+type QueryParams struct {
+	Index    string // index name, empty to query the table itself
+	Cond     string // key condition expression
+	Values   map[string]interface{}
+	Limit    int64 // 0 means no limit besides 1MB DynamoDB has
+	Desc     bool
+	StartKey map[string]*dynamodb.AttributeValue
+}
+
+// Parameters of one Scan request
+type ScanParams struct {
+	Filter        string // filter expression, empty to get everything
+	Names         map[string]*string
+	Values        map[string]interface{}
+	Limit         int64 // max amount of items to evaluate, 0 means no limit besides 1MB
+	Segment       int64
+	TotalSegments int64 // 0 for sequential scan
+	StartKey      map[string]*dynamodb.AttributeValue
+}
+
+// Storage backed by DynamoDB table
+type dynamoStorage struct {
+	db   *dynamodb.DynamoDB
+	name string
+}
+
+func (s *dynamoStorage) StoreItemWithContext(ctx context.Context, item interface{},
+	options ...func(*dynamodb.PutItemInput) error) error {
+	av, err := dattr.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.name),
+	}
+	for _, ops := range options {
+		err := ops(input)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.db.PutItemWithContext(ctx, input)
+	err = wrapAWSError(err)
+	if errors.Is(err, ErrConditionFailed) {
+		return &StorageError{Kind: ErrAlreadyExists, Cause: errors.Unwrap(err)}
+	}
+	return err
+}
+
+func (s *dynamoStorage) StoreInTransUniqWithContext(ctx context.Context, items ...interface{}) error {
+	titems := []*dynamodb.TransactWriteItem{}
+	for _, i := range items {
+		av, err := dattr.MarshalMap(i)
+		if err != nil {
+			return err
+		}
+		titems = append(titems, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				ConditionExpression: aws.String("attribute_not_exists(PK)"),
+				Item:                av,
+				TableName:           aws.String(s.name),
+			},
+		})
+	}
+	_, err := s.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: titems})
+	return wrapAWSError(err)
+}
+
+func (s *dynamoStorage) FetchItemWithContext(ctx context.Context, pk string, item interface{}) error {
+	return s.FetchSubItemWithContext(ctx, pk, pk, item)
+}
+
+func (s *dynamoStorage) FetchSubItemWithContext(ctx context.Context,
+	pk, sk string, item interface{}) error {
+	result, err := s.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.name),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(pk),
+			},
+			"SK": {
+				S: aws.String(sk),
+			},
+		},
+	})
+	if err != nil {
+		return wrapAWSError(err)
+	}
+	if len(result.Item) == 0 {
+		return newNotFoundErr()
+	}
+	err = dattr.UnmarshalMap(result.Item, item)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *dynamoStorage) FetchItemsWithPrefixWithContext(ctx context.Context,
+	pk, prefix string, out interface{}) error {
+	cond := "PK = :pk AND begins_with(SK, :prefix)"
+	qi := &dynamodb.QueryInput{
+		TableName:              aws.String(s.name),
+		KeyConditionExpression: aws.String(cond),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":prefix": {
+				S: aws.String(prefix),
+			},
+			":pk": {
+				S: aws.String(pk),
+			},
+		},
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		resp, err := s.db.QueryWithContext(ctx, qi)
+		if err != nil {
+			return wrapAWSError(err)
+		}
+		items = append(items, resp.Items...)
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+		qi.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	if len(items) > 0 {
+		return dattr.UnmarshalListOfMaps(items, out)
+	}
+	return nil
+}
+
+func (s *dynamoStorage) UpdateItemMapWithContext(ctx context.Context, pk, sk, fName, key string,
+	value interface{}) (*dynamodb.UpdateItemOutput, error) {
+	val, err := dattr.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	uii := &dynamodb.UpdateItemInput{
+		TableName:    aws.String(s.name),
+		ReturnValues: aws.String("ALL_NEW"),
+		ExpressionAttributeNames: map[string]*string{
+			"#Data":      aws.String(fName),
+			"#Key":       aws.String(key),
+			"#UpdatedAt": aws.String(UpdatedAtField),
+		},
+		UpdateExpression: aws.String("SET #Data.#Key = :v, #Data.#UpdatedAt = :t"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":v": val,
+			":t": {
+				N: aws.String(fmt.Sprintf("%d", time.Now().Unix())),
+			},
+		},
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {S: aws.String(pk)},
+			"SK": {S: aws.String(sk)},
+		},
+	}
+	out, err := s.db.UpdateItemWithContext(ctx, uii)
+	return out, wrapAWSError(err)
+}
+
+// Like UpdateItemMap but also increments item version, with version
+// other than AnyVersion update is done only if stored version matches
+func (s *dynamoStorage) UpdateItemMapVersionWithContext(ctx context.Context, pk, sk, fName, key string,
+	value interface{}, version int64) (*dynamodb.UpdateItemOutput, error) {
+	val, err := dattr.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	values, err := dattr.MarshalMap(map[string]int64{
+		":t": time.Now().Unix(), ":zero": 0, ":one": 1, ":ver": version})
+	if err != nil {
+		return nil, err
+	}
+	values[":v"] = val
+	cond := versionCond(version, true)
+	if version == AnyVersion {
+		delete(values, ":ver")
+	}
+	uii := &dynamodb.UpdateItemInput{
+		TableName:    aws.String(s.name),
+		ReturnValues: aws.String("ALL_NEW"),
+		ExpressionAttributeNames: map[string]*string{
+			"#Data":      aws.String(fName),
+			"#Key":       aws.String(key),
+			"#UpdatedAt": aws.String(UpdatedAtField),
+			"#V":         aws.String(VersionField),
+		},
+		UpdateExpression: aws.String(
+			"SET #Data.#Key = :v, #Data.#UpdatedAt = :t, #V = if_not_exists(#V, :zero) + :one"),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeValues: values,
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {S: aws.String(pk)},
+			"SK": {S: aws.String(sk)},
+		},
+	}
+	out, err := s.db.UpdateItemWithContext(ctx, uii)
+	return out, wrapAWSError(err)
+}
+
+func (s *dynamoStorage) IncrPropWithContext(ctx context.Context, pk, sk, propName string, amount int64) error {
+	exprVals, err := dattr.MarshalMap(map[string]int64{
+		":v": amount},
+	)
+	if err != nil {
+		return err
+	}
+	uii := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.name),
+		ExpressionAttributeNames: map[string]*string{
+			"#PropName": aws.String(propName),
+		},
+		UpdateExpression:          aws.String("ADD #PropName :v"),
+		ExpressionAttributeValues: exprVals,
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {S: aws.String(pk)},
+			"SK": {S: aws.String(sk)},
+		},
+	}
+	_, err = s.db.UpdateItemWithContext(ctx, uii)
+	return wrapAWSError(err)
+}
+
+func (s *dynamoStorage) QueryIndexWithContext(ctx context.Context,
+	name string, cond string, exprValues map[string]interface{}) (*dynamodb.QueryOutput, error) {
+	av, err := dattr.MarshalMap(exprValues)
+	if err != nil {
+		return nil, err
+	}
+	qi := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.name),
+		IndexName:                 aws.String(name),
+		KeyConditionExpression:    aws.String(cond),
+		ExpressionAttributeValues: av,
+	}
+	out, err := s.db.QueryWithContext(ctx, qi)
+	return out, wrapAWSError(err)
+}
+
+func (s *dynamoStorage) QueryWithContext(ctx context.Context, params *QueryParams) (*dynamodb.QueryOutput, error) {
+	av, err := dattr.MarshalMap(params.Values)
+	if err != nil {
+		return nil, err
+	}
+	qi := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.name),
+		KeyConditionExpression:    aws.String(params.Cond),
+		ExpressionAttributeValues: av,
+		ScanIndexForward:          aws.Bool(!params.Desc),
+	}
+	if params.Index != "" {
+		qi.IndexName = aws.String(params.Index)
+	}
+	if params.Limit > 0 {
+		qi.Limit = aws.Int64(params.Limit)
+	}
+	if len(params.StartKey) > 0 {
+		qi.ExclusiveStartKey = params.StartKey
+	}
+	out, err := s.db.QueryWithContext(ctx, qi)
+	return out, wrapAWSError(err)
+}
+
+func (s *dynamoStorage) DeleteSubItemWithContext(ctx context.Context, pk, sk string) error {
+	input := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(pk),
+			},
+			"SK": {
+				S: aws.String(sk),
+			},
+		},
+		TableName: aws.String(s.name),
+	}
+	_, err := s.db.DeleteItemWithContext(ctx, input)
+	return wrapAWSError(err)
+}
+
+func (s *dynamoStorage) BatchWriteWithContext(ctx context.Context,
+	reqs []*dynamodb.WriteRequest) ([]*dynamodb.WriteRequest, error) {
+	out, err := s.db.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{s.name: reqs},
+	})
+	if err != nil {
+		return nil, wrapAWSError(err)
+	}
+	return out.UnprocessedItems[s.name], nil
+}
+
+func (s *dynamoStorage) BatchGetWithContext(ctx context.Context, keys []map[string]*dynamodb.AttributeValue) (
+	items, unprocessed []map[string]*dynamodb.AttributeValue, err error) {
+	out, err := s.db.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{
+			s.name: {Keys: keys},
+		},
+	})
+	if err != nil {
+		return nil, nil, wrapAWSError(err)
+	}
+	if ka, ok := out.UnprocessedKeys[s.name]; ok && ka != nil {
+		unprocessed = ka.Keys
+	}
+	return out.Responses[s.name], unprocessed, nil
+}
+
+func (s *dynamoStorage) ScanWithContext(ctx context.Context, params *ScanParams) (*dynamodb.ScanOutput, error) {
+	si := &dynamodb.ScanInput{TableName: aws.String(s.name)}
+	if params.Filter != "" {
+		si.FilterExpression = aws.String(params.Filter)
+	}
+	if len(params.Names) > 0 {
+		si.ExpressionAttributeNames = params.Names
+	}
+	if len(params.Values) > 0 {
+		av, err := dattr.MarshalMap(params.Values)
+		if err != nil {
+			return nil, err
+		}
+		si.ExpressionAttributeValues = av
+	}
+	if params.Limit > 0 {
+		si.Limit = aws.Int64(params.Limit)
+	}
+	if params.TotalSegments > 0 {
+		si.Segment = aws.Int64(params.Segment)
+		si.TotalSegments = aws.Int64(params.TotalSegments)
+	}
+	if len(params.StartKey) > 0 {
+		si.ExclusiveStartKey = params.StartKey
+	}
+	out, err := s.db.ScanWithContext(ctx, si)
+	return out, wrapAWSError(err)
+}
+
+// Creates GSI unless table has it already, attrs are definitions of its key attributes
+func (s *dynamoStorage) AddIndexWithContext(ctx context.Context, gsi *dynamodb.GlobalSecondaryIndex,
+	attrs []*dynamodb.AttributeDefinition) error {
+	desc, err := s.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(s.name)})
+	if err != nil {
+		return wrapAWSError(err)
+	}
+	for _, idx := range desc.Table.GlobalSecondaryIndexes {
+		if aws.StringValue(idx.IndexName) == aws.StringValue(gsi.IndexName) {
+			return nil
+		}
+	}
+	_, err = s.db.UpdateTableWithContext(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(s.name),
+		AttributeDefinitions: attrs,
+		GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{
+			{Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+				IndexName:             gsi.IndexName,
+				KeySchema:             gsi.KeySchema,
+				Projection:            gsi.Projection,
+				ProvisionedThroughput: gsi.ProvisionedThroughput,
+			}},
+		},
+	})
+	return wrapAWSError(err)
+}
@@ -0,0 +1,328 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	dattr "github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	TagKeyPrefix      = "tag#"
+	TagCountKeyPrefix = "tagcnt#"
+	MsgTagsKey        = "tags#"
+	MaxTagLen         = 64
+	WRONG_TAG         = "Tag must have letters, digits or _ only"
+)
+
+var TAG_REGEXP = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+
+// Makes tag from "#Tag" or "Tag", returns empty string if it is not valid
+func NormalizeTag(tag string) string {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	if tag == "" || len(tag) > MaxTagLen || TAG_REGEXP.FindString("#"+tag) != "#"+tag {
+		return ""
+	}
+	return tag
+}
+
+// Returns sorted unique tags of text, hashtag entities Telegram found
+// are used along with #words in the text itself
+func ExtractTags(text string, entities []tb.MessageEntity) []string {
+	found := make(map[string]bool)
+	encoded := utf16.Encode([]rune(text))
+	for _, e := range entities {
+		if e.Type != tb.EntityHashtag || e.Offset < 0 || e.Offset+e.Length > len(encoded) {
+			continue
+		}
+		if tag := NormalizeTag(string(utf16.Decode(encoded[e.Offset : e.Offset+e.Length]))); tag != "" {
+			found[tag] = true
+		}
+	}
+	for _, m := range TAG_REGEXP.FindAllStringSubmatch(text, -1) {
+		if tag := NormalizeTag(m[1]); tag != "" {
+			found[tag] = true
+		}
+	}
+	var tags []string
+	for tag := range found {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (m *Msg) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds tag to Msg unless it has it already, returns true if Msg changed
+func (m *Msg) AddTag(tag string) bool {
+	if m.HasTag(tag) {
+		return false
+	}
+	m.Tags = append(m.Tags, tag)
+	sort.Strings(m.Tags)
+	return true
+}
+
+// Removes tag from Msg, returns true if Msg had it
+func (m *Msg) RemoveTag(tag string) bool {
+	for i, t := range m.Tags {
+		if t == tag {
+			m.Tags = append(m.Tags[:i], m.Tags[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Adds tag to Msg or removes it retrying on concurrent change, only owner
+// of Msg can do that. Returns updated Msg
+func (t *DTable) UpdateMsgTagWithContext(ctx context.Context, pk, userPK, tag string, remove bool) (*Msg, error) {
+	tag = NormalizeTag(tag)
+	if tag == "" {
+		return nil, errors.New(WRONG_TAG)
+	}
+	for attempt := 1; ; attempt++ {
+		msg := &Msg{}
+		if err := t.FetchItemWithContext(ctx, pk, msg); err != nil {
+			return nil, err
+		}
+		if msg.UMS.PK != userPK {
+			return nil, errors.New("Permission denied")
+		}
+		changed := false
+		if remove {
+			changed = msg.RemoveTag(tag)
+		} else {
+			changed = msg.AddTag(tag)
+		}
+		if !changed {
+			return msg, nil
+		}
+		err := t.StoreMsgIfVersionWithContext(ctx, msg, msg.Version)
+		if err == nil {
+			return msg, nil
+		}
+		if attempt == msgUpdateAttempts || !errors.Is(err, ErrVersionConflict) {
+			return nil, err
+		}
+	}
+}
+
+// Posting of Msg in tag index, PK is tag#<owner PK>#<tag>, SK is PK of Msg,
+// since Msg PKs are ksuids postings are ordered by time
+type MsgTag struct {
+	PK        string
+	SK        string
+	UMS       string `dynamodbav:"U"`
+	Kind      int64  `dynamodbav:"K"`
+	CreatedAt int64  `dynamodbav:"CRTD"`
+}
+
+// How many Msgs of the user have the tag, kept under User's PK
+type TagCount struct {
+	PK    string
+	SK    string
+	Count int64 `dynamodbav:"N"`
+}
+
+func (c *TagCount) Tag() string {
+	return strings.TrimPrefix(c.SK, TagCountKeyPrefix)
+}
+
+// Sub item of Msg with tags it is indexed by
+type MsgTags struct {
+	PK   string
+	SK   string
+	UMS  string   `dynamodbav:"U"`
+	Tags []string `dynamodbav:"T"`
+}
+
+func msgTagPK(ownerPK, tag string) string {
+	return fmt.Sprintf("%s%s#%s", TagKeyPrefix, ownerPK, tag)
+}
+
+// Updates tag index and counters for Msg, it is called from HandleDBEvent.
+// Nothing is written if tags and UMS are the same as indexed ones
+func (t *DTable) IndexMsgTagsWithContext(ctx context.Context, msg *Msg) error {
+	ums := msg.UMS.String()
+	old := &MsgTags{}
+	err := t.FetchSubItemWithContext(ctx, msg.PK, MsgTagsKey, old)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if old.UMS == "" && len(msg.Tags) == 0 {
+		return nil
+	}
+	sort.Strings(msg.Tags)
+	oldOwner := umsOwner(old.UMS)
+	if old.UMS == ums && strings.Join(old.Tags, " ") == strings.Join(msg.Tags, " ") {
+		return nil
+	}
+	current := make(map[string]bool)
+	for _, tag := range msg.Tags {
+		current[tag] = true
+	}
+	var stale []ItemKey
+	for _, tag := range old.Tags {
+		if !current[tag] || oldOwner != msg.UMS.PK {
+			stale = append(stale, ItemKey{PK: msgTagPK(oldOwner, tag), SK: msg.PK})
+			if err := t.IncrPropWithContext(ctx, oldOwner, TagCountKeyPrefix+tag, "N", -1); err != nil {
+				return err
+			}
+		}
+	}
+	var items []interface{}
+	previous := make(map[string]bool)
+	for _, tag := range old.Tags {
+		previous[tag] = oldOwner == msg.UMS.PK
+	}
+	for _, tag := range msg.Tags {
+		items = append(items, &MsgTag{PK: msgTagPK(msg.UMS.PK, tag), SK: msg.PK,
+			UMS: ums, Kind: msg.Kind, CreatedAt: msg.CreatedAt})
+		if !previous[tag] {
+			if err := t.IncrPropWithContext(ctx, msg.UMS.PK, TagCountKeyPrefix+tag, "N", 1); err != nil {
+				return err
+			}
+		}
+	}
+	for _, err := range t.BatchDeleteWithContext(ctx, stale...) {
+		if err != nil {
+			return err
+		}
+	}
+	for _, err := range t.BatchStoreWithContext(ctx, items...) {
+		if err != nil {
+			return err
+		}
+	}
+	return t.StoreItemWithContext(ctx, &MsgTags{PK: msg.PK, SK: MsgTagsKey, UMS: ums, Tags: msg.Tags})
+}
+
+// Deletes removed Msg from tag index
+func (t *DTable) UnindexMsgTagsWithContext(ctx context.Context, pk string) error {
+	old := &MsgTags{}
+	err := t.FetchSubItemWithContext(ctx, pk, MsgTagsKey, old)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	owner := umsOwner(old.UMS)
+	keys := []ItemKey{{PK: pk, SK: MsgTagsKey}}
+	for _, tag := range old.Tags {
+		keys = append(keys, ItemKey{PK: msgTagPK(owner, tag), SK: pk})
+		if err := t.IncrPropWithContext(ctx, owner, TagCountKeyPrefix+tag, "N", -1); err != nil {
+			return err
+		}
+	}
+	for _, err := range t.BatchDeleteWithContext(ctx, keys...) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns tags of the user with number of Msgs for each, most used first
+func (t *DTable) FetchTags(userPK string) ([]*TagCount, error) {
+	return t.FetchTagsWithContext(context.Background(), userPK)
+}
+
+func (t *DTable) FetchTagsWithContext(ctx context.Context, userPK string) ([]*TagCount, error) {
+	var counts []*TagCount
+	if err := t.FetchItemsWithPrefixWithContext(ctx, userPK, TagCountKeyPrefix, &counts); err != nil {
+		return nil, err
+	}
+	var out []*TagCount
+	for _, c := range counts {
+		if c.Count > 0 {
+			out = append(out, c)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	return out, nil
+}
+
+// ksuid counts time from this moment
+const ksuidEpoch = 1400000000
+
+// Smallest or biggest PK a Msg created at given time could have
+func msgPKBound(ts int64, upper bool) string {
+	if ts < ksuidEpoch {
+		return MsgKeyPrefix
+	}
+	if ts-ksuidEpoch > math.MaxUint32 {
+		return MsgKeyPrefix + "~"
+	}
+	payload := make([]byte, 16)
+	if upper {
+		for i := range payload {
+			payload[i] = 0xff
+		}
+	}
+	id, _ := ksuid.FromParts(time.Unix(ts, 0), payload)
+	return MsgKeyPrefix + id.String()
+}
+
+// Fetches Msgs of the user with the tag created in between start and end,
+// Msgs have only fields MsgIndexView needs
+func (lm *ListMsg) FetchByTag(t *DTable, userPK, tag string, start, end int64) error {
+	return lm.FetchByTagPageWithContext(context.Background(), t, userPK, tag, start, end, PageOpts{})
+}
+
+func (lm *ListMsg) FetchByTagPageWithContext(ctx context.Context, t *DTable,
+	userPK, tag string, start, end int64, page PageOpts) error {
+	params := QueryParams{
+		Cond: "PK = :pk and SK BETWEEN :start AND :end",
+		Values: map[string]interface{}{
+			":pk":    msgTagPK(userPK, tag),
+			":start": msgPKBound(start, false),
+			":end":   msgPKBound(end, true),
+		},
+		Limit: page.Limit,
+		Desc:  page.Desc,
+	}
+	startKey, err := DecodeCursor(page.Cursor)
+	if err != nil {
+		return err
+	}
+	items, lastKey, err := t.queryPages(ctx, params, startKey)
+	if err != nil {
+		return err
+	}
+	var tags []*MsgTag
+	if err := dattr.UnmarshalListOfMaps(items, &tags); err != nil {
+		return err
+	}
+	for _, mt := range tags {
+		msg := &Msg{PK: mt.SK, SK: mt.SK, Kind: mt.Kind, CreatedAt: mt.CreatedAt}
+		if msg.UMS.Parse(mt.UMS) != nil {
+			continue
+		}
+		lm.Items[msg.PK] = msg
+	}
+	if lastKey == nil {
+		lastKey = map[string]*dynamodb.AttributeValue{}
+	}
+	lm.LastEvaluatedKey = lastKey
+	return nil
+}
@@ -0,0 +1,139 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractTags(t *testing.T) {
+	assert.Equal(t, []string{"gas", "travel"}, ExtractTags("65 euro #Gas station #travel #gas", nil))
+	// offsets are in UTF-16 code units, emoji takes two of them
+	text := "😀 заметка #Покупки"
+	entities := []tb.MessageEntity{{Type: tb.EntityHashtag, Offset: 11, Length: 8}}
+	assert.Equal(t, []string{"покупки"}, ExtractTags(text, entities))
+	assert.Nil(t, ExtractTags("no tags # here", []tb.MessageEntity{{Type: tb.EntityHashtag, Offset: 40, Length: 3}}))
+	assert.Equal(t, "", NormalizeTag("#foo bar"))
+	assert.Equal(t, "foo_1", NormalizeTag("#Foo_1"))
+}
+
+func TestTagIndex(t *testing.T) {
+	ctx := context.Background()
+	table, _ := NewMemDTable("MainTest")
+	user1, _ := NewUser("user1")
+	user2, _ := NewUser("user2")
+	msg1, _ := NewMsg("bot1", user1.PK, TGTextMsgKind, CreatedAtOp("-3d"))
+	msg1.Tags = []string{"travel", "gas"}
+	msg2, _ := NewMsg("bot1", user1.PK, TGTextMsgKind, CreatedAtOp("-1d"))
+	msg2.Tags = []string{"gas"}
+	for _, m := range []*Msg{msg1, msg2} {
+		require.Nil(t, table.IndexMsgTagsWithContext(ctx, m))
+	}
+	counts, err := table.FetchTags(user1.PK)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(counts))
+	assert.Equal(t, "gas", counts[0].Tag())
+	assert.Equal(t, int64(2), counts[0].Count)
+
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchByTag(table, user1.PK, "gas", time.Now().Unix()-2*24*3600, time.Now().Unix()))
+	require.Equal(t, 1, lm.Len())
+	assert.Equal(t, msg2.PK, lm.Asc()[0].PK)
+	lm = NewListMsg()
+	require.Nil(t, lm.FetchByTag(table, user1.PK, "gas", 0, time.Now().Unix()))
+	assert.Equal(t, 2, lm.Len())
+
+	// indexing the same tags again changes nothing
+	require.Nil(t, table.IndexMsgTagsWithContext(ctx, msg2))
+	msg1.RemoveTag("gas")
+	require.Nil(t, table.IndexMsgTagsWithContext(ctx, msg1))
+	counts, _ = table.FetchTags(user1.PK)
+	assert.Equal(t, int64(1), counts[0].Count)
+	assert.Equal(t, int64(1), counts[1].Count)
+
+	msg2.UMS = UMSField{PK: user2.PK}
+	require.Nil(t, table.IndexMsgTagsWithContext(ctx, msg2))
+	counts, _ = table.FetchTags(user1.PK)
+	require.Equal(t, 1, len(counts))
+	assert.Equal(t, "travel", counts[0].Tag())
+	counts, _ = table.FetchTags(user2.PK)
+	require.Equal(t, 1, len(counts))
+	assert.Equal(t, "gas", counts[0].Tag())
+
+	require.Nil(t, table.UnindexMsgTagsWithContext(ctx, msg2.PK))
+	counts, _ = table.FetchTags(user2.PK)
+	assert.Equal(t, 0, len(counts))
+	lm = NewListMsg()
+	require.Nil(t, lm.FetchByTag(table, user2.PK, "gas", 0, time.Now().Unix()))
+	assert.Equal(t, 0, lm.Len())
+}
+
+func TestScenarioTGHashtags(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	orig := fmt.Sprintf(TGTextMsgTmpl, tgid, "65 euro #gas station #Travel")
+	_, err := HandleTGMsg(context.Background(), bot, table, orig)
+	require.Nil(t, err)
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchByUserStatus(table, user.PK, 0, "-1d", "now"))
+	require.Equal(t, 1, lm.Len())
+	msg := lm.Asc()[0]
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, []string{"gas", "travel"}, msg.Tags)
+}
+
+func TestCmdMsgTags(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	user, _ := NewUser("user")
+	msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind)
+	require.Nil(t, table.StoreItem(msg))
+
+	run := func(input string) map[string]interface{} {
+		reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user.PK)
+		outCh := make(chan []byte)
+		doneCh := make(chan bool)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		output := make([]string, 0)
+		go collectOutput(ctx, &output, outCh, doneCh)
+		err := handleUserCmd(ctx, table, reqCtx, input, outCh)
+		if assert.Nil(t, err) {
+			doneCh <- true
+		}
+		require.Equal(t, 1, len(output))
+		resp := make(map[string]interface{})
+		require.Nil(t, json.Unmarshal([]byte(output[0]), &resp))
+		return resp
+	}
+	resp := run(fmt.Sprintf(`{"name":"tagadd", "id":"1", "pk":"%s", "tag":"#Work"}`, msg.PK))
+	assert.True(t, resp["ok"].(bool))
+	assert.Equal(t, []interface{}{"work"}, resp["tags"])
+	resp = run(fmt.Sprintf(`{"name":"tagadd", "id":"2", "pk":"%s", "tag":"home"}`, msg.PK))
+	assert.Equal(t, []interface{}{"home", "work"}, resp["tags"])
+	resp = run(fmt.Sprintf(`{"name":"tagadd", "id":"3", "pk":"%s", "tag":"bad tag"}`, msg.PK))
+	assert.False(t, resp["ok"].(bool))
+	assert.Equal(t, WRONG_TAG, resp["error"])
+	resp = run(fmt.Sprintf(`{"name":"tagremove", "id":"4", "pk":"%s", "tag":"work"}`, msg.PK))
+	assert.True(t, resp["ok"].(bool))
+	assert.Equal(t, []interface{}{"home"}, resp["tags"])
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, []string{"home"}, msg.Tags)
+
+	require.Nil(t, table.IndexMsgTagsWithContext(context.Background(), msg))
+	resp = run(`{"name":"taglist", "id":"5"}`)
+	assert.Equal(t, []interface{}{map[string]interface{}{"tag": "home", "count": float64(1)}}, resp["tags"])
+}
@@ -0,0 +1,257 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const (
+	TaskTodo       = "todo"
+	TaskInProgress = "in_progress"
+	TaskDone       = "done"
+
+	TaskIndexName         = "TaskIndex"
+	WRONG_TASK_STATE      = "Unknown task state"
+	WRONG_TASK_TRANSITION = "Task can not go from %q to %q"
+	NO_TASKS              = "No open tasks."
+	TASK_ADDED            = "Added to todo."
+)
+
+// Sentinels of task changes which can not be done, their text is for
+// the user
+var (
+	ErrWrongTaskState      = errors.New(WRONG_TASK_STATE)
+	ErrWrongTaskTransition = errors.New("WrongTaskTransition")
+	ErrTaskPermission      = errors.New("Permission denied")
+)
+
+// Returned when task can not go to the state, matches ErrWrongTaskTransition
+type TaskTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TaskTransitionError) Error() string {
+	return fmt.Sprintf(WRONG_TASK_TRANSITION, e.From, e.To)
+}
+
+func (e *TaskTransitionError) Is(target error) bool {
+	return target == ErrWrongTaskTransition
+}
+
+// Which states task can go to from a state, empty state means Msg is not a task
+var taskTransitions = map[string][]string{
+	"":             {TaskTodo, TaskInProgress},
+	TaskTodo:       {TaskInProgress, TaskDone, ""},
+	TaskInProgress: {TaskTodo, TaskDone, ""},
+	TaskDone:       {TaskTodo, ""},
+}
+
+// States of tasks which are not done yet
+var OpenTaskStates = []string{TaskTodo, TaskInProgress}
+
+func taskKey(assigneePK, state string) string {
+	return fmt.Sprintf("%s#%s", assigneePK, state)
+}
+
+func IsTaskState(state string) bool {
+	_, ok := taskTransitions[state]
+	return ok && state != ""
+}
+
+// Moves Msg to task state, empty state makes it a plain note again.
+// Msg without assignee is assigned to its owner
+func (m *Msg) SetTaskState(state string, now time.Time) error {
+	if _, ok := taskTransitions[state]; !ok {
+		return ErrWrongTaskState
+	}
+	allowed := false
+	for _, s := range taskTransitions[m.TaskState] {
+		if s == state {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return &TaskTransitionError{From: m.TaskState, To: state}
+	}
+	m.TaskState = state
+	m.CompletedAt = 0
+	if state == TaskDone {
+		m.CompletedAt = now.Unix()
+	}
+	if state == "" {
+		m.Assignee = ""
+	} else if m.Assignee == "" {
+		m.Assignee = m.UMS.PK
+	}
+	m.updateTaskKey()
+	return nil
+}
+
+// Sets who the task is assigned to
+func (m *Msg) Assign(userPK string) {
+	m.Assignee = userPK
+	m.updateTaskKey()
+}
+
+func (m *Msg) updateTaskKey() {
+	m.TaskKey = ""
+	if m.TaskState != "" && m.Assignee != "" {
+		m.TaskKey = taskKey(m.Assignee, m.TaskState)
+	}
+}
+
+// Changes task state of Msg retrying on concurrent change, assignee is
+// changed if it is not empty. Only owner or assignee of Msg can do that
+func (t *DTable) TransitTaskWithContext(ctx context.Context, pk, userPK, state, assignee string) (*Msg, error) {
+	if assignee != "" {
+		if err := t.FetchItemWithContext(ctx, assignee, &User{}); err != nil {
+			return nil, err
+		}
+	}
+	var msg *Msg
+	var err error
+	for attempt := 1; ; attempt++ {
+		msg = &Msg{}
+		if err = t.FetchItemWithContext(ctx, pk, msg); err != nil {
+			return nil, err
+		}
+		if msg.UMS.PK != userPK && msg.Assignee != userPK {
+			return nil, ErrTaskPermission
+		}
+		changed := false
+		if state != msg.TaskState {
+			if err = msg.SetTaskState(state, time.Now()); err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+		if assignee != "" && msg.TaskState != "" && assignee != msg.Assignee {
+			msg.Assign(assignee)
+			changed = true
+		}
+		if !changed {
+			return msg, nil
+		}
+		err = t.StoreMsgIfVersionWithContext(ctx, msg, msg.Version)
+		if err == nil || attempt == msgUpdateAttempts || !errors.Is(err, ErrVersionConflict) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Fetches tasks assigned to the user in given state, Msgs have only
+// fields TaskIndex has
+func (lm *ListMsg) FetchByTaskState(t *DTable, userPK, state string) error {
+	return lm.FetchByTaskStatePageWithContext(context.Background(), t, userPK, state, PageOpts{})
+}
+
+func (lm *ListMsg) FetchByTaskStatePageWithContext(ctx context.Context, t *DTable,
+	userPK, state string, page PageOpts) error {
+	return lm.fetchPage(ctx, t, QueryParams{
+		Index:  TaskIndexName,
+		Cond:   "TSK = :tsk",
+		Values: map[string]interface{}{":tsk": taskKey(userPK, state)},
+	}, page)
+}
+
+// Fetches tasks assigned to the user which are not done yet
+func (lm *ListMsg) FetchOpenTasksWithContext(ctx context.Context, t *DTable, userPK string) error {
+	for _, state := range OpenTaskStates {
+		if err := lm.FetchByTaskStatePageWithContext(ctx, t, userPK, state, PageOpts{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How many tasks /todo lists
+const maxTodoListLen = 20
+
+// Handles /todo command, text is what goes after it. "/todo <text>" adds
+// new task, "/todo" sent as a reply makes the replied message a task,
+// "/todo" lists open tasks
+func handleTGTodoMsg(ctx context.Context, bot *Bot, table *DTable, user *User, tgmsg *tb.Message,
+	text string) (string, error) {
+	if text == "" && tgmsg.ReplyTo != nil {
+		msg := &Msg{}
+		err := table.FetchMsgByTGWithContext(ctx, bot.PK, tgmsg.ReplyTo, msg)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+		if err == nil {
+			if _, err = table.TransitTaskWithContext(ctx, msg.PK, user.PK, TaskTodo, ""); err != nil {
+				return tgTaskErrText(err)
+			}
+			return TASK_ADDED, nil
+		}
+	}
+	if text == "" {
+		return todoList(ctx, table, user)
+	}
+	msg, err := NewMsg(bot.PK, user.PK, TGTextMsgKind)
+	if err != nil {
+		return "", err
+	}
+	msg.Data["text"] = text
+	msg.Tags = ExtractTags(text, nil)
+	if err = msg.SetTaskState(TaskTodo, time.Now()); err != nil {
+		return "", err
+	}
+	// ref is stored along, so /todo Telegram delivers again is added once
+	err = table.StoreInTransUniqWithContext(ctx, NewTGMsgRef(bot.PK, tgmsg, msg.PK), msg)
+	var tcErr *TransactionCanceledError
+	if errors.As(err, &tcErr) && tcErr.Failed(0) {
+		return TASK_ADDED, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return TASK_ADDED, nil
+}
+
+func todoList(ctx context.Context, table *DTable, user *User) (string, error) {
+	lm := NewListMsg()
+	if err := lm.FetchOpenTasksWithContext(ctx, table, user.PK); err != nil {
+		return "", err
+	}
+	if lm.Len() == 0 {
+		return NO_TASKS, nil
+	}
+	var keys []ItemKey
+	for _, m := range lm.Asc() {
+		keys = append(keys, ItemKey{PK: m.PK, SK: m.PK})
+		if len(keys) == maxTodoListLen {
+			break
+		}
+	}
+	var msgs []*Msg
+	for _, err := range table.BatchFetchWithContext(ctx, keys, &msgs) {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+	}
+	lines := make([]string, 0, len(msgs))
+	for i, m := range msgs {
+		text := msgSummary(m, 100)
+		if text == "" {
+			text = "(no text)"
+		}
+		line := fmt.Sprintf("%d. %s", i+1, text)
+		if m.TaskState == TaskInProgress {
+			line += " (in progress)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
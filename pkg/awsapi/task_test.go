@@ -0,0 +1,151 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskTransitions(t *testing.T) {
+	now := time.Now()
+	msg, _ := NewMsg("bot1", "user#1", TGTextMsgKind)
+	assert.NotNil(t, msg.SetTaskState(TaskDone, now))
+	assert.Equal(t, WRONG_TASK_STATE, msg.SetTaskState("later", now).Error())
+	require.Nil(t, msg.SetTaskState(TaskTodo, now))
+	assert.Equal(t, "user#1", msg.Assignee)
+	assert.Equal(t, "user#1#todo", msg.TaskKey)
+	require.Nil(t, msg.SetTaskState(TaskDone, now))
+	assert.Equal(t, now.Unix(), msg.CompletedAt)
+	assert.Equal(t, "user#1#done", msg.TaskKey)
+	assert.NotNil(t, msg.SetTaskState(TaskInProgress, now))
+	assert.NotNil(t, msg.SetTaskState(TaskDone, now))
+	require.Nil(t, msg.SetTaskState(TaskTodo, now))
+	assert.Equal(t, int64(0), msg.CompletedAt)
+	msg.Assign("user#2")
+	assert.Equal(t, "user#2#todo", msg.TaskKey)
+	require.Nil(t, msg.SetTaskState("", now))
+	assert.Equal(t, "", msg.Assignee)
+	assert.Equal(t, "", msg.TaskKey)
+}
+
+func TestTaskIndex(t *testing.T) {
+	ctx := context.Background()
+	table, _ := NewMemDTable("MainTest")
+	user1, _ := NewUser("user1")
+	user2, _ := NewUser("user2")
+	var msgs []*Msg
+	for _, state := range []string{TaskTodo, TaskInProgress, TaskDone, ""} {
+		msg, _ := NewMsg("bot1", user1.PK, TGTextMsgKind)
+		if state != "" {
+			require.Nil(t, msg.SetTaskState(TaskTodo, time.Now()))
+			if state != TaskTodo {
+				require.Nil(t, msg.SetTaskState(state, time.Now()))
+			}
+		}
+		msgs = append(msgs, msg)
+	}
+	for _, err := range table.StoreItems(user1, user2, msgs[0], msgs[1], msgs[2], msgs[3]) {
+		require.Nil(t, err)
+	}
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchOpenTasksWithContext(ctx, table, user1.PK))
+	assert.ElementsMatch(t, []string{msgs[0].PK, msgs[1].PK}, lm.GetPKs())
+	lm = NewListMsg()
+	require.Nil(t, lm.FetchByTaskState(table, user1.PK, TaskDone))
+	require.Equal(t, 1, lm.Len())
+	assert.Equal(t, TaskDone, lm.Items[msgs[2].PK].TaskState)
+
+	_, err := table.TransitTaskWithContext(ctx, msgs[0].PK, user2.PK, TaskDone, "")
+	assert.NotNil(t, err)
+	_, err = table.TransitTaskWithContext(ctx, msgs[0].PK, user1.PK, TaskTodo, "user#nosuch")
+	assert.NotNil(t, err)
+	msg, err := table.TransitTaskWithContext(ctx, msgs[0].PK, user1.PK, TaskTodo, user2.PK)
+	require.Nil(t, err)
+	assert.Equal(t, user2.PK, msg.Assignee)
+	// assignee can change the state too
+	_, err = table.TransitTaskWithContext(ctx, msgs[0].PK, user2.PK, TaskInProgress, "")
+	require.Nil(t, err)
+	lm = NewListMsg()
+	require.Nil(t, lm.FetchOpenTasksWithContext(ctx, table, user1.PK))
+	assert.Equal(t, []string{msgs[1].PK}, lm.GetPKs())
+	lm = NewListMsg()
+	require.Nil(t, lm.FetchByTaskState(table, user2.PK, TaskInProgress))
+	assert.Equal(t, []string{msgs[0].PK}, lm.GetPKs())
+}
+
+func TestScenarioTGTodo(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	resp, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGTextMsgTmpl, tgid, "/todo"))
+	require.Nil(t, err)
+	assert.Equal(t, NO_TASKS, resp)
+	_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGVoiceMsgTmpl, tgid, 1, "sometgfileid"))
+	require.Nil(t, err)
+	resp, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 180, 92, "/todo"))
+	require.Nil(t, err)
+	assert.Equal(t, TASK_ADDED, resp)
+	resp, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGTextMsgTmpl, tgid, "/todo buy milk"))
+	require.Nil(t, err)
+	assert.Equal(t, TASK_ADDED, resp)
+	resp, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGTextMsgTmpl, tgid, "/todo"))
+	require.Nil(t, err)
+	assert.Contains(t, resp, "(no text)")
+	assert.Contains(t, resp, "buy milk")
+}
+
+func TestCmdTask(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	user, _ := NewUser("user")
+	msg, _ := NewMsg("bot1", user.PK, TGTextMsgKind)
+	for _, err := range table.StoreItems(user, msg) {
+		require.Nil(t, err)
+	}
+	reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user.PK)
+	run := func(input string) []string {
+		outCh := make(chan []byte)
+		doneCh := make(chan bool)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		output := make([]string, 0)
+		go collectOutput(ctx, &output, outCh, doneCh)
+		err := handleUserCmd(ctx, table, reqCtx, input, outCh)
+		if assert.Nil(t, err) {
+			doneCh <- true
+		}
+		return output
+	}
+	output := run(fmt.Sprintf(`{"name":"tasktransition", "id":"1", "pk":"%s", "state":"done"}`, msg.PK))
+	require.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], `"ok":false`)
+	output = run(fmt.Sprintf(`{"name":"tasktransition", "id":"2", "pk":"%s", "state":"todo"}`, msg.PK))
+	require.Equal(t, 1, len(output))
+	resp := make(map[string]interface{})
+	require.Nil(t, json.Unmarshal([]byte(output[0]), &resp))
+	assert.True(t, resp["ok"].(bool))
+	assert.Equal(t, TaskTodo, resp["state"])
+	assert.Equal(t, user.PK, resp["assignee"])
+
+	output = run(`{"name":"tasklist", "id":"3"}`)
+	require.Equal(t, 3, len(output))
+	assert.Contains(t, output[1], msg.PK)
+	assert.Contains(t, output[1], `"task":"todo"`)
+	output = run(`{"name":"tasklist", "id":"4", "state":"done"}`)
+	assert.Equal(t, 2, len(output))
+	output = run(`{"name":"tasklist", "id":"5", "state":"later"}`)
+	require.Equal(t, 1, len(output))
+	assert.Contains(t, output[0], WRONG_TASK_STATE)
+}
@@ -0,0 +1,164 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const (
+	ActionBtnUnique = "act"
+	TagBtnUnique    = "tag"
+
+	MSG_SAVED = "Saved."
+	NO_TAGS   = "No tags yet, add #tags to your notes."
+	// How many tags Add tag offers
+	maxTagButtons = 8
+)
+
+// Default folders buttons under stored Msg move it to, ids are the ones
+// EnsureDefaultFolders gives
+var tgActionFolders = []struct {
+	ID    int64
+	Label string
+}{
+	{0, "Inbox"},
+	{1, "Archive"},
+	{2, "Select"},
+	{3, "Trash"},
+}
+
+// Buttons the bot replies with when Msg is stored, they move Msg
+// to other default folders or add tag to it
+func MsgActionsMarkup(msg *Msg) *tb.ReplyMarkup {
+	id := strings.TrimPrefix(msg.PK, MsgKeyPrefix)
+	var row []tb.InlineButton
+	for _, f := range tgActionFolders {
+		if msg.UMS.Status == f.ID {
+			continue
+		}
+		row = append(row, tb.InlineButton{Unique: ActionBtnUnique, Text: f.Label,
+			Data: fmt.Sprintf("%s|%d", id, f.ID)})
+	}
+	row = append(row, tb.InlineButton{Unique: TagBtnUnique, Text: "Add tag", Data: id})
+	return &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{row}}
+}
+
+// Text of the reply under Msg which shows where Msg is and its tags
+func msgStateText(ctx context.Context, table *DTable, msg *Msg) (string, error) {
+	folder := &Folder{}
+	err := table.FetchSubItemWithContext(ctx, msg.UMS.PK, fmt.Sprintf("%s%d", FolderKeyPrefix, msg.UMS.Status), folder)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", err
+	}
+	text := MSG_SAVED
+	if folder.Title != "" {
+		text = fmt.Sprintf("In %s.", folder.Title)
+	}
+	if len(msg.Tags) > 0 {
+		text += "\n#" + strings.Join(msg.Tags, " #")
+	}
+	return text, nil
+}
+
+// Fetches Msg of the user for action button, reply is not nil if Msg
+// can not be changed by the user
+func tgActionMsg(ctx context.Context, table *DTable, user *User, pk string) (*Msg, *TGReply, error) {
+	msg := &Msg{}
+	err := table.FetchItemWithContext(ctx, pk, msg)
+	if errors.Is(err, ErrNotFound) {
+		return nil, &TGReply{Text: "Message is not found"}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if msg.UMS.PK != user.PK {
+		return nil, &TGReply{Text: "Permission denied"}, nil
+	}
+	return msg, nil, nil
+}
+
+// Reply with the state of Msg and action buttons under it
+func tgActionsReply(ctx context.Context, table *DTable, msg *Msg, text string) (*TGReply, error) {
+	state, err := msgStateText(ctx, table, msg)
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: text, EditText: state, EditMarkup: MsgActionsMarkup(msg)}, nil
+}
+
+// Handles Archive, Trash, Select and Inbox buttons, data is
+// "<Msg id>|<folder id>". Data without folder shows buttons again
+func handleTGActionCallback(ctx context.Context, table *DTable, user *User, data string) (*TGReply, error) {
+	parts := strings.SplitN(data, "|", 2)
+	pk := MsgKeyPrefix + parts[0]
+	msg, reply, err := tgActionMsg(ctx, table, user, pk)
+	if msg == nil {
+		return reply, err
+	}
+	text := ""
+	if len(parts) == 2 {
+		// users invited before folders were introduced may miss them
+		if err = user.EnsureDefaultFoldersWithContext(ctx, table); err != nil {
+			return nil, err
+		}
+		if text, err = moveTGMsg(ctx, table, user, pk, parts[1]); err != nil {
+			return nil, err
+		}
+		if err = msg.ReloadWithContext(ctx, table); err != nil {
+			return nil, err
+		}
+	}
+	return tgActionsReply(ctx, table, msg, text)
+}
+
+// Handles Add tag button, data is "<Msg id>" to pick a tag
+// and "<Msg id>|<tag>" to add it
+func handleTGTagCallback(ctx context.Context, table *DTable, user *User, data string) (*TGReply, error) {
+	parts := strings.SplitN(data, "|", 2)
+	pk := MsgKeyPrefix + parts[0]
+	msg, reply, err := tgActionMsg(ctx, table, user, pk)
+	if msg == nil {
+		return reply, err
+	}
+	if len(parts) == 2 {
+		if msg, err = table.UpdateMsgTagWithContext(ctx, pk, user.PK, parts[1], false); err != nil {
+			return &TGReply{Text: err.Error()}, nil
+		}
+		return tgActionsReply(ctx, table, msg, "Tagged #"+NormalizeTag(parts[1]))
+	}
+	counts, err := table.FetchTagsWithContext(ctx, user.PK)
+	if err != nil {
+		return nil, err
+	}
+	markup := &tb.ReplyMarkup{}
+	var row []tb.InlineButton
+	for _, c := range counts {
+		tag := c.Tag()
+		d := parts[0] + "|" + tag
+		if msg.HasTag(tag) || len(TagBtnUnique)+len(d)+2 > maxCallbackData {
+			continue
+		}
+		row = append(row, tb.InlineButton{Unique: TagBtnUnique, Text: "#" + tag, Data: d})
+		if len(row) == 2 {
+			markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+			row = nil
+		}
+		if len(markup.InlineKeyboard)*2+len(row) == maxTagButtons {
+			break
+		}
+	}
+	if len(row) > 0 {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, row)
+	}
+	text := "Pick a tag:"
+	if len(markup.InlineKeyboard) == 0 {
+		text = NO_TAGS
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []tb.InlineButton{
+		{Unique: ActionBtnUnique, Text: "« Back", Data: parts[0]}})
+	return &TGReply{EditText: text, EditMarkup: markup}, nil
+}
@@ -0,0 +1,84 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScenarioTGActions(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	otherUser, _ := NewUser("otheruser")
+	other, _ := NewTGAcc(42, otherUser.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc, otherUser, other) {
+		require.Nil(t, err)
+	}
+	press := func(tgid int, data string) *TGReply {
+		reply, err := HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGCallbackTmpl, tgid, `\f`+data))
+		require.Nil(t, err)
+		return reply
+	}
+	reply, err := HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGTextMsgTmpl, tgid, "buy milk"))
+	require.Nil(t, err)
+	assert.Equal(t, MSG_SAVED, reply.Text)
+	require.NotNil(t, reply.Markup)
+	var labels []string
+	for _, btn := range reply.Markup.InlineKeyboard[0] {
+		labels = append(labels, btn.Text)
+	}
+	assert.Equal(t, []string{"Archive", "Select", "Trash", "Add tag"}, labels)
+
+	msg := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 181, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	id := strings.TrimPrefix(msg.PK, MsgKeyPrefix)
+	assert.Equal(t, id+"|1", reply.Markup.InlineKeyboard[0][0].Data)
+
+	// one tap files the note, folders are made if the user has none
+	reply = press(tgid, ActionBtnUnique+"|"+id+"|1")
+	assert.Equal(t, "Moved to Archive.", reply.Text)
+	assert.Equal(t, "In Archive.", reply.EditText)
+	assert.Equal(t, "Inbox", reply.EditMarkup.InlineKeyboard[0][0].Text)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, int64(1), msg.UMS.Status)
+
+	// buttons do nothing for others
+	reply = press(42, ActionBtnUnique+"|"+id+"|3")
+	assert.Equal(t, "Permission denied", reply.Text)
+	assert.Equal(t, "", reply.EditText)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, int64(1), msg.UMS.Status)
+
+	reply = press(tgid, TagBtnUnique+"|"+id)
+	assert.Equal(t, NO_TAGS, reply.EditText)
+	back := reply.EditMarkup.InlineKeyboard[0][0]
+	assert.Equal(t, id, back.Data)
+
+	tagged, _ := NewMsg(bot.PK, user.PK, TGTextMsgKind)
+	tagged.Tags = []string{"shop", "work"}
+	require.Nil(t, table.StoreItem(tagged))
+	require.Nil(t, table.IndexMsgTagsWithContext(ctx, tagged))
+	reply = press(tgid, TagBtnUnique+"|"+id)
+	assert.Equal(t, "Pick a tag:", reply.EditText)
+	require.Equal(t, 2, len(reply.EditMarkup.InlineKeyboard))
+	assert.Equal(t, 2, len(reply.EditMarkup.InlineKeyboard[0]))
+	reply = press(tgid, TagBtnUnique+"|"+id+"|work")
+	assert.Equal(t, "Tagged #work", reply.Text)
+	assert.Equal(t, "In Archive.\n#work", reply.EditText)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, []string{"work"}, msg.Tags)
+
+	reply = press(tgid, ActionBtnUnique+"|"+back.Data)
+	assert.Equal(t, "", reply.Text)
+	assert.Equal(t, "In Archive.\n#work", reply.EditText)
+}
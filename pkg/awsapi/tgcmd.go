@@ -0,0 +1,628 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const (
+	ListBtnUnique     = "lst"
+	SearchBtnUnique   = "srch"
+	MoveBtnUnique     = "mv"
+	TaskDoneBtnUnique = "tdone"
+
+	// How many Msgs bot shows at once
+	TGPageSize = 10
+	// Telegram limits data of callback button to 64 bytes
+	maxCallbackData = 64
+
+	NO_MSGS        = "Nothing found."
+	NO_SUCH_FOLDER = "There is no such folder."
+	NEED_REPLY     = "Send this command as a reply to a message."
+	NEED_QUERY     = "What to search? /search <text>"
+	MSG_MOVED      = "Moved to %s."
+	TASK_DONE      = "Done."
+	TZ_IS          = "Your time zone is %s."
+	WRONG_TZ       = "Unknown time zone, send it like /tz Europe/Berlin"
+)
+
+// Commands shown in the menu of the bot, /start is not there
+// since only new users need it
+var TGCommands = []tb.Command{
+	{Text: "folders", Description: "Show folders"},
+	{Text: "list", Description: "List messages: /list [folder] [period, like 7d]"},
+	{Text: "search", Description: "Find messages: /search <text>"},
+	{Text: "move", Description: "Reply /move [folder] to a message to move it"},
+	{Text: "todo", Description: "Add a task: /todo <text>, or show open tasks"},
+	{Text: "done", Description: "Reply /done to a task, or pick one to finish"},
+	{Text: "tz", Description: "Show or set your time zone: /tz [Europe/Berlin]"},
+	{Text: "help", Description: "Show commands"},
+}
+
+// Registers commands with Telegram so the menu shows them
+func SetTGCommands(bot *tb.Bot) error {
+	return bot.SetCommands(TGCommands)
+}
+
+// Reply of the bot to Telegram update. For a message Text is sent back
+// with Markup buttons under it, for a callback Text is shown as
+// notification and the message with the button is replaced with
+// EditText and EditMarkup if EditText is set
+type TGReply struct {
+	Text       string
+	Markup     *tb.ReplyMarkup
+	EditText   string
+	EditMarkup *tb.ReplyMarkup
+	// Answer to inline query
+	Results    tb.Results
+	NextOffset string
+}
+
+func textReply(text string, err error) (*TGReply, error) {
+	if text == "" {
+		return nil, err
+	}
+	return &TGReply{Text: text}, err
+}
+
+// Sends reply to the update, callbacks are answered even without
+// reply since Telegram keeps button spinning till then
+func (r *TGReply) Send(bot *tb.Bot, upd *tb.Update) error {
+	if r == nil {
+		r = &TGReply{}
+	}
+	if upd.Query != nil {
+		// Telegram waits for an answer even if there are no results
+		results := r.Results
+		if results == nil {
+			results = tb.Results{}
+		}
+		return bot.Answer(upd.Query, &tb.QueryResponse{Results: results, NextOffset: r.NextOffset,
+			IsPersonal: true, CacheTime: tgInlineCacheTime})
+	}
+	if upd.Message != nil && r.Text != "" {
+		options := []interface{}{}
+		if r.Markup != nil {
+			options = append(options, r.Markup)
+		}
+		if _, err := bot.Send(upd.Message.Chat, r.Text, options...); err != nil {
+			return err
+		}
+	}
+	if upd.Callback == nil {
+		return nil
+	}
+	if r.EditText != "" && upd.Callback.Message != nil {
+		options := []interface{}{}
+		if r.EditMarkup != nil {
+			options = append(options, r.EditMarkup)
+		}
+		if _, err := bot.Edit(upd.Callback.Message, r.EditText, options...); err != nil {
+			return err
+		}
+	}
+	return bot.Respond(upd.Callback, &tb.CallbackResponse{Text: r.Text})
+}
+
+type tgCommandHandler func(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error)
+
+var tgCommandHandlers = map[string]tgCommandHandler{
+	"folders": handleTGFoldersCmd,
+	"list":    handleTGListCmd,
+	"search":  handleTGSearchCmd,
+	"move":    handleTGMoveCmd,
+	"todo":    handleTGTodoCmd,
+	"done":    handleTGDoneCmd,
+	"tz":      handleTGTZCmd,
+	"help":    handleTGHelpCmd,
+}
+
+// Splits text like "/list@somebot Archive 7d" to command and arguments,
+// command is empty if text is not a command
+func tgCommand(text string) (string, string) {
+	if !strings.HasPrefix(text, "/") {
+		return "", ""
+	}
+	cmd, args := text[1:], ""
+	if i := strings.IndexAny(cmd, " \n\t"); i >= 0 {
+		cmd, args = cmd[:i], strings.TrimSpace(cmd[i:])
+	}
+	if i := strings.Index(cmd, "@"); i >= 0 {
+		cmd = cmd[:i]
+	}
+	return strings.ToLower(cmd), args
+}
+
+func handleTGHelpCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	lines := make([]string, len(TGCommands))
+	for i, c := range TGCommands {
+		lines[i] = fmt.Sprintf("/%s - %s", c.Text, c.Description)
+	}
+	return &TGReply{Text: strings.Join(lines, "\n")}, nil
+}
+
+// Shows or sets time zone reminders are read in and dates are shown in
+func handleTGTZCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	if args == "" {
+		return &TGReply{Text: fmt.Sprintf(TZ_IS, user.Location())}, nil
+	}
+	// Local is the zone of the lambda, not the user's one
+	loc, err := time.LoadLocation(args)
+	if err != nil || loc == time.Local {
+		return &TGReply{Text: WRONG_TZ}, nil
+	}
+	if user.Data == nil {
+		user.Data = make(map[string]interface{})
+	}
+	user.Data[UserTZKey] = loc.String()
+	if err = table.StoreItemWithContext(ctx, user); err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: fmt.Sprintf(TZ_IS, loc)}, nil
+}
+
+func handleTGTodoCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	return textReply(handleTGTodoMsg(ctx, bot, table, user, tgmsg, args))
+}
+
+func folderID(f *Folder) int64 {
+	id, _ := strconv.ParseInt(PK2ID(FolderKeyPrefix, f.SK), 10, 64)
+	return id
+}
+
+// Finds folder of the user by title or id, INBOX if name is empty.
+// Returns nil if there is no such folder or the user can not read it
+func findTGFolder(ctx context.Context, table *DTable, user *User, name string) (*Folder, error) {
+	var folders []*Folder
+	if err := table.FetchItemsWithPrefixWithContext(ctx, user.PK, FolderKeyPrefix, &folders); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = "0"
+	}
+	for _, f := range folders {
+		if strings.EqualFold(f.Title, name) || PK2ID(FolderKeyPrefix, f.SK) == name {
+			ok, err := user.HasPermWithContext(ctx, table, f.PK, f.SK, "tr")
+			if err != nil || !ok {
+				return nil, err
+			}
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+func handleTGFoldersCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	var folders []*Folder
+	if err := table.FetchItemsWithPrefixWithContext(ctx, user.PK, FolderKeyPrefix, &folders); err != nil {
+		return nil, err
+	}
+	if len(folders) == 0 {
+		return &TGReply{Text: NO_SUCH_FOLDER}, nil
+	}
+	markup := &tb.ReplyMarkup{}
+	for _, f := range folders {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tb.InlineButton{{
+			Unique: ListBtnUnique, Text: f.Title, Data: fmt.Sprintf("%d|0|0", folderID(f)),
+		}})
+	}
+	return &TGReply{Text: "Folders:", Markup: markup}, nil
+}
+
+var periodRegexp = regexp.MustCompile(`^-?\d+d$|^\d{4}-\d{2}-\d{2}`)
+
+// Parses arguments of /list, "[folder] [period]", period is like 7d
+// or a date messages are listed since
+func parseListArgs(args string) (string, int64, error) {
+	fields := strings.Fields(args)
+	var since int64
+	if n := len(fields); n > 0 && periodRegexp.MatchString(fields[n-1]) {
+		period := fields[n-1]
+		if !strings.HasPrefix(period, "-") && strings.HasSuffix(period, "d") {
+			period = "-" + period
+		}
+		t, err := StrToTime(period)
+		if err != nil {
+			return "", 0, err
+		}
+		since = t.Unix()
+		fields = fields[:n-1]
+	}
+	return strings.Join(fields, " "), since, nil
+}
+
+func handleTGListCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	name, since, err := parseListArgs(args)
+	if err != nil {
+		return &TGReply{Text: err.Error()}, nil
+	}
+	folder, err := findTGFolder(ctx, table, user, name)
+	if err != nil {
+		return nil, err
+	}
+	if folder == nil {
+		return &TGReply{Text: NO_SUCH_FOLDER}, nil
+	}
+	text, markup, err := tgListPage(ctx, table, user, folder, since, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: text, Markup: markup}, nil
+}
+
+// Text and buttons of one page of Msgs in folder, newest first
+func tgListPage(ctx context.Context, table *DTable, user *User, folder *Folder,
+	since int64, offset int) (string, *tb.ReplyMarkup, error) {
+	id := folderID(folder)
+	lm := NewListMsg()
+	err := lm.FetchByUMSPageWithContext(ctx, table, user.PK, fmt.Sprintf("%s#%d", folder.PK, id),
+		since, time.Now().Unix()+1, PageOpts{Limit: int64(offset + TGPageSize + 1), Desc: true})
+	if err != nil {
+		return "", nil, err
+	}
+	pks, more := pagePKs(lm.Desc(), offset)
+	msgs, err := fetchMsgsInOrder(ctx, table, pks)
+	if err != nil {
+		return "", nil, err
+	}
+	text := fmt.Sprintf("%s:\n%s", folder.Title, msgLines(msgs, offset, user.Location()))
+	markup := pageMarkup(offset, more, func(offset int) string {
+		return fmt.Sprintf("%d|%d|%d", id, since, offset)
+	}, ListBtnUnique)
+	return text, markup, nil
+}
+
+// PKs of Msgs on the page which starts at offset, more tells if there
+// are Msgs after it
+func pagePKs(msgs []*Msg, offset int) ([]string, bool) {
+	var pks []string
+	for i := offset; i < len(msgs) && i < offset+TGPageSize; i++ {
+		pks = append(pks, msgs[i].PK)
+	}
+	return pks, len(msgs) > offset+TGPageSize
+}
+
+// Fetches Msgs by PKs keeping the order, Msgs deleted since are skipped
+func fetchMsgsInOrder(ctx context.Context, table *DTable, pks []string) ([]*Msg, error) {
+	keys := make([]ItemKey, len(pks))
+	for i, pk := range pks {
+		keys[i] = ItemKey{PK: pk, SK: pk}
+	}
+	var fetched []*Msg
+	for _, err := range table.BatchFetchWithContext(ctx, keys, &fetched) {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	byPK := make(map[string]*Msg, len(fetched))
+	for _, m := range fetched {
+		byPK[m.PK] = m
+	}
+	msgs := make([]*Msg, 0, len(fetched))
+	for _, pk := range pks {
+		if m, ok := byPK[pk]; ok {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+// Numbered lines with summary of Msgs, numbers start after offset,
+// dates are in loc
+func msgLines(msgs []*Msg, offset int, loc *time.Location) string {
+	if len(msgs) == 0 {
+		return NO_MSGS
+	}
+	lines := make([]string, len(msgs))
+	for i, m := range msgs {
+		text := msgSummary(m, 100)
+		if text == "" {
+			text = "(no text)"
+		}
+		lines[i] = fmt.Sprintf("%d. %s %s", offset+i+1,
+			time.Unix(m.CreatedAt, 0).In(loc).Format("Jan 2"), text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Prev and Next buttons, data returns data of the button for page offset.
+// Buttons which data does not fit Telegram limit are left out
+func pageMarkup(offset int, more bool, data func(int) string, unique string) *tb.ReplyMarkup {
+	var row []tb.InlineButton
+	add := func(text string, offset int) {
+		d := data(offset)
+		if len(unique)+len(d)+2 <= maxCallbackData {
+			row = append(row, tb.InlineButton{Unique: unique, Text: text, Data: d})
+		}
+	}
+	if offset > 0 {
+		prev := offset - TGPageSize
+		if prev < 0 {
+			prev = 0
+		}
+		add("« Prev", prev)
+	}
+	if more {
+		add("Next »", offset+TGPageSize)
+	}
+	if len(row) == 0 {
+		return nil
+	}
+	return &tb.ReplyMarkup{InlineKeyboard: [][]tb.InlineButton{row}}
+}
+
+func handleTGSearchCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	if args == "" {
+		return &TGReply{Text: NEED_QUERY}, nil
+	}
+	text, markup, err := tgSearchPage(ctx, table, user, args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: text, Markup: markup}, nil
+}
+
+func tgSearchPage(ctx context.Context, table *DTable, user *User,
+	query string, offset int) (string, *tb.ReplyMarkup, error) {
+	results, err := table.SearchWithContext(ctx, user.PK, query, offset+TGPageSize+1)
+	if err != nil {
+		return "", nil, err
+	}
+	found := make([]*Msg, len(results))
+	for i, r := range results {
+		found[i] = r.Msg
+	}
+	pks, more := pagePKs(found, offset)
+	msgs, err := fetchMsgsInOrder(ctx, table, pks)
+	if err != nil {
+		return "", nil, err
+	}
+	markup := pageMarkup(offset, more, func(offset int) string {
+		return fmt.Sprintf("%d|%s", offset, query)
+	}, SearchBtnUnique)
+	return fmt.Sprintf("Search %q:\n%s", query, msgLines(msgs, offset, user.Location())), markup, nil
+}
+
+// Fetches Msg the command message replies to, nil if there is no such
+// Msg or it is not the user's
+func tgRepliedMsg(ctx context.Context, bot *Bot, table *DTable, user *User, tgmsg *tb.Message) (*Msg, error) {
+	if tgmsg.ReplyTo == nil {
+		return nil, nil
+	}
+	msg := &Msg{}
+	err := table.FetchMsgByTGWithContext(ctx, bot.PK, tgmsg.ReplyTo, msg)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg.UMS.PK != user.PK {
+		return nil, nil
+	}
+	return msg, nil
+}
+
+func handleTGMoveCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	msg, err := tgRepliedMsg(ctx, bot, table, user, tgmsg)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return &TGReply{Text: NEED_REPLY}, nil
+	}
+	if args != "" {
+		return textReply(moveTGMsg(ctx, table, user, msg.PK, args))
+	}
+	var folders []*Folder
+	if err := table.FetchItemsWithPrefixWithContext(ctx, user.PK, FolderKeyPrefix, &folders); err != nil {
+		return nil, err
+	}
+	id := strings.TrimPrefix(msg.PK, MsgKeyPrefix)
+	markup := &tb.ReplyMarkup{}
+	var row []tb.InlineButton
+	for _, f := range folders {
+		if f.PK == msg.UMS.PK && folderID(f) == msg.UMS.Status {
+			continue
+		}
+		row = append(row, tb.InlineButton{Unique: MoveBtnUnique, Text: f.Title,
+			Data: fmt.Sprintf("%s|%d", id, folderID(f))})
+	}
+	if len(row) == 0 {
+		return &TGReply{Text: NO_SUCH_FOLDER}, nil
+	}
+	markup.InlineKeyboard = [][]tb.InlineButton{row}
+	return &TGReply{Text: "Move to:", Markup: markup}, nil
+}
+
+// Moves Msg of the user to the folder given by title or id,
+// returns text for the user
+func moveTGMsg(ctx context.Context, table *DTable, user *User, pk, name string) (string, error) {
+	folder, err := findTGFolder(ctx, table, user, name)
+	if err != nil {
+		return "", err
+	}
+	if folder == nil {
+		return NO_SUCH_FOLDER, nil
+	}
+	ok, err := user.HasPermWithContext(ctx, table, folder.PK, folder.SK, "t")
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "Permission denied", nil
+	}
+	ums := UMSField{PK: folder.PK, Status: folderID(folder)}
+	for attempt := 1; ; attempt++ {
+		msg := &Msg{}
+		err = table.FetchItemWithContext(ctx, pk, msg)
+		if errors.Is(err, ErrNotFound) {
+			return "Message is not found", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if msg.UMS.PK != user.PK {
+			return "Permission denied", nil
+		}
+		msg.MoveTo(ums, folder.Kind == FolderTrashKind)
+		err = table.StoreMsgIfVersionWithContext(ctx, msg, msg.Version)
+		if err == nil {
+			return fmt.Sprintf(MSG_MOVED, folder.Title), nil
+		}
+		if attempt == msgUpdateAttempts || !errors.Is(err, ErrVersionConflict) {
+			return "", err
+		}
+	}
+}
+
+func handleTGDoneCmd(ctx context.Context, bot *Bot, table *DTable, user *User,
+	tgmsg *tb.Message, args string) (*TGReply, error) {
+	msg, err := tgRepliedMsg(ctx, bot, table, user, tgmsg)
+	if err != nil {
+		return nil, err
+	}
+	if msg != nil {
+		return textReply(finishTGTask(ctx, table, user, msg.PK))
+	}
+	text, markup, err := tgOpenTasks(ctx, table, user)
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: text, Markup: markup}, nil
+}
+
+// Marks Msg done, Msg which is not a task becomes a done one
+func finishTGTask(ctx context.Context, table *DTable, user *User, pk string) (string, error) {
+	msg := &Msg{}
+	err := table.FetchItemWithContext(ctx, pk, msg)
+	if errors.Is(err, ErrNotFound) {
+		return "Message is not found", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if msg.TaskState == "" {
+		if _, err = table.TransitTaskWithContext(ctx, pk, user.PK, TaskTodo, ""); err != nil {
+			return tgTaskErrText(err)
+		}
+	}
+	if _, err = table.TransitTaskWithContext(ctx, pk, user.PK, TaskDone, ""); err != nil {
+		return tgTaskErrText(err)
+	}
+	return TASK_DONE, nil
+}
+
+// Text for the user if task change failed because it can not be done,
+// other errors are returned
+func tgTaskErrText(err error) (string, error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return "Message is not found", nil
+	case errors.Is(err, ErrTaskPermission), errors.Is(err, ErrWrongTaskState),
+		errors.Is(err, ErrWrongTaskTransition):
+		return err.Error(), nil
+	}
+	return "", err
+}
+
+// Open tasks of the user with button to finish each of them
+func tgOpenTasks(ctx context.Context, table *DTable, user *User) (string, *tb.ReplyMarkup, error) {
+	lm := NewListMsg()
+	if err := lm.FetchOpenTasksWithContext(ctx, table, user.PK); err != nil {
+		return "", nil, err
+	}
+	pks, _ := pagePKs(lm.Asc(), 0)
+	msgs, err := fetchMsgsInOrder(ctx, table, pks)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(msgs) == 0 {
+		return NO_TASKS, nil, nil
+	}
+	markup := &tb.ReplyMarkup{}
+	for _, m := range msgs {
+		text := msgSummary(m, 40)
+		if text == "" {
+			text = "(no text)"
+		}
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []tb.InlineButton{{
+			Unique: TaskDoneBtnUnique, Text: "✓ " + text, Data: strings.TrimPrefix(m.PK, MsgKeyPrefix),
+		}})
+	}
+	return "Which one is done?", markup, nil
+}
+
+// Handles Prev and Next buttons of /list and folder buttons of /folders
+func handleTGListCallback(ctx context.Context, table *DTable, user *User, data string) (*TGReply, error) {
+	parts := strings.Split(data, "|")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+	since, _ := strconv.ParseInt(parts[1], 10, 64)
+	offset, _ := strconv.Atoi(parts[2])
+	folder, err := findTGFolder(ctx, table, user, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if folder == nil {
+		return &TGReply{Text: NO_SUCH_FOLDER}, nil
+	}
+	text, markup, err := tgListPage(ctx, table, user, folder, since, offset)
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{EditText: text, EditMarkup: markup}, nil
+}
+
+func handleTGSearchCallback(ctx context.Context, table *DTable, user *User, data string) (*TGReply, error) {
+	parts := strings.SplitN(data, "|", 2)
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	offset, _ := strconv.Atoi(parts[0])
+	text, markup, err := tgSearchPage(ctx, table, user, parts[1], offset)
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{EditText: text, EditMarkup: markup}, nil
+}
+
+func handleTGMoveCallback(ctx context.Context, table *DTable, user *User, data string) (*TGReply, error) {
+	parts := strings.Split(data, "|")
+	if len(parts) != 2 {
+		return nil, nil
+	}
+	text, err := moveTGMsg(ctx, table, user, MsgKeyPrefix+parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: text, EditText: text}, nil
+}
+
+func handleTGTaskDoneCallback(ctx context.Context, table *DTable, user *User, data string) (*TGReply, error) {
+	resp, err := finishTGTask(ctx, table, user, MsgKeyPrefix+data)
+	if err != nil {
+		return nil, err
+	}
+	text, markup, err := tgOpenTasks(ctx, table, user)
+	if err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: resp, EditText: text, EditMarkup: markup}, nil
+}
@@ -0,0 +1,171 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTGCommand(t *testing.T) {
+	cmd, args := tgCommand("/list@foobot Archive 7d")
+	assert.Equal(t, "list", cmd)
+	assert.Equal(t, "Archive 7d", args)
+	cmd, args = tgCommand("/Help")
+	assert.Equal(t, "help", cmd)
+	assert.Equal(t, "", args)
+	cmd, _ = tgCommand("buy milk")
+	assert.Equal(t, "", cmd)
+
+	name, since, err := parseListArgs("Archive 7d")
+	require.Nil(t, err)
+	assert.Equal(t, "Archive", name)
+	assert.InDelta(t, time.Now().AddDate(0, 0, -7).Unix(), since, 2)
+	name, since, err = parseListArgs("My notes")
+	require.Nil(t, err)
+	assert.Equal(t, "My notes", name)
+	assert.Equal(t, int64(0), since)
+}
+
+func TestScenarioTGCommands(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	require.Nil(t, user.EnsureDefaultFolders(table))
+	send := func(id int, text string) *TGReply {
+		reply, err := HandleTGUpdate(ctx, bot, table,
+			fmt.Sprintf(TGMediaMsgTmpl, tgid, id, fmt.Sprintf(`"text": %q`, text)))
+		require.Nil(t, err)
+		return reply
+	}
+	press := func(data string) *TGReply {
+		reply, err := HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGCallbackTmpl, tgid, `\f`+data))
+		require.Nil(t, err)
+		return reply
+	}
+	for i := 0; i < TGPageSize+2; i++ {
+		assert.Equal(t, MSG_SAVED, send(100+i, fmt.Sprintf("note %d about milk", i)).Text)
+		// search index is made by stream handler
+		msg := &Msg{}
+		require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 100 + i, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+		require.Nil(t, table.IndexMsgWithContext(ctx, msg))
+	}
+
+	reply := send(200, "/help")
+	assert.True(t, strings.Contains(reply.Text, "/list - "))
+
+	reply = send(201, "/folders")
+	require.NotNil(t, reply.Markup)
+	require.Equal(t, 4, len(reply.Markup.InlineKeyboard))
+	assert.Equal(t, "INBOX", reply.Markup.InlineKeyboard[0][0].Text)
+	assert.Equal(t, "0|0|0", reply.Markup.InlineKeyboard[0][0].Data)
+
+	reply = send(202, "/list")
+	assert.True(t, strings.HasPrefix(reply.Text, "INBOX:\n1. "))
+	assert.Equal(t, TGPageSize+1, len(strings.Split(reply.Text, "\n")))
+	require.NotNil(t, reply.Markup)
+	next := reply.Markup.InlineKeyboard[0][0]
+	assert.Equal(t, "Next »", next.Text)
+	assert.Equal(t, fmt.Sprintf("0|0|%d", TGPageSize), next.Data)
+	reply = press(ListBtnUnique + "|" + next.Data)
+	assert.Equal(t, 3, len(strings.Split(reply.EditText, "\n")))
+	assert.True(t, strings.Contains(reply.EditText, fmt.Sprintf("\n%d. ", TGPageSize+1)))
+	assert.Equal(t, "« Prev", reply.EditMarkup.InlineKeyboard[0][0].Text)
+	assert.Equal(t, NO_SUCH_FOLDER, send(203, "/list Nosuch").Text)
+	assert.Equal(t, "Archive:\n"+NO_MSGS, send(204, "/list archive 7d").Text)
+
+	reply = send(205, "/search milk")
+	assert.True(t, strings.HasPrefix(reply.Text, `Search "milk":`))
+	require.NotNil(t, reply.Markup)
+	assert.Equal(t, fmt.Sprintf("%d|milk", TGPageSize), reply.Markup.InlineKeyboard[0][0].Data)
+	assert.Equal(t, NEED_QUERY, send(206, "/search").Text)
+
+	// /move and /done work on the message they reply to
+	assert.Equal(t, NEED_REPLY, send(207, "/move Archive").Text)
+	reply, err := HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 208, 100, "/move Archive"))
+	require.Nil(t, err)
+	assert.Equal(t, "Moved to Archive.", reply.Text)
+	msg := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 100, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	assert.Equal(t, int64(1), msg.UMS.Status)
+
+	reply, err = HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 209, 100, "/move"))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(reply.Markup.InlineKeyboard[0]))
+	id := strings.TrimPrefix(msg.PK, MsgKeyPrefix)
+	assert.Equal(t, id+"|0", reply.Markup.InlineKeyboard[0][0].Data)
+	reply = press(MoveBtnUnique + "|" + id + "|3")
+	assert.Equal(t, "Moved to Trash.", reply.Text)
+	require.Nil(t, msg.Reload(table))
+	assert.Equal(t, int64(3), msg.UMS.Status)
+	assert.NotEqual(t, int64(0), msg.TrashedAt)
+
+	reply, err = HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 210, 101, "/done"))
+	require.Nil(t, err)
+	assert.Equal(t, TASK_DONE, reply.Text)
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 101, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	assert.Equal(t, TaskDone, msg.TaskState)
+
+	assert.Equal(t, NO_TASKS, send(211, "/done").Text)
+	assert.Equal(t, TASK_ADDED, send(212, "/todo call mom").Text)
+	reply = send(213, "/done")
+	require.Equal(t, 1, len(reply.Markup.InlineKeyboard))
+	btn := reply.Markup.InlineKeyboard[0][0]
+	assert.Equal(t, "✓ call mom", btn.Text)
+	reply = press(TaskDoneBtnUnique + "|" + btn.Data)
+	assert.Equal(t, TASK_DONE, reply.Text)
+	assert.Equal(t, NO_TASKS, reply.EditText)
+
+	// not a command the bot knows, stored as note
+	assert.Equal(t, MSG_SAVED, send(214, "/whatever").Text)
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 214, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	assert.Equal(t, "/whatever", msg.Data["text"])
+
+	assert.Equal(t, fmt.Sprintf(TZ_IS, "UTC"), send(216, "/tz").Text)
+	assert.Equal(t, WRONG_TZ, send(217, "/tz Mars/Olympus").Text)
+	assert.Equal(t, fmt.Sprintf(TZ_IS, "Asia/Tokyo"), send(218, "/tz Asia/Tokyo").Text)
+	require.Nil(t, table.FetchItem(user.PK, user))
+	assert.Equal(t, "Asia/Tokyo", user.Location().String())
+	// reminders are read in the user's time zone now
+	send(219, "call mom remind me tomorrow 9:00")
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 219, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	due := time.Unix(msg.DueAt, 0).In(user.Location())
+	assert.Equal(t, 9, due.Hour())
+
+	// Msg 100 is in Trash, there is nowhere else to move it
+	for _, n := range []int{0, 1, 2} {
+		require.Nil(t, table.DeleteSubItem(user.PK, fmt.Sprintf("%s%d", FolderKeyPrefix, n)))
+	}
+	reply, err = HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 215, 100, "/move"))
+	require.Nil(t, err)
+	assert.Equal(t, NO_SUCH_FOLDER, reply.Text)
+	assert.Nil(t, reply.Markup)
+}
+
+func TestTGTaskErrText(t *testing.T) {
+	text, err := tgTaskErrText(ErrTaskPermission)
+	require.Nil(t, err)
+	assert.Equal(t, "Permission denied", text)
+	text, err = tgTaskErrText(&TaskTransitionError{From: TaskDone, To: TaskInProgress})
+	require.Nil(t, err)
+	assert.Equal(t, `Task can not go from "done" to "in_progress"`, text)
+	text, err = tgTaskErrText(newNotFoundErr())
+	require.Nil(t, err)
+	assert.Equal(t, "Message is not found", text)
+	// failures are not shown to the user as replies
+	_, err = tgTaskErrText(&StorageError{Kind: ErrThrottled})
+	assert.True(t, errors.Is(err, ErrThrottled))
+}
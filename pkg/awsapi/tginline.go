@@ -0,0 +1,110 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const (
+	// Telegram allows up to 50 results per answer
+	TGInlinePageSize = 20
+	// Results are the user's own notes, so cache them shortly
+	tgInlineCacheTime = 10
+)
+
+// Answers inline query "@bot <text>" with the user's own Msgs found
+// by text, unlinked Telegram accounts get nothing
+func handleTGInlineQuery(ctx context.Context, bot *Bot, table *DTable, query *tb.Query) (*TGReply, error) {
+	reply := &TGReply{}
+	text := strings.TrimSpace(query.Text)
+	if text == "" {
+		return reply, nil
+	}
+	tgacc := &TGAcc{}
+	err := table.FetchTGAccWithContext(ctx, query.From.ID, tgacc)
+	if errors.Is(err, ErrNotFound) {
+		return reply, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user := &User{}
+	if err = table.FetchItemWithContext(ctx, tgacc.OwnerPK, user); err != nil {
+		return nil, err
+	}
+	offset, _ := strconv.Atoi(query.Offset)
+	if offset < 0 {
+		offset = 0
+	}
+	results, err := table.SearchWithContext(ctx, tgacc.OwnerPK, text, 0)
+	if err != nil {
+		return nil, err
+	}
+	// search covers shared folders too, only own notes are offered,
+	// they are filtered before paging so pages are full
+	var own []*Msg
+	for _, r := range results {
+		if r.Msg.UMS.PK == tgacc.OwnerPK {
+			own = append(own, r.Msg)
+		}
+	}
+	var pks []string
+	for i := offset; i < len(own) && i < offset+TGInlinePageSize; i++ {
+		pks = append(pks, own[i].PK)
+	}
+	if len(own) > offset+TGInlinePageSize {
+		reply.NextOffset = strconv.Itoa(offset + TGInlinePageSize)
+	}
+	msgs, err := fetchMsgsInOrder(ctx, table, pks)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if r := tgInlineResult(bot, m, user.Location()); r != nil {
+			reply.Results = append(reply.Results, r)
+		}
+	}
+	return reply, nil
+}
+
+// Inline result for Msg. Photos and voices are sent by Telegram file id
+// which is only valid for the bot Msg came through, other Msgs are
+// articles with their text dated in loc. Nil if there is nothing to send
+func tgInlineResult(bot *Bot, msg *Msg, loc *time.Location) tb.Result {
+	id := strings.TrimPrefix(msg.PK, MsgKeyPrefix)
+	text := msgSummary(msg, 4000)
+	if msg.ChannelPK == bot.PK {
+		upd := &tb.Update{}
+		orig, _ := msg.Data["orig"].(string)
+		if orig != "" && json.Unmarshal([]byte(orig), upd) == nil && upd.Message != nil {
+			switch {
+			case msg.Kind == TGPhotoMsgKind && upd.Message.Photo != nil:
+				r := &tb.PhotoResult{Cache: upd.Message.Photo.FileID, Caption: msgSummary(msg, 1000)}
+				r.ID = id
+				return r
+			case msg.Kind == TGVoiceMsgKind && upd.Message.Voice != nil:
+				title := msgSummary(msg, 60)
+				if title == "" {
+					title = "Voice " + time.Unix(msg.CreatedAt, 0).In(loc).Format("Jan 2")
+				}
+				r := &tb.VoiceResult{Cache: upd.Message.Voice.FileID, Title: title,
+					Duration: upd.Message.Voice.Duration}
+				r.ID = id
+				return r
+			}
+		}
+	}
+	if text == "" {
+		return nil
+	}
+	r := &tb.ArticleResult{Title: msgSummary(msg, 60), Text: text,
+		Description: time.Unix(msg.CreatedAt, 0).In(loc).Format("Jan 2")}
+	r.ID = id
+	return r
+}
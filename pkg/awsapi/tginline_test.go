@@ -0,0 +1,87 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// %[1]d tgid, %[2]s query, %[3]s offset
+const TGInlineQueryTmpl = `{"update_id": 45554210,
+  "inline_query": {
+    "id": "4382bfdwdsb323b2e1",
+    "from": {"id": %[1]d, "is_bot": false, "first_name": "D"},
+    "query": "%[2]s",
+    "offset": "%[3]s"}
+}`
+
+func TestScenarioTGInlineQuery(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	bodies := []string{
+		`"text": "buy milk and bread"`,
+		`"photo": [{"file_id": "milkpic", "file_unique_id": "um", "width": 90, "height": 60}],
+		 "caption": "milk receipt"`,
+		`"text": "call mom"`,
+	}
+	for i, body := range bodies {
+		_, err := HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGMediaMsgTmpl, tgid, 300+i, body))
+		require.Nil(t, err)
+		msg := &Msg{}
+		require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 300 + i, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+		require.Nil(t, table.IndexMsgWithContext(ctx, msg))
+	}
+	query := func(tgid int, text, offset string) *TGReply {
+		reply, err := HandleTGUpdate(ctx, bot, table, fmt.Sprintf(TGInlineQueryTmpl, tgid, text, offset))
+		require.Nil(t, err)
+		require.NotNil(t, reply)
+		return reply
+	}
+
+	reply := query(tgid, "milk", "")
+	require.Equal(t, 2, len(reply.Results))
+	assert.Equal(t, "", reply.NextOffset)
+	var article *tb.ArticleResult
+	var photo *tb.PhotoResult
+	for _, r := range reply.Results {
+		switch r := r.(type) {
+		case *tb.ArticleResult:
+			article = r
+		case *tb.PhotoResult:
+			photo = r
+		}
+	}
+	require.NotNil(t, article)
+	assert.Equal(t, "buy milk and bread", article.Text)
+	require.NotNil(t, photo)
+	assert.Equal(t, "milkpic", photo.Cache)
+	assert.Equal(t, "milk receipt", photo.Caption)
+
+	assert.Equal(t, 0, len(query(tgid, "milk", "20").Results))
+
+	// trashed notes are not offered
+	require.Nil(t, user.EnsureDefaultFolders(table))
+	trashed := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 301, Chat: &tb.Chat{ID: int64(tgid)}}, trashed))
+	trashed.MoveTo(UMSField{PK: user.PK, Status: 3}, true)
+	require.Nil(t, table.StoreItem(trashed))
+	require.Nil(t, table.IndexMsgWithContext(ctx, trashed))
+	reply = query(tgid, "milk", "")
+	require.Equal(t, 1, len(reply.Results))
+	assert.IsType(t, &tb.ArticleResult{}, reply.Results[0])
+	assert.Equal(t, 0, len(query(tgid, "", "").Results))
+	// unlinked Telegram account finds nothing
+	assert.Equal(t, 0, len(query(42, "milk", "").Results))
+}
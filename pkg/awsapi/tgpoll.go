@@ -0,0 +1,164 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const TGPollKeyPrefix = "tgpoll#"
+
+// How long to wait before asking Telegram again or handling update
+// again after it failed
+var TGPollRetryDelay = 5 * time.Second
+
+// Polling stops if update still fails after that many attempts, so it
+// is not lost and the next run starts from it
+const tgPollAttempts = 3
+
+// Where long polling of the bot stopped, PK is tgpoll#<bot PK>
+type TGPollState struct {
+	PK           string
+	SK           string
+	LastUpdateID int   `dynamodbav:"LU"`
+	UpdatedAt    int64 `dynamodbav:"UPD"`
+}
+
+func NewTGPollState(botPK string) *TGPollState {
+	pk := TGPollKeyPrefix + botPK
+	return &TGPollState{PK: pk, SK: pk}
+}
+
+// Sends reply of the bot to the update
+type TGReplyFunc func(reply *TGReply, upd *tb.Update) error
+
+// Handles raw update the same way whether it came via webhook or
+// long polling. Errors of sending the reply are only logged since
+// the update is stored already
+func ProcessTGUpdate(ctx context.Context, bot *Bot, table *DTable, orig string, send TGReplyFunc) error {
+	reply, err := HandleTGUpdate(ctx, bot, table, orig)
+	if err != nil {
+		return err
+	}
+	var upd tb.Update
+	_ = json.Unmarshal([]byte(orig), &upd)
+	// Telegram keeps button spinning till callback is answered,
+	// inline query waits for answer as well
+	if reply != nil || upd.Callback != nil || upd.Query != nil {
+		if err = send(reply, &upd); err != nil {
+			log.Printf("Could not reply %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Gets raw updates starting from offset, see getTGUpdates
+type TGUpdatesFunc func(offset int) ([]json.RawMessage, error)
+
+// Long polls updates of the bot and handles them till ctx is done.
+// Webhook is removed since Telegram does not give updates otherwise
+func PollTG(ctx context.Context, bot *Bot, table *DTable, tgbot *tb.Bot, timeout time.Duration) error {
+	if err := tgbot.RemoveWebhook(); err != nil {
+		return err
+	}
+	updates := func(offset int) ([]json.RawMessage, error) {
+		return getTGUpdates(tgbot, offset, timeout)
+	}
+	send := func(reply *TGReply, upd *tb.Update) error {
+		return reply.Send(tgbot, upd)
+	}
+	return pollTG(ctx, bot, table, updates, send)
+}
+
+func pollTG(ctx context.Context, bot *Bot, table *DTable, updates TGUpdatesFunc, send TGReplyFunc) error {
+	state := NewTGPollState(bot.PK)
+	err := table.FetchItemWithContext(ctx, state.PK, state)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	for ctx.Err() == nil {
+		raws, err := updates(state.LastUpdateID + 1)
+		if err != nil {
+			log.Printf("Could not get updates %s", err.Error())
+			waitTGPoll(ctx)
+			continue
+		}
+		for _, raw := range raws {
+			var upd tb.Update
+			if err := json.Unmarshal(raw, &upd); err != nil {
+				// it would come first every time otherwise
+				log.Printf("ERROR skipping malformed update %s: %s", string(raw), err.Error())
+				var id struct {
+					ID int `json:"update_id"`
+				}
+				if json.Unmarshal(raw, &id) != nil || id.ID == 0 {
+					return err
+				}
+				upd.ID = id.ID
+			} else if err := processTGPollUpdate(ctx, bot, table, string(raw), send); errors.Is(err, ErrTGUpdateNotSupported) {
+				log.Printf("Skipping update %d: %s", upd.ID, err.Error())
+			} else if err != nil {
+				if ctx.Err() != nil {
+					// stopped, the update is handled again next run
+					return nil
+				}
+				return fmt.Errorf("update %d: %w", upd.ID, err)
+			}
+			state.LastUpdateID = upd.ID
+			state.UpdatedAt = time.Now().Unix()
+			// state is stored even if polling is being stopped
+			if err := table.StoreItemWithContext(context.Background(), state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handles update retrying it, handling is safe to repeat
+func processTGPollUpdate(ctx context.Context, bot *Bot, table *DTable, orig string, send TGReplyFunc) error {
+	var err error
+	for attempt := 1; attempt <= tgPollAttempts; attempt++ {
+		err = ProcessTGUpdate(ctx, bot, table, orig, send)
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrTGUpdateNotSupported) {
+			return err
+		}
+		log.Printf("ERROR processing update, attempt %d: %s", attempt, err.Error())
+		if attempt < tgPollAttempts {
+			waitTGPoll(ctx)
+		}
+	}
+	return err
+}
+
+func waitTGPoll(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(TGPollRetryDelay):
+	}
+}
+
+// Raw updates are kept to store them as Telegram sent them,
+// telebot drops fields it does not know
+func getTGUpdates(tgbot *tb.Bot, offset int, timeout time.Duration) ([]json.RawMessage, error) {
+	data, err := tgbot.Raw("getUpdates", map[string]string{
+		"offset":  strconv.Itoa(offset),
+		"timeout": strconv.Itoa(int(timeout / time.Second)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Result []json.RawMessage
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,146 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollTG(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	origDelay := TGPollRetryDelay
+	TGPollRetryDelay = time.Millisecond
+	defer func() { TGPollRetryDelay = origDelay }()
+
+	batches := [][]json.RawMessage{
+		{
+			json.RawMessage(fmt.Sprintf(TGMediaMsgTmpl, tgid, 500, `"text": "buy milk"`)),
+			json.RawMessage(fmt.Sprintf(TGMediaMsgTmpl, tgid, 501, `"text": "call mom"`)),
+		},
+		{json.RawMessage(fmt.Sprintf(TGCallbackTmpl, tgid, `\fnosuch|1`))},
+	}
+	run := func(batches [][]json.RawMessage) ([]int, []string) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var offsets []int
+		failed := false
+		updates := func(offset int) ([]json.RawMessage, error) {
+			offsets = append(offsets, offset)
+			// Telegram fails now and then, polling goes on
+			if !failed {
+				failed = true
+				return nil, errors.New("Bad Gateway")
+			}
+			if len(batches) == 0 {
+				cancel()
+				return nil, nil
+			}
+			batch := batches[0]
+			batches = batches[1:]
+			return batch, nil
+		}
+		var sent []string
+		send := func(reply *TGReply, upd *tb.Update) error {
+			if reply == nil {
+				sent = append(sent, "")
+			} else {
+				sent = append(sent, reply.Text)
+			}
+			return nil
+		}
+		require.Nil(t, pollTG(ctx, bot, table, updates, send))
+		return offsets, sent
+	}
+
+	offsets, sent := run(batches)
+	assert.Equal(t, []int{1, 1, 502, 45554191}, offsets)
+	assert.Equal(t, []string{MSG_SAVED, MSG_SAVED, ""}, sent)
+	state := NewTGPollState(bot.PK)
+	require.Nil(t, table.FetchItem(state.PK, state))
+	assert.Equal(t, 45554190, state.LastUpdateID)
+	msg := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 501, Chat: &tb.Chat{ID: int64(tgid)}}, msg))
+	assert.Equal(t, "call mom", msg.Data["text"])
+
+	// restart resumes after the last update
+	offsets, sent = run(nil)
+	assert.Equal(t, []int{45554191, 45554191}, offsets)
+	assert.Equal(t, 0, len(sent))
+}
+
+func TestPollTGFailures(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	// account of user who is gone, its updates keep failing
+	broken, _ := NewTGAcc(77, "user#gone")
+	for _, err := range table.StoreItems(bot, user, tgacc, broken) {
+		require.Nil(t, err)
+	}
+	origDelay := TGPollRetryDelay
+	TGPollRetryDelay = time.Millisecond
+	defer func() { TGPollRetryDelay = origDelay }()
+	lastUpdateID := func() int {
+		state := NewTGPollState(bot.PK)
+		require.Nil(t, table.FetchItem(state.PK, state))
+		return state.LastUpdateID
+	}
+	feed := func(ctx context.Context, raws ...string) TGUpdatesFunc {
+		return func(offset int) ([]json.RawMessage, error) {
+			var batch []json.RawMessage
+			for _, raw := range raws {
+				batch = append(batch, json.RawMessage(raw))
+			}
+			raws = nil
+			if batch == nil {
+				<-ctx.Done()
+			}
+			return batch, nil
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var sent []string
+	send := func(reply *TGReply, upd *tb.Update) error {
+		sent = append(sent, reply.Text)
+		// Ctrl+C while update is handled
+		cancel()
+		return nil
+	}
+	err := pollTG(ctx, bot, table, feed(ctx,
+		`{"update_id": 600, "channel_post": {"message_id": 1, "chat": {"id": -100, "type": "channel"}, "text": "hi"}}`,
+		`{"update_id": 601, "message": "oops"}`,
+		fmt.Sprintf(TGMediaMsgTmpl, tgid, 602, `"text": "buy milk"`),
+	), send)
+	require.Nil(t, err)
+	assert.Equal(t, []string{MSG_SAVED}, sent)
+	assert.Equal(t, 602, lastUpdateID())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err = pollTG(ctx, bot, table, feed(ctx,
+		fmt.Sprintf(TGMediaMsgTmpl, tgid, 603, `"text": "call mom"`),
+		fmt.Sprintf(TGMediaMsgTmpl, 77, 604, `"text": "lost"`),
+	), func(reply *TGReply, upd *tb.Update) error { return nil })
+	require.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	// failed update is not skipped, the next run starts from it
+	assert.Equal(t, 603, lastUpdateID())
+}
@@ -0,0 +1,88 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+)
+
+const TGUpdateKeyPrefix = "tgupd#"
+
+// Telegram gives up on undelivered update after 24 hours
+var TGUpdateRefTTL = 48 * time.Hour
+
+// Maps Telegram update to Msg it was stored as, so update Telegram
+// delivers again does not make another Msg.
+// PK is tgupd#<bot PK>#<update id>
+type TGUpdateRef struct {
+	PK        string
+	SK        string
+	MsgPK     string `dynamodbav:"M"`
+	CreatedAt int64  `dynamodbav:"CRTD"`
+	TTL       int64  `dynamodbav:"TTL"`
+}
+
+// Update ids are sequential per bot
+func TGUpdateRefPK(botPK string, updateID int) string {
+	return fmt.Sprintf("%s%s#%d", TGUpdateKeyPrefix, botPK, updateID)
+}
+
+func NewTGUpdateRef(botPK string, updateID int, msgPK string) *TGUpdateRef {
+	pk := TGUpdateRefPK(botPK, updateID)
+	now := time.Now()
+	return &TGUpdateRef{PK: pk, SK: pk, MsgPK: msgPK, CreatedAt: now.Unix(), TTL: now.Add(TGUpdateRefTTL).Unix()}
+}
+
+// Stores new Msg of the update and its ref at once, error matching
+// ErrTransactionCanceled with Failed(0) means update is stored already
+func (t *DTable) StoreTGUpdateMsgWithContext(ctx context.Context, botPK string, updateID int,
+	msg *Msg, items ...interface{}) error {
+	items = append([]interface{}{NewTGUpdateRef(botPK, updateID, msg.PK), msg}, items...)
+	return t.StoreInTransUniqWithContext(ctx, items...)
+}
+
+// Steps done after Msg of Telegram message is stored, they are safe
+// to repeat, so update delivered again finishes what failed before
+func finishTGMsg(ctx context.Context, bot *Bot, table *DTable, tgmsg *tb.Message, msg *Msg) (*TGReply, error) {
+	if err := table.StoreItemWithContext(ctx, NewTGMsgRef(bot.PK, tgmsg, msg.PK)); err != nil {
+		return nil, err
+	}
+	if err := table.AddToThreadWithContext(ctx, msg); err != nil {
+		return nil, err
+	}
+	return &TGReply{Text: MSG_SAVED, Markup: MsgActionsMarkup(msg)}, nil
+}
+
+// Reply for update which Msg is stored already, done is false if
+// update is new
+func replayTGUpdate(ctx context.Context, bot *Bot, table *DTable, upd *tb.Update) (reply *TGReply, done bool, err error) {
+	ref := &TGUpdateRef{}
+	err = table.FetchItemWithContext(ctx, TGUpdateRefPK(bot.PK, upd.ID), ref)
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	msg := &Msg{}
+	err = table.FetchItemWithContext(ctx, ref.MsgPK, msg)
+	if errors.Is(err, ErrNotFound) {
+		// deleted by the user since, it is not made again
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	reply, err = finishTGMsg(ctx, bot, table, upd.Message, msg)
+	return reply, true, err
+}
+
+// Tells if error of StoreTGUpdateMsgWithContext means update is
+// stored by another delivery
+func isTGUpdateStored(err error) bool {
+	var tcErr *TransactionCanceledError
+	return errors.As(err, &tcErr) && tcErr.Failed(0)
+}
@@ -0,0 +1,73 @@
+package awsapi
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScenarioTGUpdateReplay(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	inbox := func() int {
+		lm := NewListMsg()
+		require.Nil(t, lm.FetchByUMS(table, user.PK, user.PK+"#0", 0, time.Now().Unix()+1))
+		return lm.Len()
+	}
+	send := func(orig string) *TGReply {
+		reply, err := HandleTGUpdate(ctx, bot, table, orig)
+		require.Nil(t, err)
+		return reply
+	}
+	note := fmt.Sprintf(TGMediaMsgTmpl, tgid, 400, `"text": "buy milk"`)
+	first := send(note)
+	// Telegram delivers the update again if it got no answer
+	second := send(note)
+	assert.Equal(t, 1, inbox())
+	assert.Equal(t, MSG_SAVED, second.Text)
+	assert.Equal(t, first.Markup.InlineKeyboard[0][0].Data, second.Markup.InlineKeyboard[0][0].Data)
+	ref := &TGUpdateRef{}
+	require.Nil(t, table.FetchItem(TGUpdateRefPK(bot.PK, 400), ref))
+	assert.InDelta(t, time.Now().Add(TGUpdateRefTTL).Unix(), ref.TTL, 2)
+
+	// Msg is stored but the rest failed, delivery again finishes it
+	msg, _ := NewMsg(bot.PK, user.PK, TGTextMsgKind)
+	msg.Data["text"] = "call mom"
+	require.Nil(t, table.StoreTGUpdateMsgWithContext(ctx, bot.PK, 401, msg))
+	reply := send(fmt.Sprintf(TGMediaMsgTmpl, tgid, 401, `"text": "call mom"`))
+	assert.Equal(t, MSG_SAVED, reply.Text)
+	assert.Equal(t, 2, inbox())
+	stored := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 401, Chat: &tb.Chat{ID: int64(tgid)}}, stored))
+	assert.Equal(t, msg.PK, stored.PK)
+
+	// Msg deleted since is not made again
+	require.Nil(t, table.DeleteSubItem(msg.PK, msg.PK))
+	assert.Nil(t, send(fmt.Sprintf(TGMediaMsgTmpl, tgid, 401, `"text": "call mom"`)))
+	assert.Equal(t, 1, inbox())
+
+	todo := fmt.Sprintf(TGMediaMsgTmpl, tgid, 402, `"text": "/todo fix bike"`)
+	assert.Equal(t, TASK_ADDED, send(todo).Text)
+	assert.Equal(t, TASK_ADDED, send(todo).Text)
+	lm := NewListMsg()
+	require.Nil(t, lm.FetchOpenTasksWithContext(ctx, table, user.PK))
+	assert.Equal(t, 1, lm.Len())
+
+	photo := fmt.Sprintf(TGAlbumPhotoTmpl, tgid, 403, "trip")
+	assert.Equal(t, MSG_SAVED, send(photo).Text)
+	assert.Equal(t, MSG_SAVED, send(photo).Text)
+	assert.Equal(t, 3, inbox())
+}
@@ -0,0 +1,143 @@
+package awsapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	TGMsgKeyPrefix  = "tgmsg#"
+	ThreadKeyPrefix = "thrd#"
+)
+
+// Maps Telegram message to Msg it was stored as,
+// PK is tgmsg#<bot PK>#<chat id>#<message id>
+type TGMsgRef struct {
+	PK        string
+	SK        string
+	MsgPK     string `dynamodbav:"M"`
+	CreatedAt int64  `dynamodbav:"CRTD"`
+}
+
+// Telegram numbers messages per chat, so chat id is part of the key
+func TGMsgRefPK(botPK string, chatID int64, msgID int) string {
+	return fmt.Sprintf("%s%s#%d#%d", TGMsgKeyPrefix, botPK, chatID, msgID)
+}
+
+func NewTGMsgRef(botPK string, tgmsg *tb.Message, msgPK string) *TGMsgRef {
+	var chatID int64
+	if tgmsg.Chat != nil {
+		chatID = tgmsg.Chat.ID
+	}
+	pk := TGMsgRefPK(botPK, chatID, tgmsg.ID)
+	return &TGMsgRef{PK: pk, SK: pk, MsgPK: msgPK, CreatedAt: tgmsg.Unixtime}
+}
+
+// Fetches Msg Telegram message was stored as, returns error matching
+// ErrNotFound if there is no such Msg
+func (t *DTable) FetchMsgByTG(botPK string, tgmsg *tb.Message, msg *Msg) error {
+	return t.FetchMsgByTGWithContext(context.Background(), botPK, tgmsg, msg)
+}
+
+func (t *DTable) FetchMsgByTGWithContext(ctx context.Context, botPK string, tgmsg *tb.Message, msg *Msg) error {
+	ref := &TGMsgRef{}
+	if err := t.FetchItemWithContext(ctx, NewTGMsgRef(botPK, tgmsg, "").PK, ref); err != nil {
+		return err
+	}
+	return t.FetchItemWithContext(ctx, ref.MsgPK, msg)
+}
+
+// Member of thread, PK is thrd#<PK of the first Msg of the thread>,
+// SK is PK of Msg, so members are ordered by time
+type ThreadItem struct {
+	PK        string
+	SK        string
+	CreatedAt int64 `dynamodbav:"CRTD"`
+}
+
+// Makes Msg a reply to parent, Msg joins the thread of parent
+// or starts a new one with parent as the first Msg
+func (m *Msg) ReplyTo(parent *Msg) {
+	m.ParentPK = parent.PK
+	m.ThreadPK = parent.ThreadPK
+	if m.ThreadPK == "" {
+		m.ThreadPK = parent.PK
+	}
+}
+
+// Stores thread index items for Msg and the first Msg of its thread
+func (t *DTable) AddToThread(msg *Msg) error {
+	return t.AddToThreadWithContext(context.Background(), msg)
+}
+
+func (t *DTable) AddToThreadWithContext(ctx context.Context, msg *Msg) error {
+	if msg.ThreadPK == "" {
+		return nil
+	}
+	pk := ThreadKeyPrefix + msg.ThreadPK
+	items := []interface{}{
+		&ThreadItem{PK: pk, SK: msg.PK, CreatedAt: msg.CreatedAt},
+	}
+	if msg.ParentPK == msg.ThreadPK {
+		items = append(items, &ThreadItem{PK: pk, SK: msg.ThreadPK, CreatedAt: msgPKTime(msg.ThreadPK)})
+	}
+	for _, err := range t.BatchStoreWithContext(ctx, items...) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes removed Msg from its thread
+func (t *DTable) RemoveFromThreadWithContext(ctx context.Context, msg *Msg) error {
+	if msg.ThreadPK == "" {
+		return nil
+	}
+	return t.DeleteSubItemWithContext(ctx, ThreadKeyPrefix+msg.ThreadPK, msg.PK)
+}
+
+// Fetches Msgs of the thread, the first Msg goes first and the rest
+// are ordered by time. Msgs deleted since they joined the thread are skipped
+func (t *DTable) FetchThread(threadPK string) ([]*Msg, error) {
+	return t.FetchThreadWithContext(context.Background(), threadPK)
+}
+
+func (t *DTable) FetchThreadWithContext(ctx context.Context, threadPK string) ([]*Msg, error) {
+	var items []*ThreadItem
+	err := t.FetchItemsWithPrefixWithContext(ctx, ThreadKeyPrefix+threadPK, MsgKeyPrefix, &items)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		items = append(items, &ThreadItem{SK: threadPK})
+	}
+	keys := make([]ItemKey, len(items))
+	for i, item := range items {
+		keys[i] = ItemKey{PK: item.SK, SK: item.SK}
+	}
+	var msgs []*Msg
+	for _, err := range t.BatchFetchWithContext(ctx, keys, &msgs) {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+	}
+	// Msgs created in the same second have random order of PKs
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].PK == threadPK && msgs[j].PK != threadPK })
+	return msgs, nil
+}
+
+// Returns time Msg with given PK was created at, 0 if PK is not a ksuid
+func msgPKTime(pk string) int64 {
+	id, err := ksuid.Parse(strings.TrimPrefix(pk, MsgKeyPrefix))
+	if err != nil {
+		return 0
+	}
+	return id.Time().Unix()
+}
@@ -0,0 +1,114 @@
+package awsapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	tb "github.com/dmitriko/wtctrl/pkg/telebot"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const TGReplyMsgTmpl = `{"update_id": %[2]d,
+  "message": {
+    "message_id": %[2]d,
+    "from": {"id": %[1]d, "is_bot": false, "first_name": "D"},
+    "chat": {"id": %[1]d, "first_name": "D", "type": "private"},
+    "date": 1571403799,
+    "reply_to_message": {
+      "message_id": %[3]d,
+      "from": {"id": %[1]d, "is_bot": false, "first_name": "D"},
+      "chat": {"id": %[1]d, "first_name": "D", "type": "private"},
+      "date": 1570375932
+    },
+    "text": "%[4]s"}
+}`
+
+func TestScenarioTGReplyThread(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	ctx := context.Background()
+	tgid := 123456789
+	bot, _ := NewBot(TGBotKind, "foobot")
+	user, _ := NewUser("someuser")
+	tgacc, _ := NewTGAcc(tgid, user.PK)
+	for _, err := range table.StoreItems(bot, user, tgacc) {
+		require.Nil(t, err)
+	}
+	_, err := HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGVoiceMsgTmpl, tgid, 1, "sometgfileid"))
+	require.Nil(t, err)
+	voice := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 92, Chat: &tb.Chat{ID: int64(tgid)}}, voice))
+	assert.Equal(t, int64(TGVoiceMsgKind), voice.Kind)
+
+	_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 182, 92, "first follow up"))
+	require.Nil(t, err)
+	_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 183, 182, "second follow up"))
+	require.Nil(t, err)
+	// reply to a message that was never stored starts no thread
+	_, err = HandleTGMsg(ctx, bot, table, fmt.Sprintf(TGReplyMsgTmpl, tgid, 184, 10, "unrelated"))
+	require.Nil(t, err)
+
+	second := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 183, Chat: &tb.Chat{ID: int64(tgid)}}, second))
+	first := &Msg{}
+	require.Nil(t, table.FetchItem(second.ParentPK, first))
+	assert.Equal(t, voice.PK, first.ParentPK)
+	assert.Equal(t, voice.PK, first.ThreadPK)
+	assert.Equal(t, voice.PK, second.ThreadPK)
+	unrelated := &Msg{}
+	require.Nil(t, table.FetchMsgByTG(bot.PK, &tb.Message{ID: 184, Chat: &tb.Chat{ID: int64(tgid)}}, unrelated))
+	assert.Equal(t, "", unrelated.ParentPK)
+
+	msgs, err := table.FetchThread(voice.PK)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(msgs))
+	assert.Equal(t, voice.PK, msgs[0].PK)
+	// follow ups are created in the same second, so their order is random
+	assert.ElementsMatch(t, []interface{}{"first follow up", "second follow up"},
+		[]interface{}{msgs[1].Data["text"], msgs[2].Data["text"]})
+
+	require.Nil(t, table.RemoveFromThreadWithContext(ctx, first))
+	msgs, _ = table.FetchThread(voice.PK)
+	assert.Equal(t, 2, len(msgs))
+}
+
+func TestCmdThreadFetch(t *testing.T) {
+	table := startLocalDynamo(t)
+	defer stopLocalDynamo()
+	user, _ := NewUser("user")
+	root, _ := NewMsg("bot1", user.PK, TGVoiceMsgKind, CreatedAtOp("-2d"))
+	reply1, _ := NewMsg("bot1", user.PK, TGTextMsgKind, CreatedAtOp("-1d"))
+	reply1.ReplyTo(root)
+	reply2, _ := NewMsg("bot1", user.PK, TGTextMsgKind)
+	reply2.ReplyTo(reply1)
+	for _, err := range table.StoreItems(root, reply1, reply2) {
+		require.Nil(t, err)
+	}
+	require.Nil(t, table.AddToThread(reply1))
+	require.Nil(t, table.AddToThread(reply2))
+
+	reqCtx := getProxyContext("MESSAGE", "foobar.com", "prod", "someid=", user.PK)
+	outCh := make(chan []byte)
+	doneCh := make(chan bool)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	output := make([]string, 0)
+	go collectOutput(ctx, &output, outCh, doneCh)
+	err := handleUserCmd(ctx, table, reqCtx, fmt.Sprintf(`{"name":"threadfetch", "id":"1", "pk":"%s"}`, reply2.PK), outCh)
+	if assert.Nil(t, err) {
+		doneCh <- true
+	}
+	require.Equal(t, 5, len(output))
+	var pks []string
+	for _, line := range output[1:4] {
+		item := make(map[string]interface{})
+		require.Nil(t, json.Unmarshal([]byte(line), &item))
+		pks = append(pks, item["pk"].(string))
+	}
+	assert.Equal(t, []string{root.PK, reply1.PK, reply2.PK}, pks)
+	assert.Contains(t, output[3], `"parent":"`+reply1.PK)
+}
@@ -8,6 +8,10 @@ import (
 
 const containerName = "dynamotest"
 
+// Set this env var to run tests against DynamoDB local in docker
+// instead of MemStorage
+const dockerDynamoEnv = "TEST_DYNAMO_DOCKER"
+
 func createDynamoWithTF(t *testing.T) {
 	cmd := exec.Command("terraform", "apply", "-refresh=false", "-auto-approve",
 		"-state=/dev/null", "-lock=false", "-var", "table_name=MainTest", "dynamodb-testing")
@@ -30,8 +34,18 @@ func createDynamoFromGO(t *testing.T, testTable *DTable) {
 	}
 }
 
-// Creates container with local DynamodDB, create table
+// Creates table on MemStorage, or container with local DynamodDB
+// and the table there if TEST_DYNAMO_DOCKER is set
 func startLocalDynamo(t *testing.T) *DTable {
+	// presigned S3 urls need some credentials, they are never checked in tests
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		os.Setenv("AWS_ACCESS_KEY_ID", "test")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	}
+	if os.Getenv(dockerDynamoEnv) == "" {
+		testTable, _ := NewMemDTable("MainTest")
+		return testTable
+	}
 	cmd := exec.Command("docker", "run", "--rm", "-d", "--name", containerName,
 		"-p", "8000:8000", "amazon/dynamodb-local:latest")
 	cmd.Stderr = os.Stderr
@@ -52,6 +66,9 @@ func startLocalDynamo(t *testing.T) *DTable {
 }
 
 func stopLocalDynamo() {
+	if os.Getenv(dockerDynamoEnv) == "" {
+		return
+	}
 	cmd := exec.Command("docker", "kill", containerName)
 	cmd.Run()
 }
@@ -0,0 +1,26 @@
+package awsapi
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// Random token for Telegram webhook secret_token, hex fits
+// the characters Telegram allows
+func NewWebhookToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Tells if token sent with webhook request is the one of the bot,
+// compared in constant time. Bot without token accepts nothing
+func (b *Bot) CheckWebhookToken(token string) bool {
+	if b.WebhookToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(b.WebhookToken)) == 1
+}
@@ -2,12 +2,16 @@ package telebot
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
 )
 
+// SecretTokenHeader is the header Telegram sends Webhook.SecretToken in.
+const SecretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
 // A WebhookTLS specifies the path to a key and a cert so the poller can open
 // a TLS listener
 type WebhookTLS struct {
@@ -43,6 +47,11 @@ type Webhook struct {
 	MaxConnections int      `json:"max_connections"`
 	AllowedUpdates []string `json:"allowed_updates"`
 
+	// (Optional) Telegram sends it in SecretTokenHeader of every
+	// request, so the webhook can tell updates are genuine.
+	// 1-256 characters, only A-Z, a-z, 0-9, _ and - are allowed.
+	SecretToken string `json:"-"`
+
 	// (WebhookInfo)
 	HasCustomCert  bool   `json:"has_custom_certificate"`
 	PendingUpdates int    `json:"pending_update_count"`
@@ -88,6 +97,9 @@ func (h *Webhook) getParams() map[string]string {
 		data, _ := json.Marshal(h.AllowedUpdates)
 		params["allowed_updates"] = string(data)
 	}
+	if h.SecretToken != "" {
+		params["secret_token"] = h.SecretToken
+	}
 
 	if h.TLS != nil {
 		params["url"] = "https://" + h.Listen
@@ -142,9 +154,23 @@ func (h *Webhook) waitForStop(stop chan struct{}) {
 	close(stop)
 }
 
+// CheckSecretToken reports whether token equals SecretToken,
+// in constant time. Any token matches if SecretToken is not set.
+func (h *Webhook) CheckSecretToken(token string) bool {
+	if h.SecretToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.SecretToken)) == 1
+}
+
 // The handler simply reads the update from the body of the requests
-// and writes them to the update channel.
+// and writes them to the update channel. Requests without the right
+// secret token are rejected.
 func (h *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.CheckSecretToken(r.Header.Get(SecretTokenHeader)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	var update Update
 	err := json.NewDecoder(r.Body).Decode(&update)
 	if err != nil {
@@ -0,0 +1,46 @@
+package telebot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSecretToken(t *testing.T) {
+	h := &Webhook{
+		Endpoint:    &WebhookEndpoint{PublicURL: "https://example.com/bot"},
+		SecretToken: "s3cret_Token-1",
+	}
+	params := h.getParams()
+	assert.Equal(t, "s3cret_Token-1", params["secret_token"])
+	assert.Equal(t, "https://example.com/bot", params["url"])
+
+	assert.True(t, h.CheckSecretToken("s3cret_Token-1"))
+	assert.False(t, h.CheckSecretToken("s3cret_Token-2"))
+	assert.False(t, h.CheckSecretToken(""))
+
+	dest := make(chan Update, 1)
+	h.dest = dest
+	post := func(token string) int {
+		r := httptest.NewRequest(http.MethodPost, "/bot", strings.NewReader(`{"update_id": 1}`))
+		if token != "" {
+			r.Header.Set(SecretTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, post("forged"))
+	assert.Equal(t, 0, len(dest))
+	assert.Equal(t, http.StatusOK, post("s3cret_Token-1"))
+	require.Equal(t, 1, len(dest))
+	assert.Equal(t, 1, (<-dest).ID)
+
+	_, ok := (&Webhook{}).getParams()["secret_token"]
+	assert.False(t, ok)
+	assert.True(t, (&Webhook{}).CheckSecretToken(""))
+}
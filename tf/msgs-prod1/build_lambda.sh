@@ -10,3 +10,8 @@ cd "../../lambda/dstream"
 CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags="-s -w" -v
 
 cd $curr
+
+cd "../../lambda/scheduler"
+CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -ldflags="-s -w" -v
+
+cd $curr
@@ -1,8 +1,24 @@
 #!/bin/sh
+set -e
 CDIR=$(pwd)
 DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" && pwd )"
 cd $DIR
+# wtctrl takes the table from $DYNAMO_TABLE and $DYNAMO_REGION,
+# $TGBOT_NAMES lists bots which webhook this API serves
+WTCTRL="go run ../../cmd/wtctrl"
+BOTS=${TGBOT_NAMES:-${TF_VAR_tgbot_name:-wtctrlbot}}
+# webhook is not managed by terraform anymore, it must not be destroyed
+terraform state rm telegram_bot_webhook.tgwebhook 2>/dev/null || true
+# tgwebhook rejects updates for bots without webhook token, so bots
+# registered before get one and deploy stops if any is left
+$WTCTRL db migrate up
+$WTCTRL db migrate check
 ./build_lambda.sh && terraform apply -auto-approve
+# Telegram sends the token only after webhook is set with it
+URL=$(terraform output -raw tgwebhook_url)
+for BOT in $BOTS; do
+    $WTCTRL tgbot rotate-token --bot-name=$BOT --url=$URL/$BOT
+done
 rm -rf ../../lambda/dstream/dstream
 rm -rf ../../lambda/tgwebhook/tgwebhook
 cd $CDIR
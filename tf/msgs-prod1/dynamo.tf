@@ -25,6 +25,11 @@ resource "aws_dynamodb_table" "main" {
         type = "S"
     }
 
+    attribute {
+        name = "TSK"
+        type = "S"
+    }
+
     attribute {
         name = "CRTD"
         type = "N"
@@ -36,7 +41,7 @@ resource "aws_dynamodb_table" "main" {
     }
 
     stream_enabled   = true
-    stream_view_type = "NEW_IMAGE"
+    stream_view_type = "NEW_AND_OLD_IMAGES"
 
     global_secondary_index {
         name               = "UMSIndex"
@@ -53,5 +58,12 @@ resource "aws_dynamodb_table" "main" {
         projection_type    = "INCLUDE"
         non_key_attributes = ["PK", "A"]
     }
-}
 
+    global_secondary_index {
+        name               = "TaskIndex"
+        hash_key           = "TSK"
+        range_key          = "CRTD"
+        projection_type    = "INCLUDE"
+        non_key_attributes = ["PK", "K", "UMS", "TS", "ASG", "CMPL"]
+    }
+}
@@ -7,17 +7,23 @@ terraform {
 }
 
 variable "table_name" {}
-variable "tgbot_secret" {}
+variable "tgbot_name" {
+    default = "wtctrlbot"
+}
+variable "trash_retention_days" {
+    default = 30
+}
+# time zone of users who have not set one with /tz
+variable "reminder_tz" {
+    default = "UTC"
+}
 variable "speech_key" {}
 variable "azure_region" {}
 
 locals {
     webhook_func_name = "tgwebhook_prod1"
     dstream_func_name = "dstream_prod1"
-}
-
-provider "telegram" {
-    bot_token = var.tgbot_secret
+    scheduler_func_name = "scheduler_prod1"
 }
 
 resource "aws_s3_bucket" "images" {
@@ -57,6 +63,11 @@ resource "aws_cloudwatch_log_group" "dstream" {
     retention_in_days = 7
 }
 
+resource "aws_cloudwatch_log_group" "scheduler" {
+    name = "/aws/lambda/${local.scheduler_func_name}"
+    retention_in_days = 7
+}
+
 resource "aws_iam_role" "lambda" {
     name                = "lambda"
     assume_role_policy = <<POLICY
@@ -136,8 +147,10 @@ resource "aws_lambda_function" "tgwebhook" {
     source_code_hash = data.archive_file.tgwebhook.output_base64sha256
     environment  {
         variables = {
-            TGBOT_SECRET = var.tgbot_secret
+            TGBOT_NAME = var.tgbot_name
             TABLE_NAME = var.table_name
+            TRASH_RETENTION_DAYS = var.trash_retention_days
+            REMINDER_TZ = var.reminder_tz
         }
     }
 }
@@ -149,6 +162,20 @@ resource "aws_apigatewayv2_api" "tgwebhook" {
     route_key = "POST /"
 }
 
+# Webhook of each registered bot is <api url>/<bot name>
+resource "aws_apigatewayv2_integration" "tgwebhook" {
+    api_id = aws_apigatewayv2_api.tgwebhook.id
+    integration_type = "AWS_PROXY"
+    integration_uri = aws_lambda_function.tgwebhook.arn
+    payload_format_version = "1.0"
+}
+
+resource "aws_apigatewayv2_route" "tgwebhook_bot" {
+    api_id = aws_apigatewayv2_api.tgwebhook.id
+    route_key = "POST /{bot}"
+    target = "integrations/${aws_apigatewayv2_integration.tgwebhook.id}"
+}
+
 resource "aws_lambda_permission" "tgwebhook" {
     statement_id = "tgwebhookLambda"
     function_name = aws_lambda_function.tgwebhook.function_name
@@ -157,9 +184,10 @@ resource "aws_lambda_permission" "tgwebhook" {
     source_arn = "${aws_apigatewayv2_api.tgwebhook.execution_arn}/*/*/*"
 }
 
-resource "telegram_bot_webhook" "tgwebhook" {
-    url  = aws_apigatewayv2_api.tgwebhook.api_endpoint
-    max_connections = 100
+# Webhook carries per bot secret token, so it is set by
+# wtctrl tgbot register --url=<tgwebhook_url>/<bot name>
+output "tgwebhook_url" {
+    value = aws_apigatewayv2_api.tgwebhook.api_endpoint
 }
 
 data "archive_file" "dstream" {
@@ -179,7 +207,6 @@ resource "aws_lambda_function" "dstream" {
     source_code_hash = data.archive_file.dstream.output_base64sha256
     environment  {
         variables = {
-            TGBOT_SECRET = var.tgbot_secret
             TABLE_NAME = var.table_name
             AZURE_SPEECH2TEXT_KEY = var.speech_key
             AZURE_REGION = var.azure_region
@@ -193,3 +220,43 @@ resource "aws_lambda_event_source_mapping" "dstream" {
   function_name     = aws_lambda_function.dstream.arn
   starting_position = "LATEST"
 }
+
+data "archive_file" "scheduler" {
+    type = "zip"
+    source_file = "${path.root}/../../lambda/scheduler/scheduler"
+    output_path = "/tmp/scheduler.zip"
+}
+
+resource "aws_lambda_function" "scheduler" {
+    function_name = local.scheduler_func_name
+    runtime = "go1.x"
+    handler = "scheduler"
+    memory_size = 128
+    timeout = 50
+    role = aws_iam_role.lambda.arn
+    filename = data.archive_file.scheduler.output_path
+    source_code_hash = data.archive_file.scheduler.output_base64sha256
+    environment  {
+        variables = {
+            TABLE_NAME = var.table_name
+        }
+    }
+}
+
+resource "aws_cloudwatch_event_rule" "scheduler" {
+    name = "scheduler_prod1"
+    schedule_expression = "rate(1 minute)"
+}
+
+resource "aws_cloudwatch_event_target" "scheduler" {
+    rule = aws_cloudwatch_event_rule.scheduler.name
+    arn = aws_lambda_function.scheduler.arn
+}
+
+resource "aws_lambda_permission" "scheduler" {
+    statement_id = "schedulerLambda"
+    function_name = aws_lambda_function.scheduler.function_name
+    action = "lambda:InvokeFunction"
+    principal = "events.amazonaws.com"
+    source_arn = aws_cloudwatch_event_rule.scheduler.arn
+}
@@ -13,6 +13,13 @@ provider "aws" {
 
 variable "table_name" {}
 variable "tgbot_secret" {}
+variable "trash_retention_days" {
+  default = 30
+}
+# time zone of users who have not set one with /tz
+variable "reminder_tz" {
+  default = "UTC"
+}
 
 variable domain {
   default = "wtctrl.com"
@@ -178,7 +185,9 @@ resource "aws_lambda_function" "wsdefault" {
   source_code_hash = data.archive_file.wsdefault.output_base64sha256
   environment {
     variables = {
-      TABLE_NAME = var.table_name
+      TABLE_NAME           = var.table_name
+      TRASH_RETENTION_DAYS = var.trash_retention_days
+      REMINDER_TZ          = var.reminder_tz
     }
   }
 }